@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nadoo/glider/common/log"
+	"github.com/nadoo/glider/dns"
+	"github.com/nadoo/glider/proxy"
+	"github.com/nadoo/glider/rule"
+)
+
+// api is the http api to query the running instance, it has no authentication,
+// so it should listen on a local address only.
+type api struct {
+	proxy *rule.Proxy
+	dns   *dns.Server
+}
+
+// serveAPI starts the http api on addr.
+func serveAPI(addr string, a *api) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns/querylog", a.queryLog)
+	mux.HandleFunc("/explain", a.explain)
+	mux.HandleFunc("/rule/stats", a.ruleStats)
+
+	log.F("[api] listening on %s", addr)
+	go http.Serve(ln, mux)
+
+	return nil
+}
+
+// queryLog returns the recent dns queries, newest first, parameters:
+// n: max number of entries, default 100, 0 means no limit;
+// client, qname: substring of the client address and the query name.
+func (a *api) queryLog(w http.ResponseWriter, r *http.Request) {
+	if a.dns == nil || a.dns.QueryLog() == nil || !a.dns.QueryLog().KeepsRecent() {
+		http.Error(w, "recent dns queries are not kept, set dnsquerylogrecent to enable it", http.StatusNotFound)
+		return
+	}
+
+	n := 100
+	if v := r.FormValue("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid n: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	writeJSON(w, a.dns.QueryLog().Recent(n, r.FormValue("client"), r.FormValue("qname")))
+}
+
+// explain returns how a connection is routed by the running instance, parameters:
+// target: [tcp|udp://]HOST:PORT; src: client address, IP[:PORT]; inbound: listener name.
+func (a *api) explain(w http.ResponseWriter, r *http.Request) {
+	network, target := parseTarget(r.FormValue("target"))
+	sess, err := explainSession(network, r.FormValue("src"), r.FormValue("inbound"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, a.proxy.Explain(network, target, sess))
+}
+
+// ruleStats returns the statistics of rules, including the number of ips learned from dns answers.
+func (a *api) ruleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.proxy.Stats())
+}
+
+// parseTarget parses the target to explain, format: [tcp|udp://]HOST:PORT.
+func parseTarget(target string) (network, addr string) {
+	if i := strings.Index(target, "://"); i != -1 {
+		return target[:i], target[i+3:]
+	}
+	return "tcp", target
+}
+
+// explainSession returns the session of the connection to explain, src format: IP[:PORT].
+func explainSession(network, src, inbound string) (*proxy.Session, error) {
+	sess := &proxy.Session{Inbound: inbound}
+	if src == "" {
+		return sess, nil
+	}
+
+	host, port := src, 0
+	if h, p, err := net.SplitHostPort(src); err == nil {
+		if port, err = strconv.Atoi(p); err != nil {
+			return nil, errors.New("invalid src port: " + src)
+		}
+		host = h
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("invalid src ip: " + src)
+	}
+
+	if network == "udp" {
+		sess.Src = &net.UDPAddr{IP: ip, Port: port}
+	} else {
+		sess.Src = &net.TCPAddr{IP: ip, Port: port}
+	}
+
+	return sess, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
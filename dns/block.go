@@ -0,0 +1,263 @@
+package dns
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nadoo/glider/common/log"
+)
+
+// Block modes, how to answer the queries of blocked domains.
+const (
+	BlockNXDomain = "nxdomain"
+	BlockZeroIP   = "zeroip"
+	BlockRefused  = "refused"
+)
+
+// ValidBlockMode reports whether mode is a valid block mode, empty means nxdomain.
+func ValidBlockMode(mode string) bool {
+	switch mode {
+	case "", BlockNXDomain, BlockZeroIP, BlockRefused:
+		return true
+	}
+	return false
+}
+
+// blockAnswerTTL is the TTL of answers to blocked domains.
+const blockAnswerTTL = 60
+
+// DomainSet is a compact set of domains for suffix matching, it can hold millions of
+// domains with little memory: all the domains are reversed, sorted and stored in one
+// byte slice, and a domain matches if it or any of its parent domains is in the set.
+type DomainSet struct {
+	data []byte
+	offs []uint32 // start offset of each domain in data
+}
+
+// NewDomainSet returns a new domain set, subdomains of other domains in the set are removed.
+func NewDomainSet(domains []string) *DomainSet {
+	rs := make([]string, 0, len(domains))
+	for _, d := range domains {
+		if d = strings.TrimSuffix(strings.ToLower(d), "."); d != "" {
+			rs = append(rs, reverse(d))
+		}
+	}
+	sort.Strings(rs)
+
+	s := &DomainSet{}
+	prev := ""
+	for _, r := range rs {
+		// duplicated or covered by the parent domain
+		if prev != "" && (r == prev || strings.HasPrefix(r, prev+".")) {
+			continue
+		}
+		s.offs = append(s.offs, uint32(len(s.data)))
+		s.data = append(s.data, r...)
+		prev = r
+	}
+
+	return s
+}
+
+// Len returns the number of domains in set.
+func (s *DomainSet) Len() int {
+	return len(s.offs)
+}
+
+// at returns the i-th reversed domain in set.
+func (s *DomainSet) at(i int) []byte {
+	end := len(s.data)
+	if i+1 < len(s.offs) {
+		end = int(s.offs[i+1])
+	}
+	return s.data[s.offs[i]:end]
+}
+
+func (s *DomainSet) contains(r string) bool {
+	i := sort.Search(len(s.offs), func(i int) bool { return string(s.at(i)) >= r })
+	return i < len(s.offs) && string(s.at(i)) == r
+}
+
+// Match reports whether domain or any of its parent domains is in set.
+func (s *DomainSet) Match(domain string) bool {
+	if s == nil || len(s.offs) == 0 {
+		return false
+	}
+
+	r := reverse(strings.TrimSuffix(strings.ToLower(domain), "."))
+	for i := 0; i <= len(r); i++ {
+		if i == len(r) || r[i] == '.' {
+			if s.contains(r[:i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reverse returns the reversed string of s.
+func reverse(s string) string {
+	b := make([]byte, len(s))
+	for i := 0; i < len(s); i++ {
+		b[len(s)-1-i] = s[i]
+	}
+	return string(b)
+}
+
+// Blocklist holds domains from block list files.
+type Blocklist struct {
+	mu    sync.RWMutex
+	block *DomainSet
+	allow *DomainSet
+
+	files []string
+}
+
+// NewBlocklist returns a new block list, files will be reloaded when changed.
+func NewBlocklist(files []string) *Blocklist {
+	b := &Blocklist{files: files}
+	if len(files) > 0 {
+		b.reload()
+		watchFiles(files, b.reload)
+	}
+	return b
+}
+
+// Blocked reports whether domain is blocked.
+func (b *Blocklist) Blocked(domain string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.block.Match(domain) && !b.allow.Match(domain)
+}
+
+// reload reloads all the block list files.
+func (b *Blocklist) reload() {
+	var block, allow []string
+	for _, file := range b.files {
+		if err := loadBlocklistFile(file, &block, &allow); err != nil {
+			log.F("[dns] failed to load block list %s: %v", file, err)
+		}
+	}
+
+	blockSet, allowSet := NewDomainSet(block), NewDomainSet(allow)
+
+	b.mu.Lock()
+	b.block, b.allow = blockSet, allowSet
+	b.mu.Unlock()
+
+	log.F("[dns] loaded %d blocked domains and %d allowed domains from block lists",
+		blockSet.Len(), allowSet.Len())
+}
+
+// loadBlocklistFile loads domains from block list file, supported formats:
+// hosts: "0.0.0.0 ads.example.com", adblock: "||ads.example.com^", "@@||example.com^"(allow),
+// and plain domain: "ads.example.com". Comments start with "#" or "!".
+func loadBlocklistFile(file string, block, allow *[]string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+
+		list := block
+		if strings.HasPrefix(line, "@@") {
+			list, line = allow, line[2:]
+		}
+
+		if strings.HasPrefix(line, "||") {
+			// adblock rules with modifiers only apply to some requests, skip them
+			if i := strings.IndexByte(line, '^'); i != -1 && i == len(line)-1 {
+				if d := line[2:i]; isDomain(d) {
+					*list = append(*list, d)
+				}
+			}
+			continue
+		}
+
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 1 && isDomain(fields[0]):
+			*list = append(*list, fields[0])
+		case len(fields) > 1 && net.ParseIP(fields[0]) != nil:
+			for _, d := range fields[1:] {
+				if isDomain(d) && !localNames[d] {
+					*list = append(*list, d)
+				}
+			}
+		}
+	}
+
+	return s.Err()
+}
+
+// localNames are the names in hosts files which should not be blocked.
+var localNames = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true,
+	"broadcasthost": true, "ip6-localhost": true, "ip6-loopback": true,
+	"ip6-localnet": true, "ip6-mcastprefix": true, "ip6-allnodes": true,
+	"ip6-allrouters": true, "ip6-allhosts": true, "0.0.0.0": true,
+}
+
+// isDomain reports whether s looks like a domain name.
+func isDomain(s string) bool {
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// blocked reports whether qname should be blocked: it's in block lists, or
+// it's routed to REJECT and blockreject is enabled.
+func (c *Client) blocked(qname string) bool {
+	if c.blocklist.Blocked(qname) {
+		return true
+	}
+	return c.config.BlockReject && c.route(qname+":0").Reject
+}
+
+// blockResponse makes the response of blocked request according to the block mode.
+func (c *Client) blockResponse(req *Message) *Message {
+	m := NewMessage(req.ID, Response)
+	m.SetQuestion(req.Question)
+
+	rcode := RCodeNameError
+	switch c.config.BlockMode {
+	case BlockRefused:
+		rcode = RCodeRefused
+	case BlockZeroIP:
+		rcode = RCodeSuccess
+		switch req.Question.QTYPE {
+		case QTypeA:
+			m.AddAnswer(&RR{NAME: req.Question.QNAME, TYPE: QTypeA, CLASS: ClassINET,
+				TTL: blockAnswerTTL, RDLENGTH: net.IPv4len, RDATA: net.IPv4zero.To4()})
+		case QTypeAAAA:
+			m.AddAnswer(&RR{NAME: req.Question.QNAME, TYPE: QTypeAAAA, CLASS: ClassINET,
+				TTL: blockAnswerTTL, RDLENGTH: net.IPv6len, RDATA: net.IPv6zero})
+		}
+	}
+
+	m.setFlag(1, 0, 0, 0, (req.Bits>>8)&1, 1, rcode)
+	return m
+}
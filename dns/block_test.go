@@ -0,0 +1,146 @@
+package dns
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDomainSet(t *testing.T) {
+	s := NewDomainSet([]string{"Example.COM", "ads.example.com", "tracker.net.", "a.b.c.org", "tracker.net", "", "x"})
+	if s.Len() != 4 {
+		t.Errorf("len = %d, want 4: subdomains and duplicates removed", s.Len())
+	}
+
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.com.", true},
+		{"www.example.com", true},
+		{"a.ads.example.com", true},
+		{"myexample.com", false},
+		{"example.com.cn", false},
+		{"com", false},
+		{"tracker.net", true},
+		{"b.c.org", false},
+		{"a.b.c.org", true},
+		{"z.a.b.c.org", true},
+		{"xa.b.c.org", false},
+		{"x", true},
+		{"y.x", true},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := s.Match(tt.domain); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+
+	var empty *DomainSet
+	if empty.Match("example.com") || NewDomainSet(nil).Match("example.com") {
+		t.Error("empty set matches")
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hosts := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(hosts, []byte(`# comment
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com # inline comment
+::1 ip6-localhost
+plain.example.org
+`), 0644)
+
+	adblock := filepath.Join(dir, "adblock.txt")
+	ioutil.WriteFile(adblock, []byte(`! comment
+||adserver.net^
+||partial.net^$third-party
+@@||good.adserver.net^
+/regexp/
+`), 0644)
+
+	b := NewBlocklist([]string{hosts, adblock, filepath.Join(dir, "none")})
+
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"ads.example.com", true},
+		{"x.tracker.example.com", true},
+		{"example.com", false},
+		{"localhost", false},
+		{"ip6-localhost", false},
+		{"plain.example.org", true},
+		{"adserver.net", true},
+		{"a.adserver.net", true},
+		{"good.adserver.net", false},
+		{"x.good.adserver.net", false},
+		{"partial.net", false},
+	}
+
+	for _, tt := range tests {
+		if got := b.Blocked(tt.domain); got != tt.want {
+			t.Errorf("Blocked(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestBlockResponse(t *testing.T) {
+	tests := []struct {
+		mode    string
+		qtype   uint16
+		rcode   uint16
+		answers []string
+	}{
+		{BlockNXDomain, QTypeA, RCodeNameError, nil},
+		{BlockRefused, QTypeAAAA, RCodeRefused, nil},
+		{BlockZeroIP, QTypeA, RCodeSuccess, []string{"0.0.0.0"}},
+		{BlockZeroIP, QTypeAAAA, RCodeSuccess, []string{"::"}},
+		{BlockZeroIP, QTypeTXT, RCodeSuccess, nil},
+	}
+
+	for _, tt := range tests {
+		c := &Client{config: &Config{BlockMode: tt.mode}}
+		req := NewMessage(1, Query)
+		req.SetQuestion(NewQuestion(tt.qtype, "ads.example.com"))
+
+		b, err := c.blockResponse(req).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := UnmarshalMessage(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var answers []string
+		for _, rr := range m.Answers {
+			answers = append(answers, rr.IP)
+		}
+		if m.RCODE() != tt.rcode || len(answers) != len(tt.answers) || len(answers) > 0 && answers[0] != tt.answers[0] {
+			t.Errorf("mode %s type %d: rcode %d, answers %v, want %d, %v", tt.mode, tt.qtype, m.RCODE(), answers, tt.rcode, tt.answers)
+		}
+	}
+}
+
+func TestValidBlockMode(t *testing.T) {
+	for mode, want := range map[string]bool{"": true, "nxdomain": true, "zeroip": true, "refused": true, "NXDOMAIN": false, "drop": false} {
+		if got := ValidBlockMode(mode); got != want {
+			t.Errorf("ValidBlockMode(%q) = %v, want %v", mode, got, want)
+		}
+	}
+
+	if _, err := NewClient(nil, &Config{BlockMode: "drop"}); err == nil {
+		t.Error("NewClient with invalid block mode: expected error")
+	}
+}
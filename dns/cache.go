@@ -1,83 +1,316 @@
 package dns
 
 import (
+	"bytes"
+	"container/heap"
+	"container/list"
+	"encoding/gob"
+	"hash/fnv"
+	"os"
 	"sync"
 	"time"
 
+	"github.com/nadoo/glider/common/fileutil"
 	"github.com/nadoo/glider/common/pool"
 )
 
 // LongTTL is 50 years duration in seconds, used for none-expired items.
+// Items with LongTTL are static: they will not be evicted or persisted.
 const LongTTL = 50 * 365 * 24 * 3600
 
+// cacheShards is the number of cache shards.
+const cacheShards = 16
+
+const (
+	// prefetchMinHits is the min hits of an item to be prefetched.
+	prefetchMinHits = 3
+	// refreshInterval is the min interval between two refreshes of the same item.
+	refreshInterval = 10 * time.Second
+)
+
 type item struct {
-	value  []byte
-	expire time.Time
+	key       string
+	value     []byte
+	expire    time.Time
+	ttl       int
+	hits      int
+	refreshed time.Time
+	static    bool
+	index     int           // index in the expiry heap
+	elem      *list.Element // element in the lru list
+}
+
+// expiryHeap is a min heap of items ordered by expire time.
+type expiryHeap []*item
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expire.Before(h[j].expire) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
 }
 
-// Cache is the struct of cache.
+func (h *expiryHeap) Push(x interface{}) {
+	it := x.(*item)
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	it.index = -1
+	return it
+}
+
+// shard is a part of cache with its own lock.
+type shard struct {
+	mu     sync.Mutex
+	items  map[string]*item
+	lru    *list.List // front: most recently used, static items not included
+	expiry expiryHeap // static items not included
+	size   int
+}
+
+// Cache is a size bounded lru cache with sharded locks.
 type Cache struct {
-	store     map[string]*item
-	mutex     sync.RWMutex
+	shards    [cacheShards]*shard
 	storeCopy bool
+
+	stale    time.Duration // keep expired items for serve-stale
+	prefetch bool          // refresh popular items before they expire
 }
 
-// NewCache returns a new cache.
-func NewCache(storeCopy bool) (c *Cache) {
-	c = &Cache{store: make(map[string]*item), storeCopy: storeCopy}
+// NewCache returns a new cache holds at most size items(static items not counted),
+// expired items will be kept for stale duration to serve stale answers.
+func NewCache(size int, stale time.Duration, prefetch, storeCopy bool) (c *Cache) {
+	c = &Cache{storeCopy: storeCopy, stale: stale, prefetch: prefetch}
+
+	shardSize := size / cacheShards
+	if shardSize < 1 {
+		shardSize = 1
+	}
+
+	for i := range c.shards {
+		c.shards[i] = &shard{items: make(map[string]*item), lru: list.New(), size: shardSize}
+	}
+
 	go func() {
 		for now := range time.Tick(time.Second) {
-			c.mutex.Lock()
-			for k, v := range c.store {
-				if now.After(v.expire) {
-					delete(c.store, k)
-					if storeCopy {
-						pool.PutBuffer(v.value)
-					}
+			for _, s := range c.shards {
+				s.mu.Lock()
+				for len(s.expiry) > 0 && now.After(s.expiry[0].expire.Add(c.stale)) {
+					c.remove(s, s.expiry[0])
 				}
+				s.mu.Unlock()
 			}
-			c.mutex.Unlock()
 		}
 	}()
+
 	return
 }
 
+func (c *Cache) shard(k string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(k))
+	return c.shards[h.Sum32()%cacheShards]
+}
+
+// remove removes the item from shard s, the caller must hold the lock.
+func (c *Cache) remove(s *shard, it *item) {
+	delete(s.items, it.key)
+	if !it.static {
+		s.lru.Remove(it.elem)
+		heap.Remove(&s.expiry, it.index)
+	}
+	if c.storeCopy {
+		pool.PutBuffer(it.value)
+	}
+}
+
 // Len returns the length of cache.
-func (c *Cache) Len() int {
-	return len(c.store)
+func (c *Cache) Len() (n int) {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += len(s.items)
+		s.mu.Unlock()
+	}
+	return
 }
 
 // Put an item into cache, invalid after ttl seconds.
 func (c *Cache) Put(k string, v []byte, ttl int) {
-	if len(v) != 0 {
-		c.mutex.Lock()
-		it, ok := c.store[k]
-		if !ok {
-			if c.storeCopy {
-				it = &item{value: valCopy(v)}
-			} else {
-				it = &item{value: v}
-			}
-			c.store[k] = it
-		}
-		it.expire = time.Now().Add(time.Duration(ttl) * time.Second)
-		c.mutex.Unlock()
+	if len(v) == 0 {
+		return
+	}
+
+	if c.storeCopy {
+		v = valCopy(v)
+	}
+
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hits := 0
+	if it, ok := s.items[k]; ok {
+		hits = it.hits
+		c.remove(s, it)
+	}
+
+	it := &item{key: k, value: v, ttl: ttl, hits: hits, expire: time.Now().Add(time.Duration(ttl) * time.Second)}
+	s.items[k] = it
+
+	if ttl >= LongTTL {
+		it.static = true
+		return
+	}
+
+	it.elem = s.lru.PushFront(it)
+	heap.Push(&s.expiry, it)
+
+	// evict the least recently used item
+	if s.lru.Len() > s.size {
+		c.remove(s, s.lru.Back().Value.(*item))
 	}
 }
 
 // Get gets an item from cache(do not modify it).
+// NOTE: when storeCopy is true, use GetCopy instead, as the value may be reused after evicted.
 func (c *Cache) Get(k string) (v []byte) {
-	c.mutex.RLock()
-	if it, ok := c.store[k]; ok {
+	s := c.shard(k)
+	s.mu.Lock()
+	if it, ok := s.get(k); ok {
 		v = it.value
 	}
-	c.mutex.RUnlock()
+	s.mu.Unlock()
 	return
 }
 
 // GetCopy gets an item from cache and returns it's copy(so you can modify it).
-func (c *Cache) GetCopy(k string) []byte {
-	return valCopy(c.Get(k))
+func (c *Cache) GetCopy(k string) (v []byte) {
+	s := c.shard(k)
+	s.mu.Lock()
+	if it, ok := s.get(k); ok {
+		v = valCopy(it.value)
+	}
+	s.mu.Unlock()
+	return
+}
+
+// Lookup gets an item from cache and returns it's copy, expired items will also be returned
+// in the serve-stale period. ttl is the remaining ttl in seconds: 0 for static items and
+// negative for stale items. refresh reports whether the caller should refresh the item:
+// when it's stale, or it's popular and about to expire in prefetch mode.
+// https://tools.ietf.org/html/rfc8767
+func (c *Cache) Lookup(k string) (v []byte, ttl int, refresh bool) {
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it, ok := s.items[k]
+	if !ok {
+		return
+	}
+
+	if it.static {
+		return valCopy(it.value), 0, false
+	}
+
+	now := time.Now()
+	remain := it.expire.Sub(now)
+	if remain <= -c.stale {
+		return
+	}
+
+	s.lru.MoveToFront(it.elem)
+	it.hits++
+
+	stale := remain <= 0
+	if stale {
+		ttl = int(remain/time.Second) - 1
+	} else {
+		ttl = int((remain + time.Second - 1) / time.Second)
+	}
+
+	popular := c.prefetch && it.hits >= prefetchMinHits &&
+		remain <= time.Duration(it.ttl)*time.Second/10
+	if (stale || popular) && now.Sub(it.refreshed) > refreshInterval {
+		it.refreshed = now
+		refresh = true
+	}
+
+	return valCopy(it.value), ttl, refresh
+}
+
+// get gets an unexpired item and marks it as recently used, the caller must hold the lock.
+func (s *shard) get(k string) (*item, bool) {
+	it, ok := s.items[k]
+	if !ok || time.Now().After(it.expire) {
+		return nil, false
+	}
+
+	if !it.static {
+		s.lru.MoveToFront(it.elem)
+	}
+
+	return it, true
+}
+
+// cacheEntry is the persisted format of cache item.
+type cacheEntry struct {
+	Key    string
+	Value  []byte
+	Expire time.Time
+}
+
+// Save saves all the unexpired items(static items excluded) to file.
+func (c *Cache) Save(file string) error {
+	var entries []cacheEntry
+	now := time.Now()
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for _, it := range s.items {
+			if !it.static && it.expire.After(now) {
+				entries = append(entries, cacheEntry{it.key, append([]byte(nil), it.value...), it.expire})
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entries); err != nil {
+		return err
+	}
+
+	return fileutil.WriteFileAtomic(file, buf.Bytes(), 0600)
+}
+
+// Load loads the unexpired items from file saved by Save.
+func (c *Cache) Load(file string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var entries []cacheEntry
+	if err := gob.NewDecoder(f).Decode(&entries); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	now := time.Now()
+	for _, e := range entries {
+		if ttl := int(e.Expire.Sub(now) / time.Second); ttl > 0 {
+			c.Put(e.Key, e.Value, ttl)
+			n++
+		}
+	}
+
+	return n, nil
 }
 
 func valCopy(v []byte) (b []byte) {
@@ -0,0 +1,244 @@
+package dns
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sameShardKeys returns n keys in the same shard of c.
+func sameShardKeys(c *Cache, n int) []string {
+	var keys []string
+	s := c.shard("key0")
+	for i := 0; len(keys) < n; i++ {
+		if k := fmt.Sprintf("key%d", i); c.shard(k) == s {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// checkHeap checks the heap property and the indexes of items in the expiry heap of every shard.
+func checkHeap(t *testing.T, c *Cache) {
+	t.Helper()
+	for i, s := range c.shards {
+		for j, it := range s.expiry {
+			if it.index != j {
+				t.Fatalf("shard %d: item %s at %d has index %d", i, it.key, j, it.index)
+			}
+			if p := (j - 1) / 2; j > 0 && s.expiry.Less(j, p) {
+				t.Fatalf("shard %d: item %s expires before its parent %s", i, it.key, s.expiry[p].key)
+			}
+		}
+		if s.lru.Len() != len(s.expiry) {
+			t.Fatalf("shard %d: %d items in lru, %d items in heap", i, s.lru.Len(), len(s.expiry))
+		}
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	c := NewCache(2*cacheShards, 0, false, true)
+	keys := sameShardKeys(c, 4)
+
+	c.Put(keys[0], []byte("v0"), 60)
+	c.Put(keys[1], []byte("v1"), 60)
+
+	// keys[0] is used recently, keys[1] is evicted
+	if v := c.GetCopy(keys[0]); string(v) != "v0" {
+		t.Fatalf("get %s = %q, want v0", keys[0], v)
+	}
+	c.Put(keys[2], []byte("v2"), 60)
+	if v := c.GetCopy(keys[1]); v != nil {
+		t.Errorf("%s is not evicted", keys[1])
+	}
+
+	// replace keys[0] with a new value, keys[2] is evicted
+	c.Put(keys[0], []byte("v0 new"), 60)
+	c.Put(keys[3], []byte("v3"), 60)
+	if v := c.GetCopy(keys[2]); v != nil {
+		t.Errorf("%s is not evicted", keys[2])
+	}
+	if v := c.GetCopy(keys[0]); string(v) != "v0 new" {
+		t.Errorf("get %s = %q, want v0 new", keys[0], v)
+	}
+
+	// static items are not evicted nor counted
+	c.Put("static", []byte("s"), LongTTL)
+	for _, k := range sameShardKeys(c, 8) {
+		c.Put(k, []byte(k), 60)
+	}
+	if v, ttl, refresh := c.Lookup("static"); string(v) != "s" || ttl != 0 || refresh {
+		t.Errorf("lookup static = %q, %d, %v, want s, 0, false", v, ttl, refresh)
+	}
+
+	checkHeap(t, c)
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := NewCache(1000, 0, false, true)
+	for i := 0; i < 200; i++ {
+		c.Put(fmt.Sprintf("key%d", i), []byte("v"), 100+(i*7919)%300)
+	}
+	for i := 0; i < 200; i += 3 {
+		c.Put(fmt.Sprintf("key%d", i), []byte("v"), 1+i%5)
+	}
+	checkHeap(t, c)
+
+	// the items expired are removed by the background loop
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for _, it := range s.items {
+			if it.ttl < 10 {
+				it.expire = time.Now().Add(-time.Second)
+				heap.Fix(&s.expiry, it.index)
+			}
+		}
+		s.mu.Unlock()
+	}
+	checkHeap(t, c)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for c.Len() != 200-67 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := c.Len(); n != 200-67 {
+		t.Errorf("%d items left, want %d", n, 200-67)
+	}
+	checkHeap(t, c)
+}
+
+func TestCacheSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnscache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "cache")
+
+	c := NewCache(100, 0, false, true)
+	c.Put("a", []byte("va"), 60)
+	c.Put("b", []byte("vb"), 3600)
+	c.Put("static", []byte("s"), LongTTL)
+	c.Put("expired", []byte("ve"), 60)
+	s := c.shard("expired")
+	s.mu.Lock()
+	s.items["expired"].expire = time.Now().Add(-time.Second)
+	s.mu.Unlock()
+
+	if err := c.Save(file); err != nil {
+		t.Fatal(err)
+	}
+
+	c2 := NewCache(100, 0, false, true)
+	n, err := c2.Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || c2.Len() != 2 {
+		t.Errorf("loaded %d items, cache has %d, want 2", n, c2.Len())
+	}
+
+	for k, want := range map[string]int{"a": 60, "b": 3600} {
+		v, ttl, _ := c2.Lookup(k)
+		if !bytes.Equal(v, []byte("v"+k)) || ttl > want || ttl < want-2 {
+			t.Errorf("lookup %s = %q, ttl %d, want %q, ttl %d", k, v, ttl, "v"+k, want)
+		}
+	}
+	if v := c2.GetCopy("static"); v != nil {
+		t.Error("static item is saved")
+	}
+
+	if _, err := c2.Load(filepath.Join(dir, "none")); !os.IsNotExist(err) {
+		t.Errorf("load not existing file: %v", err)
+	}
+	ioutil.WriteFile(file, []byte("invalid"), 0644)
+	if _, err := c2.Load(file); err == nil {
+		t.Error("load invalid file: expected error")
+	}
+}
+
+// setExpire sets the expire time of item k to now+d.
+func setExpire(c *Cache, k string, d time.Duration) {
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it := s.items[k]
+	it.expire = time.Now().Add(d)
+	heap.Fix(&s.expiry, it.index)
+}
+
+func TestCacheStale(t *testing.T) {
+	c := NewCache(100, 30*time.Second, false, true)
+	c.Put("k", []byte("v"), 60)
+
+	tests := []struct {
+		expire  time.Duration
+		found   bool
+		ttl     int
+		refresh bool
+	}{
+		{30 * time.Second, true, 30, false},
+		{500 * time.Millisecond, true, 1, false},
+		{-5 * time.Second, true, -6, true},  // stale, refresh it
+		{-6 * time.Second, true, -7, false}, // refreshed recently
+		{-31 * time.Second, false, 0, false},
+	}
+
+	for _, tt := range tests {
+		setExpire(c, "k", tt.expire)
+		v, ttl, refresh := c.Lookup("k")
+		if (v != nil) != tt.found || ttl != tt.ttl || refresh != tt.refresh {
+			t.Errorf("expire in %s: lookup = %q, ttl %d, refresh %v, want found %v, ttl %d, refresh %v",
+				tt.expire, v, ttl, refresh, tt.found, tt.ttl, tt.refresh)
+		}
+	}
+
+	// Get never returns stale items
+	setExpire(c, "k", -time.Second)
+	if v := c.GetCopy("k"); v != nil {
+		t.Errorf("get stale item = %q, want nil", v)
+	}
+
+	// no serve-stale
+	c = NewCache(100, 0, false, true)
+	c.Put("k", []byte("v"), 60)
+	setExpire(c, "k", -time.Millisecond)
+	if v, _, _ := c.Lookup("k"); v != nil {
+		t.Errorf("lookup expired item without serve-stale = %q, want nil", v)
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	for _, prefetch := range []bool{true, false} {
+		c := NewCache(100, 0, prefetch, true)
+		c.Put("k", []byte("v"), 100)
+
+		// popular items are refreshed in the last 10% of ttl, once in the refresh interval
+		var refreshes []bool
+		for i, expire := range []time.Duration{50, 5, 5, 5, 50, 5, 5} {
+			if i == 4 {
+				c.Put("k", []byte("v"), 100) // refreshed, the hits are kept
+			}
+			setExpire(c, "k", expire*time.Second)
+			_, _, refresh := c.Lookup("k")
+			refreshes = append(refreshes, refresh)
+		}
+
+		want := []bool{false, false, true, false, false, true, false}
+		if !prefetch {
+			want = make([]bool, len(want))
+		}
+		for i := range want {
+			if refreshes[i] != want[i] {
+				t.Errorf("prefetch %v: refreshes = %v, want %v", prefetch, refreshes, want)
+				break
+			}
+		}
+	}
+}
@@ -5,16 +5,27 @@ import (
 	"errors"
 	"io"
 	"net"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/nadoo/glider/common/log"
 	"github.com/nadoo/glider/common/pool"
 	"github.com/nadoo/glider/proxy"
+	"github.com/nadoo/glider/rule"
 )
 
-// HandleFunc function handles the dns TypeA or TypeAAAA answer.
-type HandleFunc func(domain, ip string) error
+// failedRTT is the rtt recorded for a failed upstream server.
+const failedRTT = 10 * time.Second
+
+// staleAnswerTTL is the TTL of stale answers.
+// https://tools.ietf.org/html/rfc8767#section-4
+const staleAnswerTTL = 30
+
+// HandleFunc function handles the dns TypeA or TypeAAAA answer,
+// ttl is how long the answer may be used by clients(seconds).
+type HandleFunc func(domain, ip string, ttl int) error
 
 // Config for dns.
 type Config struct {
@@ -24,6 +35,28 @@ type Config struct {
 	MinTTL    int
 	Records   []string
 	AlwaysTCP bool
+	Race      int
+
+	HostsFiles []string
+
+	IPFamily string
+	ECS      string
+
+	QueryLog       string
+	QueryLogSize   int
+	QueryLogRecent int
+
+	BlockReject bool
+	BlockMode   string
+	BlockLists  []string
+
+	FakeIP    []string
+	FakeIPTTL int
+
+	CacheSize  int
+	CacheFile  string
+	ServeStale int
+	Prefetch   bool
 }
 
 // Client is a dns client struct.
@@ -32,23 +65,79 @@ type Client struct {
 	cache       *Cache
 	config      *Config
 	upStream    *UPStream
-	upStreamMap map[string]*UPStream
+	upStreamMap *rule.DomainMatcher // domain: *UPStream
+	familyMap   *rule.DomainMatcher // domain: string
+	ecs         *ecsPolicy
+	ecsMap      *rule.DomainMatcher // domain: *ecsPolicy
+	queryLog    *QueryLog
 	handlers    []HandleFunc
+	fakeIP      *FakeIP
+	hosts       *Hosts
+	blocklist   *Blocklist
 }
 
 // NewClient returns a new dns client.
-func NewClient(proxy proxy.Proxy, config *Config) (*Client, error) {
+func NewClient(p proxy.Proxy, config *Config) (*Client, error) {
+	if !proxy.ValidIPFamily(config.IPFamily) {
+		return nil, errors.New("invalid dns ip family: " + config.IPFamily)
+	}
+
+	if !ValidBlockMode(config.BlockMode) {
+		return nil, errors.New("invalid dns block mode: " + config.BlockMode + ", should be nxdomain, zeroip or refused")
+	}
+
+	cache := NewCache(config.CacheSize, time.Duration(config.ServeStale)*time.Second, config.Prefetch, true)
 	c := &Client{
-		proxy:       proxy,
-		cache:       NewCache(true),
+		proxy:       p,
+		cache:       cache,
 		config:      config,
-		upStream:    NewUPStream(config.Servers),
-		upStreamMap: make(map[string]*UPStream),
+		upStream:    NewUPStream(config.Servers, config.Race),
+		upStreamMap: rule.NewDomainMatcher(),
+		familyMap:   rule.NewDomainMatcher(),
+		ecsMap:      rule.NewDomainMatcher(),
+		hosts:       NewHosts(config.HostsFiles),
+		blocklist:   NewBlocklist(config.BlockLists),
+	}
+
+	ecs, err := parseECS(config.ECS)
+	if err != nil {
+		return nil, err
+	}
+	c.ecs = ecs
+
+	// load the cache saved last time
+	if config.CacheFile != "" {
+		n, err := c.cache.Load(config.CacheFile)
+		if err == nil {
+			log.F("[dns] loaded %d items from cache file %s", n, config.CacheFile)
+		} else if !os.IsNotExist(err) {
+			log.F("[dns] failed to load cache from %s: %v", config.CacheFile, err)
+		}
 	}
 
 	// custom records
 	for _, record := range config.Records {
-		c.AddRecord(record)
+		if err := c.AddRecord(record); err != nil {
+			log.F("[dns] invalid record %s: %v", record, err)
+		}
+	}
+
+	// query log, the recent entries are kept even if there's no query log file
+	if config.QueryLog != "" || config.QueryLogRecent > 0 {
+		queryLog, err := NewQueryLog(config.QueryLog, int64(config.QueryLogSize)<<20, config.QueryLogRecent)
+		if err != nil {
+			return nil, err
+		}
+		c.queryLog = queryLog
+	}
+
+	// fake ip mode
+	if len(config.FakeIP) > 0 {
+		fakeIP, err := NewFakeIP(config.FakeIP, config.FakeIPTTL)
+		if err != nil {
+			return nil, err
+		}
+		c.fakeIP = fakeIP
 	}
 
 	return c, nil
@@ -62,63 +151,211 @@ func (c *Client) Exchange(reqBytes []byte, clientAddr string, preferTCP bool) ([
 		return nil, err
 	}
 
+	start := time.Now()
+	e := &QueryLogEntry{Cache: CacheMiss}
+
+	respBytes, err := c.exchangeMsg(req, reqBytes, clientAddr, preferTCP, e)
+	if c.queryLog != nil {
+		c.logQuery(e, req, clientAddr, start, err)
+	}
+
+	if err != nil || preferTCP {
+		return respBytes, err
+	}
+
+	// udp client, the response should fit in the payload size it advertised.
+	if len(respBytes)-2 > req.UDPSize() || req.OPT() == nil {
+		n, err := Truncate(respBytes[2:], req.UDPSize(), req.OPT() != nil)
+		if err != nil {
+			return respBytes, err
+		}
+		binary.BigEndian.PutUint16(respBytes[:2], uint16(n))
+		respBytes = respBytes[:2+n]
+	}
+
+	return respBytes, nil
+}
+
+// exchangeMsg gets the response of req from cache or upstream dns servers,
+// where the answer comes from is recorded in e.
+func (c *Client) exchangeMsg(req *Message, reqBytes []byte, clientAddr string, preferTCP bool,
+	e *QueryLogEntry) ([]byte, error) {
+
+	if m, ok := c.answerHosts(req, clientAddr, preferTCP); ok {
+		e.Upstream = "hosts"
+		return c.reply(m, e)
+	}
+
+	if c.blocked(req.Question.QNAME) {
+		e.Upstream = "blocked"
+		log.F("[dns] %s <-> blocked, type: %d, %s", clientAddr, req.Question.QTYPE, req.Question.QNAME)
+		return c.reply(c.blockResponse(req), e)
+	}
+
+	if c.filtered(req, clientAddr, preferTCP) {
+		e.Upstream = "filtered"
+		log.F("[dns] %s <-> filtered, type: %d, %s, ip family: %s",
+			clientAddr, req.Question.QTYPE, req.Question.QNAME, c.IPFamily(req.Question.QNAME))
+		return c.reply(emptyResponse(req), e)
+	}
+
+	// check fake ip before cache, the real answers cached before fake ip is enabled should not be used
 	if req.Question.QTYPE == QTypeA || req.Question.QTYPE == QTypeAAAA {
-		v := c.cache.GetCopy(qKey(req.Question))
-		if len(v) > 4 {
-			binary.BigEndian.PutUint16(v[2:4], req.ID)
-			log.F("[dns] %s <-> cache, type: %d, %s",
+		if c.fakeIP != nil && c.fakeable(req.Question.QNAME) {
+			e.Upstream = "fakeip"
+			log.F("[dns] %s <-> fakeip, type: %d, %s",
 				clientAddr, req.Question.QTYPE, req.Question.QNAME)
+			return c.reply(c.fakeIP.MakeResponse(req), e)
+		}
+	}
 
-			return v, nil
+	v, ttl, refresh := c.cache.Lookup(qKey(req.Question))
+	if len(v) > 4 {
+		binary.BigEndian.PutUint16(v[2:4], req.ID)
+		CopyQName(v[2:], reqBytes[2:])
+
+		e.Cache = CacheHit
+		if ttl < 0 {
+			e.Cache = CacheStale
+			SetTTL(v[2:], staleAnswerTTL)
+		} else if ttl > 0 {
+			SetTTL(v[2:], uint32(ttl))
 		}
+
+		if refresh {
+			go c.refresh(valCopy(reqBytes))
+		}
+
+		log.F("[dns] %s <-> cache, type: %d, %s, ttl: %d",
+			clientAddr, req.Question.QTYPE, req.Question.QNAME, ttl)
+
+		// cached answers are kept in wire format, parse it only when the query is logged
+		if c.queryLog != nil {
+			if m, err := UnmarshalMessage(v[2:]); err == nil {
+				e.setResponse(m)
+			}
+		}
+
+		return v, nil
+	}
+
+	return c.resolve(req, reqBytes, clientAddr, preferTCP, e)
+}
+
+// refresh resolves the request in background to update the cache.
+func (c *Client) refresh(reqBytes []byte) {
+	defer pool.PutBuffer(reqBytes)
+
+	req, err := UnmarshalMessage(reqBytes[2:])
+	if err != nil {
+		return
+	}
+
+	respBytes, err := c.resolve(req, reqBytes, "refresh", false, &QueryLogEntry{})
+	if err != nil {
+		log.F("[dns] failed to refresh %s: %v", req.Question.QNAME, err)
+		return
+	}
+	pool.PutBuffer(respBytes)
+}
+
+// resolve resolves the request via upstream dns servers and puts the answer into cache.
+func (c *Client) resolve(req *Message, reqBytes []byte, clientAddr string, preferTCP bool,
+	e *QueryLogEntry) ([]byte, error) {
+	if b, ok := c.withECS(req); ok {
+		defer pool.PutBuffer(b)
+		reqBytes = b
 	}
 
 	dnsServer, network, dialerAddr, respBytes, err := c.exchange(req.Question.QNAME, reqBytes, preferTCP)
+	e.Upstream, e.Dialer = dnsServer, dialerAddr
 	if err != nil {
 		return nil, err
 	}
 
-	if req.Question.QTYPE != QTypeA && req.Question.QTYPE != QTypeAAAA {
-		log.F("[dns] %s <-> %s(%s) via %s, type: %d, %s",
-			clientAddr, dnsServer, network, dialerAddr, req.Question.QTYPE, req.Question.QNAME)
+	resp, err := UnmarshalMessage(respBytes[2:])
+	if err != nil {
+		log.F("[dns] %s <-> %s(%s) via %s, type: %d, %s, error in unmarshal response: %v",
+			clientAddr, dnsServer, network, dialerAddr, req.Question.QTYPE, req.Question.QNAME, err)
 		return respBytes, nil
 	}
 
-	resp, err := UnmarshalMessage(respBytes[2:])
-	if err != nil {
-		return respBytes, err
+	if c.queryLog != nil {
+		e.setResponse(resp)
 	}
 
 	ips, ttl := c.extractAnswer(resp)
 
-	// add to cache only when there's a valid ip address
-	if len(ips) != 0 && ttl > 0 {
-		c.cache.Put(qKey(resp.Question), respBytes, ttl)
+	// the ecs option in response is only for the client sent it, and the cached one
+	// may be served to any client, so it's stripped except for the client sent it.
+	// https://tools.ietf.org/html/rfc7871#section-7.2.2
+	cached := respBytes
+	if hasECS(resp) {
+		if hasECS(req) {
+			cached = valCopy(respBytes)
+			defer pool.PutBuffer(cached)
+		}
+		if n, err := stripECS(cached[2:]); err == nil {
+			binary.BigEndian.PutUint16(cached[:2], uint16(n))
+			cached = cached[:2+n]
+		}
+		if !hasECS(req) {
+			respBytes = cached
+		}
+	}
+
+	// add to cache when it's a valid answer or a negative answer with SOA
+	if ttl > 0 && !resp.TC() {
+		c.cache.Put(qKey(resp.Question), cached, ttl)
 	}
 
-	log.F("[dns] %s <-> %s(%s) via %s, type: %d, %s: %s",
-		clientAddr, dnsServer, network, dialerAddr, resp.Question.QTYPE, resp.Question.QNAME, strings.Join(ips, ","))
+	log.F("[dns] %s <-> %s(%s) via %s, type: %d, %s: %s, rcode: %d, answers: %d",
+		clientAddr, dnsServer, network, dialerAddr, resp.Question.QTYPE, resp.Question.QNAME,
+		strings.Join(ips, ","), resp.RCODE(), len(resp.Answers))
 
 	return respBytes, nil
 }
 
+// extractAnswer calls the handlers with ips in answer, returns the ips and the ttl to cache it.
+// The ttl of negative answers follows the SOA record, 0 means it should not be cached.
+// https://tools.ietf.org/html/rfc2308#section-5
 func (c *Client) extractAnswer(resp *Message) ([]string, int) {
 	var ips []string
-	ttl := c.config.MinTTL
+	ttl := -1
 	for _, answer := range resp.Answers {
 		if answer.TYPE == QTypeA || answer.TYPE == QTypeAAAA {
+			// the answer may be served from cache longer than its ttl
+			ipTTL := int(answer.TTL)
+			if ipTTL < c.config.MinTTL {
+				ipTTL = c.config.MinTTL
+			}
+			ipTTL += c.config.ServeStale
+
 			for _, h := range c.handlers {
-				h(resp.Question.QNAME, answer.IP)
+				h(resp.Question.QNAME, answer.IP, ipTTL)
 			}
 			if answer.IP != "" {
 				ips = append(ips, answer.IP)
 			}
-			if answer.TTL != 0 {
-				ttl = int(answer.TTL)
-			}
+		}
+		if ttl == -1 || int(answer.TTL) < ttl {
+			ttl = int(answer.TTL)
 		}
 	}
 
+	switch rcode := resp.RCODE(); {
+	case rcode == RCodeSuccess && len(resp.Answers) > 0:
+	case rcode == RCodeSuccess || rcode == RCodeNameError:
+		// negative answer: NODATA or NXDOMAIN
+		ttl = negativeTTL(resp)
+	default:
+		return ips, 0
+	}
+
+	if ttl < 0 {
+		return ips, 0
+	}
+
 	if ttl > c.config.MaxTTL {
 		ttl = c.config.MaxTTL
 	} else if ttl < c.config.MinTTL {
@@ -128,69 +365,316 @@ func (c *Client) extractAnswer(resp *Message) ([]string, int) {
 	return ips, ttl
 }
 
+// negativeTTL returns the ttl of negative answer: min(SOA.TTL, SOA.MINIMUM), -1 if there's no SOA.
+func negativeTTL(resp *Message) int {
+	for _, rr := range resp.Authority {
+		if rr.TYPE == QTypeSOA && len(rr.RDATA) >= 4 {
+			// MINIMUM is the last field of SOA RDATA
+			ttl := binary.BigEndian.Uint32(rr.RDATA[len(rr.RDATA)-4:])
+			if rr.TTL < ttl {
+				ttl = rr.TTL
+			}
+			return int(ttl)
+		}
+	}
+	return -1
+}
+
+// router routes destinations without scheduling forwarders, it's implemented by rule.Proxy.
+type router interface {
+	Route(dstAddr string) rule.Route
+}
+
+// route returns the route of dstAddr, it uses the dialer of proxy if proxy is not a router.
+func (c *Client) route(dstAddr string) rule.Route {
+	if r, ok := c.proxy.(router); ok {
+		return r.Route(dstAddr)
+	}
+
+	host, _, _ := net.SplitHostPort(dstAddr)
+	addr := c.proxy.NextDialer(dstAddr, nil).Addr()
+	return rule.Route{Direct: addr == "DIRECT", Reject: addr == "REJECT", Server: strings.Contains(addr, host)}
+}
+
+// fakeable returns whether the domain should be answered with a fake ip,
+// only domains which will be connected via forwarders are fakeable.
+func (c *Client) fakeable(qname string) bool {
+	r := c.route(qname + ":0")
+	return !r.Direct && !r.Reject && !r.Server
+}
+
+// filtered reports whether the A/AAAA query should be answered with an empty answer
+// according to the ip family of qname. In prefer mode, the query of the other family
+// is filtered only when qname has addresses of the preferred family.
+func (c *Client) filtered(req *Message, clientAddr string, preferTCP bool) bool {
+	qtype := req.Question.QTYPE
+	if qtype != QTypeA && qtype != QTypeAAAA {
+		return false
+	}
+
+	var preferred uint16
+	switch c.IPFamily(req.Question.QNAME) {
+	case proxy.IPv4Only:
+		return qtype == QTypeAAAA
+	case proxy.IPv6Only:
+		return qtype == QTypeA
+	case proxy.PreferIPv4:
+		preferred = QTypeA
+	case proxy.PreferIPv6:
+		preferred = QTypeAAAA
+	default:
+		return false
+	}
+
+	if qtype == preferred {
+		return false
+	}
+
+	resp, respBytes, err := c.query(req.Question.QNAME, preferred, clientAddr, preferTCP)
+	if err != nil {
+		return false
+	}
+	defer pool.PutBuffer(respBytes)
+
+	for _, rr := range resp.Answers {
+		if rr.TYPE == preferred {
+			return true
+		}
+	}
+
+	return false
+}
+
+// query resolves qname with type qtype via cache or upstream dns servers.
+// NOTE: respBytes = respLen + respMsg, put it back to pool after use.
+func (c *Client) query(qname string, qtype uint16, clientAddr string, preferTCP bool) (*Message, []byte, error) {
+	req := NewMessage(0, Query)
+	req.setFlag(0, 0, 0, 0, 1, 0, 0)
+	req.SetQuestion(NewQuestion(qtype, qname))
+
+	reqBytes, err := marshalWithLen(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer pool.PutBuffer(reqBytes)
+
+	respBytes, err := c.exchangeMsg(req, reqBytes, clientAddr, preferTCP, &QueryLogEntry{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := UnmarshalMessage(respBytes[2:])
+	if err != nil {
+		pool.PutBuffer(respBytes)
+		return nil, nil, err
+	}
+
+	return resp, respBytes, nil
+}
+
+// emptyResponse makes a NOERROR response without answers for req.
+// NOTE: respBytes = respLen + respMsg.
+func emptyResponse(req *Message) *Message {
+	m := NewMessage(req.ID, Response)
+	m.setFlag(1, 0, 0, 0, (req.Bits>>8)&1, 1, RCodeSuccess)
+	m.SetQuestion(req.Question)
+	return m
+}
+
+// reply marshals the local answer m and records it in the query log entry e.
+// NOTE: respBytes = respLen + respMsg.
+func (c *Client) reply(m *Message, e *QueryLogEntry) ([]byte, error) {
+	if c.queryLog != nil {
+		e.setResponse(m)
+	}
+	return marshalWithLen(m)
+}
+
+// SaveCache saves the cache to the cache file if specified.
+func (c *Client) SaveCache() error {
+	if c.config.CacheFile == "" {
+		return nil
+	}
+	return c.cache.Save(c.config.CacheFile)
+}
+
+// FakeIP returns the fake ip table, nil if fake ip mode is not enabled.
+func (c *Client) FakeIP() *FakeIP {
+	return c.fakeIP
+}
+
 // exchange choose a upstream dns server based on qname, communicate with it on the network.
 func (c *Client) exchange(qname string, reqBytes []byte, preferTCP bool) (
 	server, network, dialerAddr string, respBytes []byte, err error) {
 
 	// use tcp to connect upstream server default
 	network = "tcp"
-	dialer := c.proxy.NextDialer(qname + ":53")
+	var dialer proxy.Dialer = proxy.Default
 
 	// if we are resolving the dialer's domain, then use Direct to avoid denpency loop
-	// TODO: dialer.Addr() == "REJECT", tricky
-	if strings.Contains(dialer.Addr(), qname) || dialer.Addr() == "REJECT" {
-		dialer = proxy.Default
+	r := c.route(qname + ":53")
+	if !r.Server && !r.Reject {
+		dialer = c.proxy.NextDialer(qname+":53", nil)
 	}
 
 	// If client uses udp and no forwarders specified, use udp
-	// TODO: dialer.Addr() == "DIRECT", tricky
 	if !preferTCP && !c.config.AlwaysTCP && dialer.Addr() == "DIRECT" {
 		network = "udp"
 	}
 
 	ups := c.UpStream(qname)
-	server = ups.Server()
-	for i := 0; i < ups.Len(); i++ {
-		var rc net.Conn
-		rc, err = dialer.Dial(network, server)
+	if ups.Race() > 1 {
+		server, network, respBytes, err = c.exchangeRace(ups, dialer, network, reqBytes)
 		if err != nil {
+			log.F("[dns] error in resolving %s, failed to exchange with all servers via %s: %v",
+				qname, dialer.Addr(), err)
+		}
+	} else {
+		server = ups.Server()
+		for i := 0; i < ups.Len(); i++ {
+			network, respBytes, err = c.exchangeServer(ups, dialer, network, server, reqBytes)
+			if err == nil {
+				break
+			}
+
 			newServer := ups.SwitchIf(server)
-			log.F("[dns] error in resolving %s, failed to connect to server %v via %s: %v, switch to %s",
+			log.F("[dns] error in resolving %s, failed to exchange with server %v via %s: %v, switch to %s",
 				qname, server, dialer.Addr(), err, newServer)
+
 			server = newServer
-			continue
 		}
-		defer rc.Close()
+	}
 
-		// TODO: support timeout setting for different upstream server
-		if c.config.Timeout > 0 {
-			rc.SetDeadline(time.Now().Add(time.Duration(c.config.Timeout) * time.Second))
+	// if all dns upstreams failed, then maybe the forwarder is not available.
+	if err != nil {
+		c.proxy.Record(dialer, false)
+	}
+
+	return server, network, dialer.Addr(), respBytes, err
+}
+
+// exchangeServer exchanges with server and records its rtt, the request will be
+// sent again over tcp if the udp response is truncated.
+func (c *Client) exchangeServer(ups *UPStream, dialer proxy.Dialer, network, server string, reqBytes []byte) (
+	string, []byte, error) {
+
+	start := time.Now()
+	respBytes, err := c.exchangeVia(dialer, network, server, reqBytes)
+	if err == nil && network == "udp" && isTruncated(respBytes) {
+		// the udp response is truncated by upstream, retry over tcp to get the full answer
+		pool.PutBuffer(respBytes)
+		network = "tcp"
+		respBytes, err = c.exchangeVia(dialer, network, server, reqBytes)
+	}
+
+	rtt := time.Since(start)
+	if err != nil && rtt < failedRTT {
+		rtt = failedRTT
+	}
+	ups.Record(server, rtt)
+
+	return network, respBytes, err
+}
+
+// exchangeRace queries the fastest servers of ups at once and returns the first valid answer.
+func (c *Client) exchangeRace(ups *UPStream, dialer proxy.Dialer, network string, reqBytes []byte) (
+	server, respNetwork string, respBytes []byte, err error) {
+
+	type result struct {
+		server, network string
+		respBytes       []byte
+		err             error
+	}
+
+	// the slower servers may still use the request after we return, so make a copy
+	reqCopy := valCopy(reqBytes)
+
+	servers := ups.Fastest(ups.Race())
+	results := make(chan result, len(servers))
+	for _, s := range servers {
+		go func(s string) {
+			nw, b, err := c.exchangeServer(ups, dialer, network, s, reqCopy)
+			results <- result{s, nw, b, err}
+		}(s)
+	}
+
+	for i := range servers {
+		r := <-results
+		if r.err != nil {
+			err = r.err
+			log.F("[dns] failed to exchange with server %v via %s: %v", r.server, dialer.Addr(), r.err)
+			continue
 		}
 
-		switch network {
-		case "tcp":
-			respBytes, err = c.exchangeTCP(rc, reqBytes)
-		case "udp":
-			respBytes, err = c.exchangeUDP(rc, reqBytes)
+		if respBytes != nil {
+			pool.PutBuffer(respBytes)
 		}
+		server, respNetwork, respBytes, err = r.server, r.network, r.respBytes, nil
 
-		if err == nil {
-			break
+		// not a valid answer, wait for other servers
+		if !isValid(respBytes) {
+			continue
 		}
 
-		newServer := ups.SwitchIf(server)
-		log.F("[dns] error in resolving %s, failed to exchange with server %v via %s: %v, switch to %s",
-			qname, server, dialer.Addr(), err, newServer)
+		// wait for the slower servers in background
+		go func(n int) {
+			for ; n > 0; n-- {
+				if r := <-results; r.respBytes != nil {
+					pool.PutBuffer(r.respBytes)
+				}
+			}
+			pool.PutBuffer(reqCopy)
+		}(len(servers) - i - 1)
 
-		server = newServer
+		return
 	}
 
-	// if all dns upstreams failed, then maybe the forwarder is not available.
+	pool.PutBuffer(reqCopy)
+	return
+}
+
+// exchangeVia connects to server via dialer and exchanges with it on the network.
+func (c *Client) exchangeVia(dialer proxy.Dialer, network, server string, reqBytes []byte) ([]byte, error) {
+	rc, err := dialer.Dial(network, server)
 	if err != nil {
-		c.proxy.Record(dialer, false)
+		return nil, err
 	}
+	defer rc.Close()
 
-	return server, network, dialer.Addr(), respBytes, err
+	// TODO: support timeout setting for different upstream server
+	if c.config.Timeout > 0 {
+		rc.SetDeadline(time.Now().Add(time.Duration(c.config.Timeout) * time.Second))
+	}
+
+	switch network {
+	case "tcp":
+		return c.exchangeTCP(rc, reqBytes)
+	case "udp":
+		return c.exchangeUDP(rc, reqBytes)
+	}
+
+	return nil, errors.New("exchangeVia: unsupported network " + network)
+}
+
+// isTruncated returns whether the TC flag of response is set.
+// NOTE: respBytes = respLen + respMsg.
+func isTruncated(respBytes []byte) bool {
+	if len(respBytes) < 2+HeaderLen {
+		return false
+	}
+	h := &Header{Bits: binary.BigEndian.Uint16(respBytes[4:6])}
+	return h.TC()
+}
+
+// isValid returns whether the response is a valid answer(positive or negative),
+// SERVFAIL and REFUSED responses are not valid.
+// NOTE: respBytes = respLen + respMsg.
+func isValid(respBytes []byte) bool {
+	if len(respBytes) < 2+HeaderLen {
+		return false
+	}
+	h := &Header{Bits: binary.BigEndian.Uint16(respBytes[4:6])}
+	return h.RCODE() != RCodeServerFail && h.RCODE() != RCodeRefused
 }
 
 // exchangeTCP exchange with server over tcp.
@@ -221,9 +705,10 @@ func (c *Client) exchangeUDP(rc net.Conn, reqBytes []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	respBytes := pool.GetBuffer(UDPMaxLen)
+	respBytes := pool.GetBuffer(MsgMaxLen)
 	n, err := rc.Read(respBytes[2:])
 	if err != nil {
+		pool.PutBuffer(respBytes)
 		return nil, err
 	}
 	binary.BigEndian.PutUint16(respBytes[:2], uint16(n))
@@ -231,19 +716,40 @@ func (c *Client) exchangeUDP(rc net.Conn, reqBytes []byte) ([]byte, error) {
 	return respBytes[:2+n], nil
 }
 
-// SetServers sets upstream dns servers for the given domain.
-func (c *Client) SetServers(domain string, servers []string) {
-	c.upStreamMap[strings.ToLower(domain)] = NewUPStream(servers)
+// SetServers sets upstream dns servers for the given domains, the domains share the same upstream
+// so the rtt of servers is learned from all of them. race is the number of fastest servers to query
+// at once, 0 means use the global setting.
+func (c *Client) SetServers(domains []string, servers []string, race int) {
+	if race == 0 {
+		race = c.config.Race
+	}
+	ups := NewUPStream(servers, race)
+	for _, domain := range domains {
+		if err := c.upStreamMap.Add(domain, ups); err != nil {
+			log.F("[dns] invalid domain %s: %v", domain, err)
+		}
+	}
+}
+
+// SetIPFamily sets the ip family of A/AAAA answers for the given domain.
+func (c *Client) SetIPFamily(domain, family string) {
+	if err := c.familyMap.Add(domain, family); err != nil {
+		log.F("[dns] invalid domain %s: %v", domain, err)
+	}
+}
+
+// IPFamily returns the ip family of A/AAAA answers for the given domain.
+func (c *Client) IPFamily(domain string) string {
+	if family, _, _ := c.familyMap.Match(domain); family != nil {
+		return family.(string)
+	}
+	return c.config.IPFamily
 }
 
 // UpStream returns upstream dns server for the given domain.
 func (c *Client) UpStream(domain string) *UPStream {
-	domain = strings.ToLower(domain)
-	for i := len(domain); i != -1; {
-		i = strings.LastIndexByte(domain[:i], '.')
-		if upstream, ok := c.upStreamMap[domain[i+1:]]; ok {
-			return upstream
-		}
+	if upstream, _, _ := c.upStreamMap.Match(domain); upstream != nil {
+		return upstream.(*UPStream)
 	}
 	return c.upStream
 }
@@ -253,30 +759,12 @@ func (c *Client) AddHandler(h HandleFunc) {
 	c.handlers = append(c.handlers, h)
 }
 
-// AddRecord adds custom record to dns cache, format:
-// www.example.com/1.2.3.4 or www.example.com/2606:2800:220:1:248:1893:25c8:1946
+// AddRecord adds custom record, queries of it will be answered authoritatively, format:
+// www.example.com/1.2.3.4, www.example.com/2606:2800:220:1:248:1893:25c8:1946,
+// *.lan/10.0.0.1, www.example.com/1.2.3.4,1.2.3.5, www.example.com/CNAME/example.com,
+// www.example.com/TXT/text, 10.0.0.1/PTR/router.lan
 func (c *Client) AddRecord(record string) error {
-	r := strings.Split(record, "/")
-	domain, ip := r[0], r[1]
-	m, err := c.MakeResponse(domain, ip)
-	if err != nil {
-		return err
-	}
-
-	wb := pool.GetWriteBuffer()
-	defer pool.PutWriteBuffer(wb)
-
-	wb.Write([]byte{0, 0})
-
-	n, err := m.MarshalTo(wb)
-	if err != nil {
-		return err
-	}
-
-	binary.BigEndian.PutUint16(wb.Bytes()[:2], uint16(n))
-	c.cache.Put(qKey(m.Question), wb.Bytes(), LongTTL)
-
-	return nil
+	return c.hosts.AddRecord(record)
 }
 
 // MakeResponse makes a dns response message for the given domain and ip address.
@@ -306,12 +794,7 @@ func (c *Client) MakeResponse(domain string, ip string) (*Message, error) {
 	return m, nil
 }
 
+// qKey returns the cache key of question, format: qname/qtype/qclass.
 func qKey(q *Question) string {
-	switch q.QTYPE {
-	case QTypeA:
-		return q.QNAME + "/4"
-	case QTypeAAAA:
-		return q.QNAME + "/6"
-	}
-	return q.QNAME
+	return strings.ToLower(q.QNAME) + "/" + strconv.Itoa(int(q.QTYPE)) + "/" + strconv.Itoa(int(q.QCLASS))
 }
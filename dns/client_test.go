@@ -0,0 +1,89 @@
+package dns
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// soaRR returns a SOA rr of example.com with root mname and rname.
+func soaRR(ttl, minimum uint32) *RR {
+	rdata := make([]byte, 22)
+	binary.BigEndian.PutUint32(rdata[18:], minimum)
+	return &RR{NAME: "example.com", TYPE: QTypeSOA, CLASS: ClassINET, TTL: ttl, RDLENGTH: 22, RDATA: rdata}
+}
+
+func ipRR(ttl uint32, ip ...byte) *RR {
+	qtype := QTypeA
+	if len(ip) == 16 {
+		qtype = QTypeAAAA
+	}
+	return &RR{NAME: "www.example.com", TYPE: qtype, CLASS: ClassINET, TTL: ttl, RDLENGTH: uint16(len(ip)), RDATA: ip}
+}
+
+func TestExtractAnswer(t *testing.T) {
+	txt := &RR{NAME: "www.example.com", TYPE: QTypeTXT, CLASS: ClassINET, TTL: 100, RDLENGTH: 4, RDATA: []byte("\x03txt")}
+
+	tests := []struct {
+		name      string
+		rcode     uint16
+		answers   []*RR
+		authority []*RR
+		ips       []string
+		ttl       int
+	}{
+		{"a", RCodeSuccess, []*RR{ipRR(300, 1, 2, 3, 4), ipRR(200, 5, 6, 7, 8)}, nil, []string{"1.2.3.4", "5.6.7.8"}, 200},
+		{"max ttl", RCodeSuccess, []*RR{ipRR(86400, 1, 2, 3, 4)}, nil, []string{"1.2.3.4"}, 1800},
+		{"min ttl", RCodeSuccess, []*RR{ipRR(1, 1, 2, 3, 4)}, nil, []string{"1.2.3.4"}, 10},
+		{"txt", RCodeSuccess, []*RR{txt}, nil, nil, 100},
+		{"nxdomain", RCodeNameError, nil, []*RR{soaRR(3600, 60)}, nil, 60},
+		{"nodata", RCodeSuccess, nil, []*RR{soaRR(30, 600)}, nil, 30},
+		{"negative min ttl", RCodeNameError, nil, []*RR{soaRR(3600, 0)}, nil, 10},
+		{"nxdomain without soa", RCodeNameError, nil, nil, nil, 0},
+		{"servfail", RCodeServerFail, nil, []*RR{soaRR(3600, 60)}, nil, 0},
+		{"refused", RCodeRefused, nil, nil, nil, 0},
+	}
+
+	for _, tt := range tests {
+		c := &Client{config: &Config{MinTTL: 10, MaxTTL: 1800, ServeStale: 30}}
+
+		var handled []int
+		c.AddHandler(func(domain, ip string, ttl int) error {
+			handled = append(handled, ttl)
+			return nil
+		})
+
+		m := NewMessage(1, Response)
+		m.setFlag(1, 0, 0, 0, 1, 1, tt.rcode)
+		m.SetQuestion(NewQuestion(QTypeA, "www.example.com"))
+		m.Answers, m.Authority = tt.answers, tt.authority
+
+		b, err := m.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := UnmarshalMessage(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ips, ttl := c.extractAnswer(resp)
+		if !reflect.DeepEqual(ips, tt.ips) || ttl != tt.ttl {
+			t.Errorf("%s: ips %v, ttl %d, want %v, %d", tt.name, ips, ttl, tt.ips, tt.ttl)
+		}
+
+		// handlers get the ttl of ips, at least min ttl, plus the serve-stale period
+		for i, ipTTL := range handled {
+			want := int(tt.answers[i].TTL)
+			if want < 10 {
+				want = 10
+			}
+			if ipTTL != want+30 {
+				t.Errorf("%s: handler got ttl %d, want %d", tt.name, ipTTL, want+30)
+			}
+		}
+		if len(handled) != len(tt.ips) {
+			t.Errorf("%s: handler called %d times, want %d", tt.name, len(handled), len(tt.ips))
+		}
+	}
+}
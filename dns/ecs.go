@@ -0,0 +1,184 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/nadoo/glider/common/log"
+)
+
+// ECSStrip means stripping the edns client subnet option in queries.
+const ECSStrip = "strip"
+
+// ecsDefaultPrefix is the source prefix length used when an ip address is specified.
+// https://tools.ietf.org/html/rfc7871#section-11.1
+var ecsDefaultPrefix = map[int]int{net.IPv4len: 24, net.IPv6len: 56}
+
+// ecsPolicy is how to handle the edns client subnet option in queries.
+type ecsPolicy struct {
+	strip  bool
+	subnet *net.IPNet
+}
+
+// parseECS parses the ecs setting: "strip", CIDR or ip address, nil if ecs is empty.
+func parseECS(ecs string) (*ecsPolicy, error) {
+	switch ecs {
+	case "":
+		return nil, nil
+	case ECSStrip:
+		return &ecsPolicy{strip: true}, nil
+	}
+
+	if !strings.Contains(ecs, "/") {
+		ip := net.ParseIP(ecs)
+		if ip == nil {
+			return nil, errors.New("invalid ecs: " + ecs)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		mask := net.CIDRMask(ecsDefaultPrefix[len(ip)], len(ip)*8)
+		return &ecsPolicy{subnet: &net.IPNet{IP: ip.Mask(mask), Mask: mask}}, nil
+	}
+
+	_, subnet, err := net.ParseCIDR(ecs)
+	if err != nil {
+		return nil, err
+	}
+	return &ecsPolicy{subnet: subnet}, nil
+}
+
+// apply returns the request with the ecs option set or stripped.
+// NOTE: reqBytes = reqLen + reqMsg, put it back to pool after use.
+func (p *ecsPolicy) apply(req *Message) ([]byte, error) {
+	m := &Message{Header: req.Header, Question: req.Question}
+
+	var opt *RR
+	for _, rr := range req.Additional {
+		if rr.TYPE != QTypeOPT {
+			m.AddAdditional(rr)
+			continue
+		}
+
+		// keep the original OPT rr untouched, the client's OPT is still needed
+		c := *rr
+		opt = &c
+		m.AddAdditional(opt)
+	}
+
+	if opt == nil {
+		if p.strip {
+			return marshalWithLen(m)
+		}
+		opt = NewOPT(UDPMaxLen)
+		m.AddAdditional(opt)
+	}
+
+	opts, err := opt.Options()
+	if err != nil {
+		return nil, err
+	}
+
+	var newOpts []EDNS0Option
+	for _, o := range opts {
+		if o.Code != OptionCodeECS {
+			newOpts = append(newOpts, o)
+		}
+	}
+
+	if !p.strip {
+		newOpts = append(newOpts, NewECSOption(p.subnet))
+	}
+	opt.SetOptions(newOpts)
+
+	return marshalWithLen(m)
+}
+
+// SetECS sets the edns client subnet setting for the given domain: "strip", CIDR or ip address.
+func (c *Client) SetECS(domain, ecs string) error {
+	p, err := parseECS(ecs)
+	if err != nil {
+		return err
+	}
+	return c.ecsMap.Add(domain, p)
+}
+
+// ecsPolicy returns the edns client subnet setting for the given domain, nil if not set.
+func (c *Client) ecsPolicy(domain string) *ecsPolicy {
+	if p, _, _ := c.ecsMap.Match(domain); p != nil {
+		return p.(*ecsPolicy)
+	}
+	return c.ecs
+}
+
+// withECS returns the request with edns client subnet setting applied, ok is false if no change made.
+// NOTE: reqBytes = reqLen + reqMsg, put it back to pool after use.
+func (c *Client) withECS(req *Message) (reqBytes []byte, ok bool) {
+	p := c.ecsPolicy(req.Question.QNAME)
+	if p == nil {
+		return nil, false
+	}
+
+	reqBytes, err := p.apply(req)
+	if err != nil {
+		log.F("[dns] failed to set ecs of %s: %v", req.Question.QNAME, err)
+		return nil, false
+	}
+
+	return reqBytes, true
+}
+
+// hasECS reports whether the message m has the edns client subnet option.
+func hasECS(m *Message) bool {
+	opt := m.OPT()
+	if opt == nil {
+		return false
+	}
+
+	opts, _ := opt.Options()
+	for _, o := range opts {
+		if o.Code == OptionCodeECS {
+			return true
+		}
+	}
+	return false
+}
+
+// stripECS removes the edns client subnet option in message b in place and returns the new length.
+// https://tools.ietf.org/html/rfc7871#section-7.2.2
+func stripECS(b []byte) (int, error) {
+	// move the OPT rr to the end, so it can be resized without moving others
+	n, err := Truncate(b, len(b), true)
+	if err != nil {
+		return 0, err
+	}
+
+	_, _, spans, err := rrSpans(b[:n])
+	if err != nil {
+		return 0, err
+	}
+
+	if len(spans) == 0 || spans[len(spans)-1].rr.TYPE != QTypeOPT {
+		return n, nil
+	}
+
+	opt := spans[len(spans)-1].rr
+	opts, err := opt.Options()
+	if err != nil {
+		return 0, err
+	}
+
+	var newOpts []EDNS0Option
+	for _, o := range opts {
+		if o.Code != OptionCodeECS {
+			newOpts = append(newOpts, o)
+		}
+	}
+
+	rdStart := n - int(opt.RDLENGTH)
+	opt.SetOptions(newOpts)
+	binary.BigEndian.PutUint16(b[rdStart-2:], opt.RDLENGTH)
+	return rdStart + copy(b[rdStart:], opt.RDATA), nil
+}
@@ -0,0 +1,217 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/nadoo/glider/proxy"
+)
+
+// cookie is an edns cookie option to check other options are kept.
+var cookie = EDNS0Option{Code: 10, Data: []byte("12345678")}
+
+// ecsOptions returns the options in the OPT rr of message b.
+func ecsOptions(t *testing.T, b []byte) []EDNS0Option {
+	t.Helper()
+	m, err := UnmarshalMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := m.OPT()
+	if opt == nil {
+		return nil
+	}
+	opts, err := opt.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+func TestParseECS(t *testing.T) {
+	tests := []struct {
+		ecs    string
+		strip  bool
+		subnet string
+		err    bool
+	}{
+		{"", false, "", false},
+		{"strip", true, "", false},
+		{"1.2.3.4", false, "1.2.3.0/24", false},
+		{"2001:db8:1:2::1", false, "2001:db8:1::/56", false},
+		{"10.1.0.0/16", false, "10.1.0.0/16", false},
+		{"1.2.3", false, "", true},
+		{"1.2.3.4/33", false, "", true},
+	}
+
+	for _, tt := range tests {
+		p, err := parseECS(tt.ecs)
+		if (err != nil) != tt.err {
+			t.Errorf("parseECS(%q) error: %v", tt.ecs, err)
+			continue
+		}
+		if p == nil {
+			if tt.ecs != "" && !tt.err {
+				t.Errorf("parseECS(%q) = nil", tt.ecs)
+			}
+			continue
+		}
+
+		var subnet string
+		if p.subnet != nil {
+			subnet = p.subnet.String()
+		}
+		if p.strip != tt.strip || subnet != tt.subnet {
+			t.Errorf("parseECS(%q) = strip %v, subnet %s, want %v, %s", tt.ecs, p.strip, subnet, tt.strip, tt.subnet)
+		}
+	}
+}
+
+func TestECSApply(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("1.2.3.0/24")
+	clientECS := NewECSOption(&net.IPNet{IP: net.IPv4(5, 6, 7, 0), Mask: net.CIDRMask(24, 32)})
+
+	tests := []struct {
+		name   string
+		policy *ecsPolicy
+		opts   []EDNS0Option // nil means no OPT rr in request
+		want   []EDNS0Option
+	}{
+		{"add without OPT", &ecsPolicy{subnet: subnet}, nil, []EDNS0Option{NewECSOption(subnet)}},
+		{"add", &ecsPolicy{subnet: subnet}, []EDNS0Option{cookie}, []EDNS0Option{cookie, NewECSOption(subnet)}},
+		{"replace", &ecsPolicy{subnet: subnet}, []EDNS0Option{clientECS, cookie}, []EDNS0Option{cookie, NewECSOption(subnet)}},
+		{"strip", &ecsPolicy{strip: true}, []EDNS0Option{clientECS, cookie}, []EDNS0Option{cookie}},
+		{"strip without OPT", &ecsPolicy{strip: true}, nil, nil},
+	}
+
+	for _, tt := range tests {
+		req := NewMessage(1, Query)
+		req.SetQuestion(NewQuestion(QTypeA, "www.example.com"))
+		if tt.opts != nil {
+			opt := NewOPT(1232)
+			opt.SetOptions(tt.opts)
+			req.AddAdditional(opt)
+		}
+
+		b, err := tt.policy.apply(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ecsOptions(t, b[2:]); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: options = %v, want %v", tt.name, got, tt.want)
+		}
+
+		// the client's request is untouched
+		if tt.opts != nil {
+			if got, _ := req.OPT().Options(); !reflect.DeepEqual(got, tt.opts) {
+				t.Errorf("%s: options of request changed to %v", tt.name, got)
+			}
+		}
+	}
+}
+
+func TestStripECS(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("1.2.3.0/24")
+	opt := NewOPT(1232)
+	opt.SetOptions([]EDNS0Option{cookie, NewECSOption(subnet)})
+
+	answer := wireRR(pointer(HeaderLen), QTypeA, ClassINET, 300, []byte{1, 2, 3, 4})
+	optRR := wireRR([]byte{0}, QTypeOPT, 1232, 0, opt.RDATA)
+	glue := wireRR(wireName("ns1.example.com"), QTypeA, ClassINET, 300, []byte{5, 6, 7, 8})
+	b := wireMsg("www.example.com", 1, 0, 2, answer, optRR, glue)
+
+	n, err := stripECS(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := UnmarshalMessage(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rrTypes(m.Additional); !reflect.DeepEqual(got, []uint16{QTypeA, QTypeOPT}) {
+		t.Errorf("additional = %v, want A, OPT", got)
+	}
+	if len(m.Answers) != 1 || m.Answers[0].IP != "1.2.3.4" || m.Additional[0].IP != "5.6.7.8" {
+		t.Errorf("rrs are changed: %v, %v", m.Answers, m.Additional)
+	}
+	if m.UDPSize() != 1232 {
+		t.Errorf("udp size = %d, want 1232", m.UDPSize())
+	}
+	if got := ecsOptions(t, b[:n]); !reflect.DeepEqual(got, []EDNS0Option{cookie}) {
+		t.Errorf("options = %v, want cookie only", got)
+	}
+
+	// no ecs option
+	b2 := append([]byte(nil), b[:n]...)
+	if n2, err := stripECS(b2); err != nil || !bytes.Equal(b2[:n2], b[:n]) {
+		t.Errorf("strip message without ecs: changed, error %v", err)
+	}
+}
+
+// directProxy is a proxy which connects all addresses directly.
+type directProxy struct{}
+
+func (directProxy) Dial(network, addr string, sess *proxy.Session) (net.Conn, proxy.Dialer, error) {
+	c, err := proxy.Default.Dial(network, addr)
+	return c, proxy.Default, err
+}
+
+func (directProxy) DialUDP(network, addr string, sess *proxy.Session) (net.PacketConn, net.Addr, error) {
+	return proxy.Default.DialUDP(network, addr)
+}
+
+func (directProxy) NextDialer(dstAddr string, sess *proxy.Session) proxy.Dialer { return proxy.Default }
+
+func (directProxy) Record(dialer proxy.Dialer, success bool) {}
+
+func TestResolveECS(t *testing.T) {
+	s := newTestServer(t, net.IPv4(1, 2, 3, 4), RCodeSuccess, 0)
+	defer s.Close()
+
+	c, err := NewClient(directProxy{}, &Config{Servers: []string{s.Addr()}, Timeout: 1, MaxTTL: 1800, ECS: "1.2.3.0/24", CacheSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, subnet, _ := net.ParseCIDR("5.6.7.0/24")
+	for _, clientECS := range []bool{false, true} {
+		req := NewMessage(0, Query)
+		req.setFlag(0, 0, 0, 0, 1, 0, 0)
+		req.SetQuestion(NewQuestion(QTypeA, "www.example.com"))
+		opt := NewOPT(1232)
+		if clientECS {
+			opt.SetOptions([]EDNS0Option{NewECSOption(subnet)})
+		}
+		req.AddAdditional(opt)
+		reqBytes, err := marshalWithLen(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the upstream echoes the ecs option set by policy
+		resp, err := c.resolve(req, reqBytes, "127.0.0.1:1234", false, &QueryLogEntry{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip, _ := answerIP(t, resp); ip != "1.2.3.4" {
+			t.Errorf("client ecs %v: answer %q, want 1.2.3.4", clientECS, ip)
+		}
+
+		m, _ := UnmarshalMessage(resp[2:])
+		if hasECS(m) != clientECS {
+			t.Errorf("client ecs %v: response has ecs %v", clientECS, hasECS(m))
+		}
+
+		// the cached response is served to any client, no ecs in it
+		cached := c.cache.GetCopy(qKey(req.Question))
+		if cached == nil {
+			t.Fatalf("client ecs %v: response is not cached", clientECS)
+		}
+		if m, _ := UnmarshalMessage(cached[2:]); m == nil || m.OPT() == nil || hasECS(m) {
+			t.Errorf("client ecs %v: cached response should have OPT rr without ecs", clientECS)
+		}
+	}
+}
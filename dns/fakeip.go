@@ -0,0 +1,298 @@
+package dns
+
+import (
+	"container/list"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nadoo/glider/common/log"
+	"github.com/nadoo/glider/proxy"
+)
+
+// fakeIPMaxSize is the max number of addresses used in a fake ip range.
+const fakeIPMaxSize = 1 << 20
+
+// fakeIPAnswerTTL is the TTL of fake ip answers, keep it short so clients
+// will not use a fake ip after it is recycled.
+const fakeIPAnswerTTL = 1
+
+type fakeEntry struct {
+	domain string
+	ip     net.IP
+	expire time.Time
+}
+
+// fakePool is a fake ip pool of one address family.
+type fakePool struct {
+	ipnet    *net.IPNet
+	base     *big.Int
+	size     int64
+	next     int64
+	lru      *list.List // front: most recently used
+	byDomain map[string]*list.Element
+	byIP     map[string]*list.Element
+}
+
+func newFakePool(ipnet *net.IPNet) (*fakePool, error) {
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones < 2 {
+		return nil, errors.New("fakeip: range too small: " + ipnet.String())
+	}
+
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	if size.Cmp(big.NewInt(fakeIPMaxSize)) > 0 {
+		size.SetInt64(fakeIPMaxSize)
+	}
+
+	return &fakePool{
+		ipnet:    ipnet,
+		base:     new(big.Int).SetBytes(ipnet.IP),
+		size:     size.Int64(),
+		next:     1, // skip the network address
+		lru:      list.New(),
+		byDomain: make(map[string]*list.Element),
+		byIP:     make(map[string]*list.Element),
+	}, nil
+}
+
+// ipAt returns the ip at offset n of the pool.
+func (p *fakePool) ipAt(n int64) net.IP {
+	b := new(big.Int).Add(p.base, big.NewInt(n)).Bytes()
+	ip := make(net.IP, len(p.ipnet.IP))
+	copy(ip[len(ip)-len(b):], b)
+	return ip
+}
+
+func (p *fakePool) remove(e *list.Element) {
+	entry := p.lru.Remove(e).(*fakeEntry)
+	delete(p.byDomain, entry.domain)
+	delete(p.byIP, entry.ip.String())
+}
+
+// get returns the fake ip of domain, allocates a new one if not exists.
+func (p *fakePool) get(domain string, ttl time.Duration) net.IP {
+	now := time.Now()
+	if e, ok := p.byDomain[domain]; ok {
+		entry := e.Value.(*fakeEntry)
+		entry.expire = now.Add(ttl)
+		p.lru.MoveToFront(e)
+		return entry.ip
+	}
+
+	var ip net.IP
+	if back := p.lru.Back(); back != nil && (p.next >= p.size-1 || now.After(back.Value.(*fakeEntry).expire)) {
+		// pool exhausted or the least recently used entry expired, recycle it
+		ip = back.Value.(*fakeEntry).ip
+		p.remove(back)
+	} else {
+		ip = p.ipAt(p.next)
+		p.next++
+	}
+
+	entry := &fakeEntry{domain: domain, ip: ip, expire: now.Add(ttl)}
+	e := p.lru.PushFront(entry)
+	p.byDomain[domain] = e
+	p.byIP[ip.String()] = e
+
+	return ip
+}
+
+// lookup returns the domain of the fake ip.
+func (p *fakePool) lookup(ip net.IP, ttl time.Duration) (string, bool) {
+	e, ok := p.byIP[ip.String()]
+	if !ok {
+		return "", false
+	}
+
+	entry := e.Value.(*fakeEntry)
+	if time.Now().After(entry.expire) {
+		p.remove(e)
+		return "", false
+	}
+
+	entry.expire = time.Now().Add(ttl)
+	p.lru.MoveToFront(e)
+
+	return entry.domain, true
+}
+
+// FakeIP is a bidirectional domain and fake ip table.
+type FakeIP struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	v4  *fakePool
+	v6  *fakePool
+}
+
+// NewFakeIP returns a new fake ip table, cidrs are the fake ip ranges,
+// at most one ipv4 and one ipv6 range. Mappings not used in ttl will be recycled.
+func NewFakeIP(cidrs []string, ttl int) (*FakeIP, error) {
+	f := &FakeIP{ttl: time.Duration(ttl) * time.Second}
+	for _, s := range cidrs {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			ipnet.IP = ip4
+			f.v4, err = newFakePool(ipnet)
+		} else {
+			f.v6, err = newFakePool(ipnet)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if f.v4 == nil && f.v6 == nil {
+		return nil, errors.New("fakeip: no fake ip range specified")
+	}
+
+	return f, nil
+}
+
+// IP returns the fake ip of domain for query type qtype, nil if there's
+// no fake ip range of that address family.
+func (f *FakeIP) IP(domain string, qtype uint16) net.IP {
+	p := f.v4
+	if qtype == QTypeAAAA {
+		p = f.v6
+	}
+
+	if p == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return p.get(strings.ToLower(domain), f.ttl)
+}
+
+// Contains reports whether the ip is in the fake ip ranges.
+func (f *FakeIP) Contains(ip net.IP) bool {
+	return f.pool(ip) != nil
+}
+
+func (f *FakeIP) pool(ip net.IP) *fakePool {
+	if ip4 := ip.To4(); ip4 != nil {
+		if f.v4 != nil && f.v4.ipnet.Contains(ip4) {
+			return f.v4
+		}
+		return nil
+	}
+
+	if f.v6 != nil && f.v6.ipnet.Contains(ip) {
+		return f.v6
+	}
+
+	return nil
+}
+
+// Domain returns the domain of the fake ip.
+func (f *FakeIP) Domain(ip net.IP) (string, bool) {
+	p := f.pool(ip)
+	if p == nil {
+		return "", false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return p.lookup(ip, f.ttl)
+}
+
+// Translate translates the fake ip in addr to domain, addr format: host:port.
+// It returns addr itself if the host is not a fake ip.
+func (f *FakeIP) Translate(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !f.Contains(ip) {
+		return addr, nil
+	}
+
+	domain, ok := f.Domain(ip)
+	if !ok {
+		return addr, errors.New("fakeip: no domain found for " + host + ", maybe expired")
+	}
+
+	return net.JoinHostPort(domain, port), nil
+}
+
+// MakeResponse makes a fake ip response message for req.
+func (f *FakeIP) MakeResponse(req *Message) *Message {
+	m := NewMessage(req.ID, Response)
+	m.setFlag(1, 0, 0, 0, (req.Bits>>8)&1, 1, 0)
+	m.SetQuestion(req.Question)
+
+	if ip := f.IP(req.Question.QNAME, req.Question.QTYPE); ip != nil {
+		m.AddAnswer(&RR{NAME: req.Question.QNAME, TYPE: req.Question.QTYPE, CLASS: ClassINET,
+			TTL: fakeIPAnswerTTL, RDLENGTH: uint16(len(ip)), RDATA: ip})
+	}
+
+	return m
+}
+
+// fakeIPProxy translates fake ips to domains before dialing.
+type fakeIPProxy struct {
+	proxy.Proxy
+	fakeIP *FakeIP
+}
+
+// Proxy returns a proxy which translates fake ips to domains before dialing via p,
+// so routing always uses the real domain and it will be resolved by the forwarder.
+func (f *FakeIP) Proxy(p proxy.Proxy) proxy.Proxy {
+	return &fakeIPProxy{Proxy: p, fakeIP: f}
+}
+
+// Dial connects to the given address via the proxy.
+func (p *fakeIPProxy) Dial(network, addr string, sess *proxy.Session) (net.Conn, proxy.Dialer, error) {
+	tgt, err := p.translate(addr)
+	if err != nil {
+		return nil, proxy.Default, err
+	}
+	return p.Proxy.Dial(network, tgt, sess)
+}
+
+// DialUDP connects to the given address via the proxy.
+func (p *fakeIPProxy) DialUDP(network, addr string, sess *proxy.Session) (net.PacketConn, net.Addr, error) {
+	tgt, err := p.translate(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.Proxy.DialUDP(network, tgt, sess)
+}
+
+// NextDialer returns the next dialer according to the real destination.
+func (p *fakeIPProxy) NextDialer(dstAddr string, sess *proxy.Session) proxy.Dialer {
+	tgt, _ := p.translate(dstAddr)
+	return p.Proxy.NextDialer(tgt, sess)
+}
+
+func (p *fakeIPProxy) translate(addr string) (string, error) {
+	tgt, err := p.fakeIP.Translate(addr)
+	if err != nil {
+		log.F("[fakeip] %s", err)
+		return addr, err
+	}
+
+	if tgt != addr {
+		log.F("[fakeip] translate %s to %s", addr, tgt)
+	}
+
+	return tgt, nil
+}
@@ -0,0 +1,472 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nadoo/glider/common/log"
+	"github.com/nadoo/glider/common/pool"
+)
+
+// fileCheckInterval is the interval to check whether the hosts or block list files are changed.
+const fileCheckInterval = 10 * time.Second
+
+// hostRecords is the custom records of a name.
+type hostRecords struct {
+	ips   []net.IP
+	cname string
+	txt   []string
+	ptr   []string
+}
+
+// hostTable is a table of custom records, wildcard names are stored
+// without the leading "*." and match all the subdomains.
+type hostTable struct {
+	exact    map[string]*hostRecords
+	wildcard map[string]*hostRecords
+}
+
+func newHostTable() *hostTable {
+	return &hostTable{exact: make(map[string]*hostRecords), wildcard: make(map[string]*hostRecords)}
+}
+
+// records returns the records of name, creates it if not exists.
+func (t *hostTable) records(name string) *hostRecords {
+	m := t.exact
+	if strings.HasPrefix(name, "*.") {
+		m, name = t.wildcard, name[2:]
+	}
+
+	r, ok := m[name]
+	if !ok {
+		r = &hostRecords{}
+		m[name] = r
+	}
+	return r
+}
+
+// hostRecord is a parsed custom record.
+type hostRecord struct {
+	name  string
+	qtype uint16
+	ip    net.IP // A/AAAA
+	value string // domain of CNAME/PTR, text of TXT
+}
+
+// parseRecord validates a record of name, format of value depends on qtype: ip for A/AAAA, domain for CNAME/PTR.
+func parseRecord(name string, qtype uint16, value string) (*hostRecord, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name == "" || name == "*" {
+		return nil, errors.New("hosts: invalid name")
+	}
+
+	r := &hostRecord{name: name, qtype: qtype}
+	switch qtype {
+	case QTypeA, QTypeAAAA:
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, errors.New("hosts: invalid ip: " + value)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		r.ip = ip
+	case QTypeCNAME:
+		r.value = strings.TrimSuffix(value, ".")
+	case QTypeTXT:
+		r.value = value
+	case QTypePTR:
+		// allow ip address as the name of PTR record
+		if ip := net.ParseIP(name); ip != nil {
+			r.name = reverseName(ip)
+		}
+		r.value = strings.TrimSuffix(value, ".")
+	default:
+		return nil, errors.New("hosts: unsupported record type")
+	}
+
+	return r, nil
+}
+
+// insert inserts the parsed record r to t.
+func (t *hostTable) insert(r *hostRecord) {
+	rs := t.records(r.name)
+	switch r.qtype {
+	case QTypeA, QTypeAAAA:
+		rs.ips = append(rs.ips, r.ip)
+	case QTypeCNAME:
+		rs.cname = r.value
+	case QTypeTXT:
+		rs.txt = append(rs.txt, r.value)
+	case QTypePTR:
+		rs.ptr = append(rs.ptr, r.value)
+	}
+}
+
+// add adds a record of name, format of value depends on qtype: ip for A/AAAA, domain for CNAME/PTR.
+func (t *hostTable) add(name string, qtype uint16, value string) error {
+	r, err := parseRecord(name, qtype, value)
+	if err != nil {
+		return err
+	}
+	t.insert(r)
+	return nil
+}
+
+// lookup returns the records of name, exact names take precedence over
+// wildcard names, and the longest wildcard name wins.
+func (t *hostTable) lookup(name string) *hostRecords {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if r, ok := t.exact[name]; ok {
+		return r
+	}
+
+	for i := strings.IndexByte(name, '.'); i != -1; {
+		if r, ok := t.wildcard[name[i+1:]]; ok {
+			return r
+		}
+		next := strings.IndexByte(name[i+1:], '.')
+		if next == -1 {
+			break
+		}
+		i += next + 1
+	}
+
+	return nil
+}
+
+// Hosts holds custom records from config and hosts files.
+type Hosts struct {
+	mu     sync.RWMutex
+	static *hostTable // records from config
+	table  *hostTable // static records merged with records in files
+
+	files []string
+}
+
+// NewHosts returns a new Hosts, files will be reloaded when changed.
+func NewHosts(files []string) *Hosts {
+	h := &Hosts{static: newHostTable(), table: newHostTable(), files: files}
+	if len(files) > 0 {
+		h.reload()
+		watchFiles(files, h.reload)
+	}
+
+	return h
+}
+
+// AddRecord adds a custom record, format:
+// www.example.com/1.2.3.4, *.lan/10.0.0.1, www.example.com/1.2.3.4,1.2.3.5,
+// www.example.com/CNAME/example.com, www.example.com/TXT/text,
+// 10.0.0.1/PTR/router.lan or 1.0.0.10.in-addr.arpa/PTR/router.lan.
+func (h *Hosts) AddRecord(record string) error {
+	r := strings.SplitN(record, "/", 3)
+	if len(r) < 2 {
+		return errors.New("hosts: invalid record: " + record)
+	}
+
+	// parse all the records first, so nothing is added if any of them is invalid
+	var records []*hostRecord
+	if len(r) == 3 {
+		rec, err := parseRecord(r[0], recordType(r[1]), r[2])
+		if err != nil {
+			return err
+		}
+		records = append(records, rec)
+	} else {
+		for _, ip := range strings.Split(r[1], ",") {
+			rec, err := parseRecord(r[0], QTypeA, ip)
+			if err != nil {
+				return err
+			}
+			records = append(records, rec)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// the static records are added to the merged table too, so they
+	// take effect without reloading the hosts files.
+	for _, rec := range records {
+		h.static.insert(rec)
+		h.table.insert(rec)
+	}
+
+	return nil
+}
+
+// recordType returns the query type of record type string.
+func recordType(s string) uint16 {
+	switch strings.ToUpper(s) {
+	case "A":
+		return QTypeA
+	case "AAAA":
+		return QTypeAAAA
+	case "CNAME":
+		return QTypeCNAME
+	case "TXT":
+		return QTypeTXT
+	case "PTR":
+		return QTypePTR
+	}
+	return 0
+}
+
+// merge rebuilds the merged table with records in files, the caller must hold the lock.
+func (h *Hosts) merge() {
+	t := newHostTable()
+	copyTable(t, h.static)
+
+	for _, file := range h.files {
+		if err := loadHostsFile(t, file); err != nil {
+			log.F("[dns] failed to load hosts file %s: %v", file, err)
+		}
+	}
+
+	h.table = t
+}
+
+// copyTable copies the records in src to dst.
+func copyTable(dst, src *hostTable) {
+	for _, m := range []struct{ dst, src map[string]*hostRecords }{
+		{dst.exact, src.exact}, {dst.wildcard, src.wildcard}} {
+		for name, r := range m.src {
+			c := *r
+			c.ips = append([]net.IP(nil), r.ips...)
+			c.txt = append([]string(nil), r.txt...)
+			c.ptr = append([]string(nil), r.ptr...)
+			m.dst[name] = &c
+		}
+	}
+}
+
+// loadHostsFile loads records from hosts file to t, format: "ip name1 name2 # comment",
+// a PTR record will be added for each ip with the first name.
+func loadHostsFile(t *hostTable, file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		if net.ParseIP(fields[0]) == nil {
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			t.add(name, QTypeA, fields[0])
+		}
+
+		if !strings.HasPrefix(fields[1], "*.") {
+			t.add(fields[0], QTypePTR, fields[1])
+		}
+	}
+
+	return s.Err()
+}
+
+// reload reloads all the hosts files.
+func (h *Hosts) reload() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.merge()
+	log.F("[dns] loaded %d names and %d wildcard names from hosts files",
+		len(h.table.exact), len(h.table.wildcard))
+}
+
+// lookup returns a copy of the records of name.
+func (h *Hosts) lookup(name string) (hostRecords, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if r := h.table.lookup(name); r != nil {
+		return *r, true
+	}
+	return hostRecords{}, false
+}
+
+// watchFiles calls onChange in background when any of the files is changed.
+func watchFiles(files []string, onChange func()) {
+	modTimes := func() []time.Time {
+		t := make([]time.Time, len(files))
+		for i, file := range files {
+			if fi, err := os.Stat(file); err == nil {
+				t[i] = fi.ModTime()
+			}
+		}
+		return t
+	}
+
+	last := modTimes()
+	go func() {
+		for range time.Tick(fileCheckInterval) {
+			cur := modTimes()
+			for i := range cur {
+				if !cur[i].Equal(last[i]) {
+					last = cur
+					onChange()
+					break
+				}
+			}
+		}
+	}()
+}
+
+// reverseName returns the reverse lookup name of ip.
+// https://tools.ietf.org/html/rfc1035#section-3.5
+// https://tools.ietf.org/html/rfc3596#section-2.5
+func reverseName(ip net.IP) string {
+	var sb strings.Builder
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			sb.WriteString(strconv.Itoa(int(ip4[i])))
+			sb.WriteByte('.')
+		}
+		sb.WriteString("in-addr.arpa")
+		return sb.String()
+	}
+
+	const hex = "0123456789abcdef"
+	for i := len(ip) - 1; i >= 0; i-- {
+		sb.WriteByte(hex[ip[i]&0xf])
+		sb.WriteByte('.')
+		sb.WriteByte(hex[ip[i]>>4])
+		sb.WriteByte('.')
+	}
+	sb.WriteString("ip6.arpa")
+	return sb.String()
+}
+
+// maxCNAMEChain is the max number of cname records followed in custom records.
+const maxCNAMEChain = 8
+
+// answerHosts answers req authoritatively with custom records, ok is false if qname is not a custom name.
+func (c *Client) answerHosts(req *Message, clientAddr string, preferTCP bool) (m *Message, ok bool) {
+	q := req.Question
+	r, ok := c.hosts.lookup(q.QNAME)
+	if !ok {
+		return nil, false
+	}
+
+	m = NewMessage(req.ID, Response)
+	m.setFlag(1, 0, 1, 0, (req.Bits>>8)&1, 1, RCodeSuccess)
+	m.SetQuestion(q)
+
+	ttl := uint32(c.config.MinTTL)
+
+	// follow the cname chain in custom records
+	name := q.QNAME
+	for i := 0; ok && r.cname != "" && q.QTYPE != QTypeCNAME && i < maxCNAMEChain; i++ {
+		m.AddAnswer(nameRR(name, QTypeCNAME, ttl, r.cname))
+		name = r.cname
+		r, ok = c.hosts.lookup(name)
+	}
+
+	if ok {
+		addHostRecords(m, name, q.QTYPE, ttl, &r)
+	} else if q.QTYPE == QTypeA || q.QTYPE == QTypeAAAA {
+		// the cname target is not a custom name, resolve it via upstream
+		if err := c.resolveCNAME(m, name, q.QTYPE, clientAddr, preferTCP); err != nil {
+			log.F("[dns] failed to resolve cname target %s of %s: %v", name, q.QNAME, err)
+		}
+	}
+
+	log.F("[dns] %s <-> hosts, type: %d, %s, answers: %d", clientAddr, q.QTYPE, q.QNAME, len(m.Answers))
+
+	return m, true
+}
+
+// resolveCNAME resolves the cname target and adds the answers to m.
+func (c *Client) resolveCNAME(m *Message, target string, qtype uint16, clientAddr string, preferTCP bool) error {
+	resp, respBytes, err := c.query(target, qtype, clientAddr, preferTCP)
+	if err != nil {
+		return err
+	}
+	defer pool.PutBuffer(respBytes)
+
+	for _, rr := range resp.Answers {
+		switch rr.TYPE {
+		case QTypeA, QTypeAAAA:
+			m.AddAnswer(&RR{NAME: rr.NAME, TYPE: rr.TYPE, CLASS: rr.CLASS, TTL: rr.TTL,
+				RDLENGTH: rr.RDLENGTH, RDATA: append([]byte(nil), rr.RDATA...)})
+		case QTypeCNAME:
+			// the domain in rdata may be compressed, decode it and marshal again
+			sb := new(strings.Builder)
+			if _, err := resp.UnmarshalDomainTo(sb, rr.RDATA); err != nil {
+				return err
+			}
+			m.AddAnswer(nameRR(rr.NAME, QTypeCNAME, rr.TTL, sb.String()))
+		}
+	}
+
+	m.Bits = m.Bits&^0xF | resp.RCODE()
+	return nil
+}
+
+// addHostRecords adds the custom records of name with type qtype to m.
+func addHostRecords(m *Message, name string, qtype uint16, ttl uint32, r *hostRecords) {
+	switch qtype {
+	case QTypeA, QTypeAAAA:
+		for _, ip := range r.ips {
+			if (qtype == QTypeA) == (len(ip) == net.IPv4len) {
+				m.AddAnswer(&RR{NAME: name, TYPE: qtype, CLASS: ClassINET,
+					TTL: ttl, RDLENGTH: uint16(len(ip)), RDATA: ip})
+			}
+		}
+	case QTypeCNAME:
+		if r.cname != "" {
+			m.AddAnswer(nameRR(name, QTypeCNAME, ttl, r.cname))
+		}
+	case QTypePTR:
+		for _, ptr := range r.ptr {
+			m.AddAnswer(nameRR(name, QTypePTR, ttl, ptr))
+		}
+	case QTypeTXT:
+		for _, txt := range r.txt {
+			// https://tools.ietf.org/html/rfc1035#section-3.3.14
+			// one or more <character-string>s, each of them is at most 255 bytes
+			var rdata []byte
+			for s := txt; ; s = s[255:] {
+				n := len(s)
+				if n > 255 {
+					n = 255
+				}
+				rdata = append(rdata, byte(n))
+				rdata = append(rdata, s[:n]...)
+				if len(s) <= 255 {
+					break
+				}
+			}
+			m.AddAnswer(&RR{NAME: name, TYPE: QTypeTXT, CLASS: ClassINET,
+				TTL: ttl, RDLENGTH: uint16(len(rdata)), RDATA: rdata})
+		}
+	}
+}
+
+// nameRR returns a rr whose rdata is a domain name, like CNAME and PTR.
+func nameRR(name string, qtype uint16, ttl uint32, domain string) *RR {
+	buf := &bytes.Buffer{}
+	MarshalDomainTo(buf, domain)
+	return &RR{NAME: name, TYPE: qtype, CLASS: ClassINET,
+		TTL: ttl, RDLENGTH: uint16(buf.Len()), RDATA: buf.Bytes()}
+}
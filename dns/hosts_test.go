@@ -0,0 +1,109 @@
+package dns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHostsAddRecord(t *testing.T) {
+	h := NewHosts(nil)
+	for _, record := range []string{
+		"www.example.com/1.2.3.4,1.2.3.5",
+		"www.example.com/AAAA/2001:db8::1",
+		"*.lan/10.0.0.1",
+		"router.lan/10.0.0.254",
+		"alias.example.com/CNAME/www.example.com.",
+		"www.example.com/TXT/hello",
+		"10.0.0.254/PTR/router.lan",
+	} {
+		if err := h.AddRecord(record); err != nil {
+			t.Fatalf("AddRecord(%q): %v", record, err)
+		}
+	}
+
+	r, ok := h.lookup("WWW.example.com.")
+	if !ok || len(r.ips) != 3 || !r.ips[0].Equal(net.IPv4(1, 2, 3, 4)) || len(r.ips[0]) != net.IPv4len ||
+		!reflect.DeepEqual(r.txt, []string{"hello"}) {
+		t.Errorf("lookup www.example.com = %+v, %v", r, ok)
+	}
+	if r, _ := h.lookup("alias.example.com"); r.cname != "www.example.com" {
+		t.Errorf("cname = %q, want www.example.com", r.cname)
+	}
+	if r, _ := h.lookup("pc.lan"); len(r.ips) != 1 || !r.ips[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("wildcard lookup pc.lan = %+v", r)
+	}
+	if r, _ := h.lookup("router.lan"); len(r.ips) != 1 || !r.ips[0].Equal(net.IPv4(10, 0, 0, 254)) {
+		t.Errorf("exact name should take precedence over wildcard: %+v", r)
+	}
+	if r, _ := h.lookup("254.0.0.10.in-addr.arpa"); !reflect.DeepEqual(r.ptr, []string{"router.lan"}) {
+		t.Errorf("ptr = %v, want router.lan", r.ptr)
+	}
+	if _, ok := h.lookup("lan"); ok {
+		t.Error("wildcard matches the parent name")
+	}
+
+	// invalid records are not added, nor any part of them
+	for _, record := range []string{
+		"invalid",
+		"bad.example.com/1.2.3.4,invalid",
+		"bad.example.com/MX/mail.example.com",
+		"/1.2.3.4",
+		"*/1.2.3.4",
+	} {
+		if err := h.AddRecord(record); err == nil {
+			t.Errorf("AddRecord(%q): expected error", record)
+		}
+	}
+	if r, ok := h.lookup("bad.example.com"); ok {
+		t.Errorf("invalid record is added partially: %+v", r)
+	}
+	if len(h.static.exact) != len(h.table.exact) || len(h.static.wildcard) != len(h.table.wildcard) {
+		t.Error("static and merged tables differ")
+	}
+}
+
+func TestHostsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(file, []byte(`# comment
+10.0.0.2 nas.lan nas # inline comment
+10.0.0.3 *.dev.lan
+invalid host.lan
+`), 0644)
+
+	h := NewHosts([]string{file})
+	if err := h.AddRecord("static.lan/10.0.0.9"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"nas.lan": "10.0.0.2", "nas": "10.0.0.2", "a.dev.lan": "10.0.0.3", "static.lan": "10.0.0.9"} {
+		if r, _ := h.lookup(name); len(r.ips) != 1 || r.ips[0].String() != want {
+			t.Errorf("lookup %s = %v, want %s", name, r.ips, want)
+		}
+	}
+	if r, _ := h.lookup("2.0.0.10.in-addr.arpa"); !reflect.DeepEqual(r.ptr, []string{"nas.lan"}) {
+		t.Errorf("ptr of hosts file = %v, want nas.lan", r.ptr)
+	}
+	if _, ok := h.lookup("host.lan"); ok {
+		t.Error("line with invalid ip is loaded")
+	}
+
+	// static records are kept after reloading
+	ioutil.WriteFile(file, []byte("10.0.0.4 nas.lan\n"), 0644)
+	h.reload()
+	if r, _ := h.lookup("nas.lan"); len(r.ips) != 1 || r.ips[0].String() != "10.0.0.4" {
+		t.Errorf("lookup nas.lan after reload = %v", r.ips)
+	}
+	if r, _ := h.lookup("static.lan"); len(r.ips) != 1 {
+		t.Errorf("static record is lost after reload")
+	}
+}
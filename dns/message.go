@@ -8,6 +8,8 @@ import (
 	"math/rand"
 	"net"
 	"strings"
+
+	"github.com/nadoo/glider/common/pool"
 )
 
 // UDPMaxLen is the max size of udp dns request.
@@ -17,6 +19,11 @@ import (
 // the header.
 const UDPMaxLen = 512
 
+// MsgMaxLen is the max size of dns message, used as the buffer size when
+// reading udp messages since the payload size can be enlarged by EDNS0.
+// https://tools.ietf.org/html/rfc6891#section-6.2.5
+const MsgMaxLen = 65535
+
 // HeaderLen is the length of dns msg header.
 const HeaderLen = 12
 
@@ -28,13 +35,29 @@ const (
 
 // Query types.
 const (
-	QTypeA    uint16 = 1  //ipv4
-	QTypeAAAA uint16 = 28 ///ipv6
+	QTypeA     uint16 = 1  //ipv4
+	QTypeNS    uint16 = 2  //name server
+	QTypeCNAME uint16 = 5  //canonical name
+	QTypeSOA   uint16 = 6  //start of authority
+	QTypePTR   uint16 = 12 //domain name pointer
+	QTypeMX    uint16 = 15 //mail exchange
+	QTypeTXT   uint16 = 16 //text strings
+	QTypeAAAA  uint16 = 28 ///ipv6
+	QTypeOPT   uint16 = 41 //edns0 pseudo rr
 )
 
 // ClassINET .
 const ClassINET uint16 = 1
 
+// Response codes.
+const (
+	RCodeSuccess     uint16 = 0
+	RCodeFormatError uint16 = 1
+	RCodeServerFail  uint16 = 2
+	RCodeNameError   uint16 = 3 //nxdomain
+	RCodeRefused     uint16 = 5
+)
+
 // Message format:
 // https://tools.ietf.org/html/rfc1035#section-4.1
 // All communications inside of the domain protocol are carried in a single
@@ -98,10 +121,145 @@ func (m *Message) Marshal() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// marshalWithLen marshals message to a buffer from pool with the 2 bytes length prefix.
+// NOTE: b = msgLen + msg, put it back to pool after use.
+func marshalWithLen(m *Message) ([]byte, error) {
+	wb := pool.GetWriteBuffer()
+	defer pool.PutWriteBuffer(wb)
+
+	wb.Write([]byte{0, 0})
+
+	n, err := m.MarshalTo(wb)
+	if err != nil {
+		return nil, err
+	}
+
+	b := pool.GetBuffer(wb.Len())
+	copy(b, wb.Bytes())
+	binary.BigEndian.PutUint16(b[:2], uint16(n))
+
+	return b, nil
+}
+
+// AddAdditional adds an additional rr to dns message.
+func (m *Message) AddAdditional(rr *RR) error {
+	m.Additional = append(m.Additional, rr)
+	return nil
+}
+
+// OPT returns the OPT pseudo rr in the additional section, nil if not exists.
+// https://tools.ietf.org/html/rfc6891#section-6.1.2
+func (m *Message) OPT() *RR {
+	for _, rr := range m.Additional {
+		if rr.TYPE == QTypeOPT {
+			return rr
+		}
+	}
+	return nil
+}
+
+// UDPSize returns the max udp payload size the sender of message can handle.
+// https://tools.ietf.org/html/rfc6891#section-6.2.3
+func (m *Message) UDPSize() int {
+	if opt := m.OPT(); opt != nil && opt.CLASS > UDPMaxLen {
+		return int(opt.CLASS)
+	}
+	return UDPMaxLen
+}
+
+// EDNS0 option codes.
+// https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-11
+const (
+	OptionCodeECS uint16 = 8 //edns client subnet
+)
+
+// EDNS0Option is an option in the RDATA of OPT rr.
+// https://tools.ietf.org/html/rfc6891#section-6.1.2
+//
+//                 +0 (MSB)                            +1 (LSB)
+//      +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//   0: |                          OPTION-CODE                          |
+//      +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//   2: |                         OPTION-LENGTH                         |
+//      +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//   4: |                                                               |
+//      /                          OPTION-DATA                          /
+//      /                                                               /
+//      +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+type EDNS0Option struct {
+	Code uint16
+	Data []byte
+}
+
+// NewOPT returns a new OPT pseudo rr with the udp payload size.
+func NewOPT(udpSize uint16) *RR {
+	return &RR{NAME: "", TYPE: QTypeOPT, CLASS: udpSize}
+}
+
+// Options returns the options in the RDATA of OPT rr.
+func (rr *RR) Options() ([]EDNS0Option, error) {
+	var opts []EDNS0Option
+	for b := rr.RDATA; len(b) > 0; {
+		if len(b) < 4 {
+			return nil, errors.New("Options: not enough data")
+		}
+
+		code, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			return nil, errors.New("Options: not enough data for OPTION-DATA")
+		}
+
+		opts = append(opts, EDNS0Option{Code: code, Data: b[4 : 4+n]})
+		b = b[4+n:]
+	}
+	return opts, nil
+}
+
+// SetOptions sets the options to the RDATA of OPT rr.
+func (rr *RR) SetOptions(opts []EDNS0Option) {
+	var rdata []byte
+	for _, opt := range opts {
+		rdata = append(rdata, byte(opt.Code>>8), byte(opt.Code), byte(len(opt.Data)>>8), byte(len(opt.Data)))
+		rdata = append(rdata, opt.Data...)
+	}
+	rr.RDATA = rdata
+	rr.RDLENGTH = uint16(len(rdata))
+}
+
+// NewECSOption returns a new edns client subnet option of ipnet.
+// https://tools.ietf.org/html/rfc7871#section-6
+//
+//                 +0 (MSB)                            +1 (LSB)
+//      +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//   0: |                          OPTION-CODE                          |
+//      +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//   2: |                         OPTION-LENGTH                         |
+//      +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//   4: |                            FAMILY                             |
+//      +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//   6: |     SOURCE PREFIX-LENGTH      |     SCOPE PREFIX-LENGTH       |
+//      +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//   8: |                           ADDRESS...                          /
+//      +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+func NewECSOption(ipnet *net.IPNet) EDNS0Option {
+	family, ip := uint16(2), ipnet.IP.To16()
+	if ip4 := ipnet.IP.To4(); ip4 != nil {
+		family, ip = 1, ip4
+	}
+
+	prefix, _ := ipnet.Mask.Size()
+	addr := ip.Mask(ipnet.Mask)[:(prefix+7)/8]
+
+	data := []byte{byte(family >> 8), byte(family), byte(prefix), 0}
+	return EDNS0Option{Code: OptionCodeECS, Data: append(data, addr...)}
+}
+
 // MarshalTo marshals message struct to []byte and write to w.
 func (m *Message) MarshalTo(w io.Writer) (n int, err error) {
 	m.Header.SetQdcount(1)
 	m.Header.SetAncount(len(m.Answers))
+	m.Header.SetNscount(len(m.Authority))
+	m.Header.SetArcount(len(m.Additional))
 
 	nn := 0
 	nn, err = m.Header.MarshalTo(w)
@@ -116,12 +274,14 @@ func (m *Message) MarshalTo(w io.Writer) (n int, err error) {
 	}
 	n += nn
 
-	for _, answer := range m.Answers {
-		nn, err = answer.MarshalTo(w)
-		if err != nil {
-			return
+	for _, rrs := range [][]*RR{m.Answers, m.Authority, m.Additional} {
+		for _, rr := range rrs {
+			nn, err = rr.MarshalTo(w)
+			if err != nil {
+				return
+			}
+			n += nn
 		}
-		n += nn
 	}
 
 	return
@@ -146,24 +306,254 @@ func UnmarshalMessage(b []byte) (*Message, error) {
 	}
 	m.SetQuestion(q)
 
-	// resp answers
+	// resp answers, authority and additional rrs
 	rrIdx := HeaderLen + qLen
-	for i := 0; i < int(m.Header.ANCOUNT); i++ {
-		rr := &RR{}
-		rrLen, err := m.UnmarshalRR(rrIdx, rr)
-		if err != nil {
-			return nil, err
-		}
-		m.AddAnswer(rr)
+	for _, sec := range []struct {
+		count uint16
+		rrs   *[]*RR
+	}{
+		{m.Header.ANCOUNT, &m.Answers},
+		{m.Header.NSCOUNT, &m.Authority},
+		{m.Header.ARCOUNT, &m.Additional},
+	} {
+		for i := 0; i < int(sec.count); i++ {
+			rr := &RR{}
+			rrLen, err := m.UnmarshalRR(rrIdx, rr)
+			if err != nil {
+				return nil, err
+			}
+			*sec.rrs = append(*sec.rrs, rr)
 
-		rrIdx += rrLen
+			rrIdx += rrLen
+		}
 	}
 
 	m.Header.SetAncount(len(m.Answers))
+	m.Header.SetNscount(len(m.Authority))
+	m.Header.SetArcount(len(m.Additional))
 
 	return m, nil
 }
 
+// rrSpan is the position of a rr in the message.
+type rrSpan struct {
+	sec        int // 0: answer, 1: authority, 2: additional
+	start, end int
+	rr         *RR
+}
+
+// rrSpans unmarshals the message b and returns the header, the end of question and positions of all rrs.
+func rrSpans(b []byte) (*Message, int, []rrSpan, error) {
+	m := &Message{unMarshaled: b}
+	if len(b) < HeaderLen {
+		return nil, 0, nil, errors.New("rrSpans: not enough data")
+	}
+
+	err := UnmarshalHeader(b[:HeaderLen], &m.Header)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	qLen, err := m.UnmarshalQuestion(b[HeaderLen:], &Question{})
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	var spans []rrSpan
+	rrIdx := HeaderLen + qLen
+	for sec, count := range []uint16{m.ANCOUNT, m.NSCOUNT, m.ARCOUNT} {
+		for i := 0; i < int(count); i++ {
+			rr := &RR{}
+			rrLen, err := m.UnmarshalRR(rrIdx, rr)
+			if err != nil {
+				return nil, 0, nil, err
+			}
+
+			spans = append(spans, rrSpan{sec, rrIdx, rrIdx + rrLen, rr})
+			rrIdx += rrLen
+		}
+	}
+
+	return m, HeaderLen + qLen, spans, nil
+}
+
+// SetTTL sets the TTL of all rrs(except OPT) in message b in place.
+func SetTTL(b []byte, ttl uint32) error {
+	_, _, spans, err := rrSpans(b)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range spans {
+		if s.rr.TYPE != QTypeOPT {
+			// TTL(4) + RDLENGTH(2) + RDATA
+			binary.BigEndian.PutUint32(b[s.end-int(s.rr.RDLENGTH)-6:], ttl)
+		}
+	}
+
+	return nil
+}
+
+// CopyQName copies the question name of message src to message b in place when they're the same
+// ignoring case, the uncompressed owner names of rrs which are the question name are also copied.
+// clients using 0x20 encoding require the same case as the query in the response.
+func CopyQName(b, src []byte) error {
+	n, err := qNameLen(src)
+	if err != nil {
+		return err
+	}
+
+	name := src[HeaderLen : HeaderLen+n]
+	if m, err := qNameLen(b); err != nil || m != n || !equalFold(b[HeaderLen:HeaderLen+n], name) {
+		return errors.New("CopyQName: question mismatch")
+	}
+
+	_, _, spans, err := rrSpans(b)
+	if err != nil {
+		return err
+	}
+
+	copy(b[HeaderLen:], name)
+	for _, s := range spans {
+		if s.end-s.start > n && equalFold(b[s.start:s.start+n], name) {
+			copy(b[s.start:], name)
+		}
+	}
+
+	return nil
+}
+
+// qNameLen returns the length of the uncompressed question name in message b.
+func qNameLen(b []byte) (int, error) {
+	for i := HeaderLen; i < len(b); i += int(b[i]) + 1 {
+		if b[i] == 0 {
+			return i + 1 - HeaderLen, nil
+		}
+		if b[i]&0xC0 != 0 {
+			return 0, errors.New("qNameLen: compressed question name")
+		}
+	}
+	return 0, errors.New("qNameLen: not enough data")
+}
+
+// equalFold reports whether a and b are the same ignoring ascii case.
+func equalFold(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		if 'A' <= x && x <= 'Z' {
+			x += 'a' - 'A'
+		}
+		if 'A' <= y && y <= 'Z' {
+			y += 'a' - 'A'
+		}
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
+
+// Truncate truncates the message b in place to fit in size bytes and returns the new length.
+// Only whole rrs are kept, the TC flag will be set if any answer or authority rr is dropped.
+// The OPT rr is moved to the end if keepOPT is true, otherwise it will be removed.
+// https://tools.ietf.org/html/rfc2181#section-9
+// https://tools.ietf.org/html/rfc6891#section-7
+func Truncate(b []byte, size int, keepOPT bool) (int, error) {
+	m, qEnd, spans, err := rrSpans(b)
+	if err != nil {
+		return 0, err
+	}
+
+	var opt []byte
+	var opts []rrSpan
+	end := qEnd
+	for _, s := range spans {
+		if s.rr.TYPE == QTypeOPT {
+			if keepOPT && opt == nil {
+				opt = append([]byte(nil), b[s.start:s.end]...)
+			}
+			opts = append(opts, s)
+		}
+		end = s.end
+	}
+
+	// no OPT rr or the only one is the last rr to keep
+	if end <= size && (len(opts) == 0 || keepOPT && len(opts) == 1 && opts[0].end == end) {
+		return end, nil
+	}
+
+	// keep the rrs before the first one that does not fit, the OPT rrs are removed
+	// and the rrs after them are moved forward.
+	var counts [3]uint16
+	n, tc := qEnd, false
+	for _, s := range spans {
+		if s.rr.TYPE == QTypeOPT {
+			continue
+		}
+		if n+s.end-s.start+len(opt) > size {
+			tc = s.sec != 2
+			break
+		}
+		if n != s.start && !moveRR(b, n, s, opts) {
+			break
+		}
+		counts[s.sec]++
+		n += s.end - s.start
+	}
+
+	if opt != nil {
+		n += copy(b[n:], opt)
+		counts[2]++
+	}
+
+	binary.BigEndian.PutUint16(b[6:8], counts[0])
+	binary.BigEndian.PutUint16(b[8:10], counts[1])
+	binary.BigEndian.PutUint16(b[10:12], counts[2])
+
+	if tc {
+		binary.BigEndian.PutUint16(b[2:4], m.Bits|1<<9)
+	}
+
+	return n, nil
+}
+
+// moveRR moves the rr s in message b forward to dst after the removed rrs, the compression pointer
+// in its owner name is adjusted. it returns false if the rr can't be moved: the rdata of it may
+// contain compressed names, or its name points into the removed rrs.
+func moveRR(b []byte, dst int, s rrSpan, removed []rrSpan) bool {
+	// types with compressible names in rdata: NS, MD, MF, CNAME, SOA, MB, MG, MR, PTR, MINFO, MX
+	// https://tools.ietf.org/html/rfc3597#section-4
+	switch s.rr.TYPE {
+	case QTypeNS, 3, 4, QTypeCNAME, QTypeSOA, 7, 8, 9, QTypePTR, 14, QTypeMX:
+		return false
+	}
+
+	i := s.start
+	for b[i] != 0 && b[i]&0xC0 != 0xC0 {
+		i += int(b[i]) + 1
+	}
+
+	if b[i] != 0 {
+		offset := int(binary.BigEndian.Uint16(b[i:]) & 0x3FFF)
+		moved := offset
+		for _, r := range removed {
+			if offset >= r.start && offset < r.end {
+				return false
+			}
+			if offset >= r.end {
+				moved -= r.end - r.start
+			}
+		}
+		binary.BigEndian.PutUint16(b[i:], uint16(moved)|0xC000)
+	}
+
+	copy(b[dst:], b[s.start:s.end])
+	return true
+}
+
 // Header format:
 // https://tools.ietf.org/html/rfc1035#section-4.1.1
 // The header contains the following fields:
@@ -203,6 +593,16 @@ func (h *Header) SetTC(tc int) {
 	h.Bits |= uint16(tc) << 9
 }
 
+// RCODE returns the response code.
+func (h *Header) RCODE() uint16 {
+	return h.Bits & 0xF
+}
+
+// TC returns whether the message is truncated.
+func (h *Header) TC() bool {
+	return h.Bits&(1<<9) != 0
+}
+
 // SetQdcount sets query count, most dns servers only support 1 query per request.
 func (h *Header) SetQdcount(qdcount int) {
 	h.QDCOUNT = uint16(qdcount)
@@ -213,6 +613,16 @@ func (h *Header) SetAncount(ancount int) {
 	h.ANCOUNT = uint16(ancount)
 }
 
+// SetNscount sets authority records count.
+func (h *Header) SetNscount(nscount int) {
+	h.NSCOUNT = uint16(nscount)
+}
+
+// SetArcount sets additional records count.
+func (h *Header) SetArcount(arcount int) {
+	h.ARCOUNT = uint16(arcount)
+}
+
 func (h *Header) setFlag(QR uint16, Opcode uint16, AA uint16,
 	TC uint16, RD uint16, RA uint16, RCODE uint16) {
 	h.Bits = QR<<15 + Opcode<<11 + AA<<10 + TC<<9 + RD<<8 + RA<<7 + RCODE
@@ -422,7 +832,7 @@ func (m *Message) UnmarshalRR(start int, rr *RR) (n int, err error) {
 	}
 	rr.NAME = sb.String()
 
-	if len(p) <= n+10 {
+	if len(p) < n+10 {
 		return 0, errors.New("UnmarshalRR: not enough data")
 	}
 
@@ -437,9 +847,9 @@ func (m *Message) UnmarshalRR(start int, rr *RR) (n int, err error) {
 
 	rr.RDATA = p[n+10 : n+10+int(rr.RDLENGTH)]
 
-	if rr.TYPE == QTypeA {
+	if rr.TYPE == QTypeA && rr.RDLENGTH == net.IPv4len {
 		rr.IP = net.IP(rr.RDATA[:net.IPv4len]).String()
-	} else if rr.TYPE == QTypeAAAA {
+	} else if rr.TYPE == QTypeAAAA && rr.RDLENGTH == net.IPv6len {
 		rr.IP = net.IP(rr.RDATA[:net.IPv6len]).String()
 	}
 
@@ -451,7 +861,13 @@ func (m *Message) UnmarshalRR(start int, rr *RR) (n int, err error) {
 // MarshalDomainTo marshals domain string struct to []byte and write to w.
 func MarshalDomainTo(w io.Writer, domain string) (n int, err error) {
 	nn := 0
+	domain = strings.TrimSuffix(domain, ".")
 	for _, seg := range strings.Split(domain, ".") {
+		// root domain name
+		if seg == "" {
+			continue
+		}
+
 		nn, err = w.Write([]byte{byte(len(seg))})
 		if err != nil {
 			return
@@ -0,0 +1,298 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// wireName returns the uncompressed wire format of domain.
+func wireName(domain string) []byte {
+	var b []byte
+	for _, label := range bytes.Split([]byte(domain), []byte(".")) {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// wireRR returns the wire format of a rr with the encoded owner name.
+func wireRR(name []byte, typ, class uint16, ttl uint32, rdata []byte) []byte {
+	b := append([]byte(nil), name...)
+	b = append(b, byte(typ>>8), byte(typ), byte(class>>8), byte(class))
+	b = append(b, byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl))
+	b = append(b, byte(len(rdata)>>8), byte(len(rdata)))
+	return append(b, rdata...)
+}
+
+// wireMsg returns a response of question qname/A with rrs of the counts.
+func wireMsg(qname string, an, ns, ar uint16, rrs ...[]byte) []byte {
+	b := []byte{0x12, 0x34, 0x81, 0x80, 0, 1, byte(an >> 8), byte(an), byte(ns >> 8), byte(ns), byte(ar >> 8), byte(ar)}
+	b = append(b, wireName(qname)...)
+	b = append(b, 0, byte(QTypeA), 0, byte(ClassINET))
+	for _, rr := range rrs {
+		b = append(b, rr...)
+	}
+	return b
+}
+
+// pointer returns a compression pointer to offset.
+func pointer(offset int) []byte {
+	return []byte{0xC0 | byte(offset>>8), byte(offset)}
+}
+
+func rrTypes(rrs []*RR) (types []uint16) {
+	for _, rr := range rrs {
+		types = append(types, rr.TYPE)
+	}
+	return
+}
+
+// testMsg returns a response of www.example.com/A with an answer, an authority rr of NS ns1.example.com,
+// and the additional rrs: OPT, ns1 A, ns1 AAAA. the name of the ns1 AAAA rr points to the name of ns1 A.
+func testMsg() []byte {
+	qEnd := HeaderLen + len(wireName("www.example.com")) + 4
+	answer := wireRR(pointer(HeaderLen), QTypeA, ClassINET, 300, []byte{1, 2, 3, 4})
+	authority := wireRR(pointer(HeaderLen+4), QTypeNS, ClassINET, 300, append([]byte{3, 'n', 's', '1'}, pointer(HeaderLen+4)...))
+	opt := wireRR([]byte{0}, QTypeOPT, 4096, 0, nil)
+	glue4 := wireRR(append([]byte{3, 'n', 's', '1'}, pointer(HeaderLen+4)...), QTypeA, ClassINET, 300, []byte{5, 6, 7, 8})
+	glue6 := wireRR(pointer(qEnd+len(answer)+len(authority)+len(opt)), QTypeAAAA, ClassINET, 300, net.ParseIP("2001:db8::1"))
+	return wireMsg("www.example.com", 1, 1, 3, answer, authority, opt, glue4, glue6)
+}
+
+func TestTruncate(t *testing.T) {
+	full := testMsg()
+	if _, err := UnmarshalMessage(full); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		size       int
+		keepOPT    bool
+		answers    int
+		authority  int
+		additional []uint16
+		tc         bool
+	}{
+		{"fit, OPT moved to the end", 512, true, 1, 1, []uint16{QTypeA, QTypeAAAA, QTypeOPT}, false},
+		{"fit, OPT removed", 512, false, 1, 1, []uint16{QTypeA, QTypeAAAA}, false},
+		{"additional dropped", len(full) - 20, true, 1, 1, []uint16{QTypeA, QTypeOPT}, false},
+		{"authority dropped", 60, true, 1, 0, []uint16{QTypeOPT}, true},
+		{"answer dropped", 40, false, 0, 0, nil, true},
+	}
+
+	for _, tt := range tests {
+		b := append([]byte(nil), full...)
+		n, err := Truncate(b, tt.size, tt.keepOPT)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if n > tt.size {
+			t.Errorf("%s: length %d larger than %d", tt.name, n, tt.size)
+		}
+
+		m, err := UnmarshalMessage(b[:n])
+		if err != nil {
+			t.Errorf("%s: unmarshal truncated message: %v", tt.name, err)
+			continue
+		}
+		if len(m.Answers) != tt.answers || len(m.Authority) != tt.authority {
+			t.Errorf("%s: %d answers, %d authority, want %d, %d", tt.name, len(m.Answers), len(m.Authority), tt.answers, tt.authority)
+		}
+		if types := rrTypes(m.Additional); !reflect.DeepEqual(types, tt.additional) {
+			t.Errorf("%s: additional types %v, want %v", tt.name, types, tt.additional)
+		}
+		if m.TC() != tt.tc {
+			t.Errorf("%s: tc = %v, want %v", tt.name, m.TC(), tt.tc)
+		}
+
+		for _, rr := range m.Additional {
+			if rr.TYPE != QTypeOPT && rr.NAME != "ns1.example.com" {
+				t.Errorf("%s: name of additional rr is %q after moved", tt.name, rr.NAME)
+			}
+		}
+		if tt.keepOPT && m.UDPSize() != 4096 {
+			t.Errorf("%s: udp size = %d, want 4096", tt.name, m.UDPSize())
+		}
+	}
+}
+
+func TestTruncateUnchanged(t *testing.T) {
+	answer := wireRR(pointer(HeaderLen), QTypeA, ClassINET, 300, []byte{1, 2, 3, 4})
+	opt := wireRR([]byte{0}, QTypeOPT, 1232, 0, nil)
+	b := wireMsg("www.example.com", 1, 0, 1, answer, opt)
+	orig := append([]byte(nil), b...)
+
+	n, err := Truncate(b, 512, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b[:n], orig) {
+		t.Errorf("message with OPT at the end changed:\n%x\n%x", b[:n], orig)
+	}
+
+	// names in rdata may point to the moved rrs, the rrs after OPT are dropped
+	cname := wireRR(pointer(HeaderLen), QTypeCNAME, ClassINET, 300, pointer(HeaderLen+4))
+	b = wireMsg("www.example.com", 0, 0, 2, opt, cname)
+	n, err = Truncate(b, 512, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := UnmarshalMessage(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if types := rrTypes(m.Additional); !reflect.DeepEqual(types, []uint16{QTypeOPT}) || m.TC() {
+		t.Errorf("additional types %v, tc %v, want only OPT without tc", types, m.TC())
+	}
+}
+
+func TestUDPSize(t *testing.T) {
+	tests := []struct {
+		opt  *RR
+		want int
+	}{
+		{nil, UDPMaxLen},
+		{NewOPT(4096), 4096},
+		{NewOPT(1232), 1232},
+		{NewOPT(100), UDPMaxLen},
+	}
+
+	for _, tt := range tests {
+		m := NewMessage(1, Query)
+		m.SetQuestion(NewQuestion(QTypeA, "www.example.com"))
+		if tt.opt != nil {
+			m.AddAdditional(&RR{NAME: "www.example.com", TYPE: QTypeA, CLASS: ClassINET, RDLENGTH: 4, RDATA: []byte{1, 2, 3, 4}})
+			m.AddAdditional(tt.opt)
+		}
+
+		b, err := m.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err = UnmarshalMessage(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (m.OPT() != nil) != (tt.opt != nil) {
+			t.Errorf("OPT() = %v, want %v", m.OPT(), tt.opt)
+		}
+		if got := m.UDPSize(); got != tt.want {
+			t.Errorf("UDPSize() with %v = %d, want %d", tt.opt, got, tt.want)
+		}
+	}
+}
+
+func TestMarshalCounts(t *testing.T) {
+	m := NewMessage(1, Response)
+	m.SetQuestion(NewQuestion(QTypeA, "www.example.com"))
+	m.AddAnswer(&RR{NAME: "www.example.com", TYPE: QTypeA, CLASS: ClassINET, TTL: 60, RDLENGTH: 4, RDATA: []byte{1, 2, 3, 4}})
+	m.Authority = append(m.Authority,
+		&RR{NAME: "example.com", TYPE: QTypeNS, CLASS: ClassINET, TTL: 60, RDLENGTH: 2, RDATA: pointer(HeaderLen + 4)},
+		&RR{NAME: "example.com", TYPE: QTypeNS, CLASS: ClassINET, TTL: 60, RDLENGTH: 2, RDATA: pointer(HeaderLen + 4)})
+	opt := NewOPT(4096)
+	opt.SetOptions([]EDNS0Option{{Code: 10, Data: []byte("cookie00")}})
+	m.AddAdditional(opt)
+
+	b, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := []uint16{binary.BigEndian.Uint16(b[4:]), binary.BigEndian.Uint16(b[6:]),
+		binary.BigEndian.Uint16(b[8:]), binary.BigEndian.Uint16(b[10:])}
+	if want := []uint16{1, 1, 2, 1}; !reflect.DeepEqual(counts, want) {
+		t.Fatalf("counts = %v, want %v", counts, want)
+	}
+
+	m, err = UnmarshalMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := m.OPT().Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []EDNS0Option{{Code: 10, Data: []byte("cookie00")}}; !reflect.DeepEqual(opts, want) {
+		t.Errorf("options = %v, want %v", opts, want)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	opt := &RR{TYPE: QTypeOPT, RDATA: []byte{0, 8, 0, 4, 0, 1, 0}}
+	if _, err := opt.Options(); err == nil {
+		t.Error("Options of truncated option data: expected error")
+	}
+}
+
+func TestNewECSOption(t *testing.T) {
+	tests := []struct {
+		cidr string
+		data []byte
+	}{
+		{"1.2.3.4/24", []byte{0, 1, 24, 0, 1, 2, 3}},
+		{"1.2.3.4/32", []byte{0, 1, 32, 0, 1, 2, 3, 4}},
+		{"1.2.3.255/25", []byte{0, 1, 25, 0, 1, 2, 3, 128}},
+		{"0.0.0.0/0", []byte{0, 1, 0, 0}},
+		{"2001:db8:1234:5678::/56", []byte{0, 2, 56, 0, 0x20, 0x01, 0x0d, 0xb8, 0x12, 0x34, 0x56}},
+	}
+
+	for _, tt := range tests {
+		ip, ipnet, err := net.ParseCIDR(tt.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipnet.IP = ip
+
+		opt := NewECSOption(ipnet)
+		if opt.Code != OptionCodeECS || !bytes.Equal(opt.Data, tt.data) {
+			t.Errorf("NewECSOption(%s) = %d %v, want %d %v", tt.cidr, opt.Code, opt.Data, OptionCodeECS, tt.data)
+		}
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	b := testMsg()
+	if err := SetTTL(b, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := UnmarshalMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rrs := range [][]*RR{m.Answers, m.Authority, m.Additional} {
+		for _, rr := range rrs {
+			if rr.TYPE != QTypeOPT && rr.TTL != 42 {
+				t.Errorf("ttl of %s type %d = %d, want 42", rr.NAME, rr.TYPE, rr.TTL)
+			}
+		}
+	}
+	if m.OPT().TTL != 0 {
+		t.Errorf("ttl of OPT = %d, want 0", m.OPT().TTL)
+	}
+}
+
+func TestCopyQName(t *testing.T) {
+	b := testMsg()
+	if err := CopyQName(b, wireMsg("WwW.ExAmPlE.CoM", 0, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := UnmarshalMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Question.QNAME != "WwW.ExAmPlE.CoM" || m.Answers[0].NAME != "WwW.ExAmPlE.CoM" {
+		t.Errorf("question %q, answer %q, want WwW.ExAmPlE.CoM", m.Question.QNAME, m.Answers[0].NAME)
+	}
+
+	if err := CopyQName(b, wireMsg("www.example.org", 0, 0, 0)); err == nil {
+		t.Error("CopyQName of another name: expected error")
+	}
+}
@@ -0,0 +1,202 @@
+package dns
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nadoo/glider/common/log"
+)
+
+// queryLogBackups is the number of rotated query log files to keep.
+const queryLogBackups = 3
+
+// queryLogQueueLen is the max number of entries waiting to be written,
+// entries will be dropped from the file (but kept in the ring buffer) when it's full.
+const queryLogQueueLen = 1024
+
+// Cache status of queries.
+const (
+	CacheHit   = "hit"
+	CacheStale = "stale"
+	CacheMiss  = "miss"
+)
+
+// QueryLogEntry is an entry of dns query log.
+type QueryLogEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	QName    string    `json:"qname"`
+	QType    uint16    `json:"qtype"`
+	Answers  []string  `json:"answers,omitempty"`
+	RCode    uint16    `json:"rcode"`
+	Cache    string    `json:"cache"`
+	Upstream string    `json:"upstream,omitempty"` // upstream server, or hosts, blocked, filtered, fakeip
+	Dialer   string    `json:"dialer,omitempty"`
+	Latency  float64   `json:"latency"` // in milliseconds
+	Error    string    `json:"error,omitempty"`
+}
+
+// QueryLog writes dns query log to file in json lines format with size based
+// rotation, and keeps the recent entries in a ring buffer.
+type QueryLog struct {
+	file    string
+	maxSize int64
+	queue   chan *QueryLogEntry
+
+	mu   sync.Mutex
+	ring []*QueryLogEntry
+	next int
+	full bool
+}
+
+// NewQueryLog returns a new query log, the file will be rotated when it's larger than
+// maxSize bytes, and at most recent entries are kept in memory.
+func NewQueryLog(file string, maxSize int64, recent int) (*QueryLog, error) {
+	l := &QueryLog{file: file, maxSize: maxSize}
+	if recent > 0 {
+		l.ring = make([]*QueryLogEntry, recent)
+	}
+
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		l.queue = make(chan *QueryLogEntry, queryLogQueueLen)
+		go l.write(f)
+	}
+
+	return l, nil
+}
+
+// Add adds an entry to the query log.
+func (l *QueryLog) Add(e *QueryLogEntry) {
+	if len(l.ring) > 0 {
+		l.mu.Lock()
+		l.ring[l.next] = e
+		l.next = (l.next + 1) % len(l.ring)
+		if l.next == 0 {
+			l.full = true
+		}
+		l.mu.Unlock()
+	}
+
+	if l.queue != nil {
+		select {
+		case l.queue <- e:
+		default:
+		}
+	}
+}
+
+// KeepsRecent reports whether the recent entries are kept in memory.
+func (l *QueryLog) KeepsRecent() bool {
+	return len(l.ring) > 0
+}
+
+// Recent returns at most n recent entries, newest first, which match the client
+// and qname (case insensitive substring match, empty matches all). n <= 0 means no limit.
+func (l *QueryLog) Recent(n int, client, qname string) []QueryLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count := l.next
+	if l.full {
+		count = len(l.ring)
+	}
+
+	qname = strings.ToLower(qname)
+
+	var entries []QueryLogEntry
+	for i := 0; i < count && (n <= 0 || len(entries) < n); i++ {
+		e := l.ring[(l.next-1-i+len(l.ring))%len(l.ring)]
+		if strings.Contains(e.Client, client) && strings.Contains(strings.ToLower(e.QName), qname) {
+			entries = append(entries, *e)
+		}
+	}
+
+	return entries
+}
+
+// write writes the queued entries to file.
+func (l *QueryLog) write(f *os.File) {
+	var size int64
+	if fi, err := f.Stat(); err == nil {
+		size = fi.Size()
+	}
+
+	for e := range l.queue {
+		b, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		b = append(b, '\n')
+
+		if l.maxSize > 0 && size > 0 && size+int64(len(b)) > l.maxSize {
+			f.Close()
+			if f, err = l.rotate(); err != nil {
+				log.F("[dns] failed to rotate query log %s: %v", l.file, err)
+				return
+			}
+			size = 0
+		}
+
+		n, err := f.Write(b)
+		if err != nil {
+			log.F("[dns] failed to write query log %s: %v", l.file, err)
+		}
+		size += int64(n)
+	}
+}
+
+// rotate renames file to file.1, file.1 to file.2 and so on, then opens a new file.
+func (l *QueryLog) rotate() (*os.File, error) {
+	for i := queryLogBackups - 1; i > 0; i-- {
+		os.Rename(l.file+"."+strconv.Itoa(i), l.file+"."+strconv.Itoa(i+1))
+	}
+
+	if err := os.Rename(l.file, l.file+".1"); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(l.file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+}
+
+// setResponse sets the rcode and the ips in answers of resp to the entry.
+func (e *QueryLogEntry) setResponse(resp *Message) {
+	e.RCode = resp.RCODE()
+	e.Answers = e.Answers[:0]
+	for _, rr := range resp.Answers {
+		if rr.TYPE == QTypeA || rr.TYPE == QTypeAAAA {
+			e.Answers = append(e.Answers, net.IP(rr.RDATA).String())
+		}
+	}
+}
+
+// logQuery completes the query log entry with the request, then adds it to the query log,
+// the response is set to the entry when it's made or parsed.
+func (c *Client) logQuery(e *QueryLogEntry, req *Message, clientAddr string, start time.Time, err error) {
+	e.Time = start
+	e.Client = clientAddr
+	e.QName = req.Question.QNAME
+	e.QType = req.Question.QTYPE
+	e.Latency = float64(time.Since(start).Microseconds()) / 1000
+
+	if err != nil {
+		e.RCode = RCodeServerFail
+		e.Error = err.Error()
+	}
+
+	c.queryLog.Add(e)
+}
+
+// QueryLog returns the query log, nil if it's not enabled.
+func (c *Client) QueryLog() *QueryLog {
+	return c.queryLog
+}
@@ -60,7 +60,7 @@ func (s *Server) ListenAndServeUDP(wg *sync.WaitGroup) {
 	log.F("[dns] listening UDP on %s", s.addr)
 
 	for {
-		reqBytes := pool.GetBuffer(UDPMaxLen)
+		reqBytes := pool.GetBuffer(MsgMaxLen)
 
 		n, caddr, err := pc.ReadFrom(reqBytes[2:])
 		if err != nil {
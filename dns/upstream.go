@@ -1,16 +1,23 @@
 package dns
 
-import "sync/atomic"
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
 
 // UPStream is a dns upstream.
 type UPStream struct {
 	index   uint32
 	servers []string
+	rtts    []int64 // smoothed rtt of servers, in nanoseconds
+	race    int
 }
 
 // NewUPStream returns a new UpStream.
-func NewUPStream(servers []string) *UPStream {
-	return &UPStream{servers: servers}
+// race is the number of fastest servers to query at once, 0 means query servers one by one.
+func NewUPStream(servers []string, race int) *UPStream {
+	return &UPStream{servers: servers, rtts: make([]int64, len(servers)), race: race}
 }
 
 // Server returns a dns server.
@@ -35,3 +42,59 @@ func (u *UPStream) SwitchIf(server string) string {
 func (u *UPStream) Len() int {
 	return len(u.servers)
 }
+
+// Race returns the number of servers to query at once, 0 means racing is disabled.
+func (u *UPStream) Race() int {
+	if u.race > len(u.servers) {
+		return len(u.servers)
+	}
+	return u.race
+}
+
+// Record records the rtt of server, the smoothed rtt is calculated like tcp: srtt = 7/8*srtt + 1/8*rtt.
+func (u *UPStream) Record(server string, rtt time.Duration) {
+	for i, s := range u.servers {
+		if s == server {
+			old := atomic.LoadInt64(&u.rtts[i])
+			if old == 0 {
+				atomic.StoreInt64(&u.rtts[i], int64(rtt))
+			} else {
+				atomic.StoreInt64(&u.rtts[i], old-old/8+int64(rtt)/8)
+			}
+			return
+		}
+	}
+}
+
+// RTT returns the smoothed rtt of server, 0 if unknown.
+func (u *UPStream) RTT(server string) time.Duration {
+	for i, s := range u.servers {
+		if s == server {
+			return time.Duration(atomic.LoadInt64(&u.rtts[i]))
+		}
+	}
+	return 0
+}
+
+// Fastest returns the n fastest servers, servers never used are considered fastest.
+func (u *UPStream) Fastest(n int) []string {
+	idx := make([]int, len(u.servers))
+	rtts := make([]int64, len(u.servers))
+	for i := range idx {
+		idx[i] = i
+		rtts[i] = atomic.LoadInt64(&u.rtts[i])
+	}
+
+	sort.SliceStable(idx, func(i, j int) bool { return rtts[idx[i]] < rtts[idx[j]] })
+
+	if n > len(idx) {
+		n = len(idx)
+	}
+
+	servers := make([]string, n)
+	for i := range servers {
+		servers[i] = u.servers[idx[i]]
+	}
+
+	return servers
+}
@@ -0,0 +1,171 @@
+package dns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nadoo/glider/proxy"
+)
+
+// testServer is a udp dns server answers A queries with ip after delay, no answer if ip is nil.
+// The OPT rr of query is echoed back in the response.
+type testServer struct {
+	pc    net.PacketConn
+	ip    net.IP
+	rcode uint16
+	delay time.Duration
+}
+
+func newTestServer(t *testing.T, ip net.IP, rcode uint16, delay time.Duration) *testServer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{pc: pc, ip: ip.To4(), rcode: rcode, delay: delay}
+	go s.serve()
+	return s
+}
+
+func (s *testServer) Addr() string { return s.pc.LocalAddr().String() }
+
+func (s *testServer) Close() { s.pc.Close() }
+
+func (s *testServer) serve() {
+	b := make([]byte, MsgMaxLen)
+	for {
+		n, addr, err := s.pc.ReadFrom(b)
+		if err != nil {
+			return
+		}
+
+		req, err := UnmarshalMessage(b[:n])
+		if err != nil || s.ip == nil {
+			continue
+		}
+
+		m := NewMessage(req.ID, Response)
+		m.setFlag(1, 0, 0, 0, 1, 1, s.rcode)
+		m.SetQuestion(req.Question)
+		if s.rcode == RCodeSuccess {
+			m.AddAnswer(&RR{NAME: req.Question.QNAME, TYPE: QTypeA, CLASS: ClassINET, TTL: 60, RDLENGTH: 4, RDATA: s.ip})
+		}
+		if opt := req.OPT(); opt != nil {
+			m.AddAdditional(opt)
+		}
+
+		resp, _ := m.Marshal()
+		go func() {
+			time.Sleep(s.delay)
+			s.pc.WriteTo(resp, addr)
+		}()
+	}
+}
+
+func testRequest(t *testing.T, qname string) []byte {
+	req := NewMessage(0, Query)
+	req.setFlag(0, 0, 0, 0, 1, 0, 0)
+	req.SetQuestion(NewQuestion(QTypeA, qname))
+	b, err := marshalWithLen(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func answerIP(t *testing.T, respBytes []byte) (string, uint16) {
+	t.Helper()
+	m, err := UnmarshalMessage(respBytes[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answers) == 0 {
+		return "", m.RCODE()
+	}
+	return m.Answers[0].IP, m.RCODE()
+}
+
+func TestUPStream(t *testing.T) {
+	ups := NewUPStream([]string{"a", "b", "c", "d"}, 8)
+	if ups.Race() != 4 {
+		t.Errorf("race = %d, want 4", ups.Race())
+	}
+
+	ups.Record("a", 80*time.Millisecond)
+	ups.Record("a", 160*time.Millisecond)
+	if rtt := ups.RTT("a"); rtt != 90*time.Millisecond {
+		t.Errorf("smoothed rtt = %s, want 90ms", rtt)
+	}
+	ups.Record("b", 10*time.Millisecond)
+	ups.Record("d", failedRTT)
+
+	// servers never used are considered fastest
+	if got, want := ups.Fastest(3), []string{"c", "b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fastest = %v, want %v", got, want)
+	}
+	if got := ups.Fastest(10); len(got) != 4 || got[3] != "d" {
+		t.Errorf("fastest = %v, want d the last", got)
+	}
+
+	if s := ups.SwitchIf("x"); s != "a" {
+		t.Errorf("switch if not current server = %s, want a", s)
+	}
+	if s := ups.SwitchIf("a"); s != "b" {
+		t.Errorf("switch if current server = %s, want b", s)
+	}
+}
+
+func TestExchangeRace(t *testing.T) {
+	fail := newTestServer(t, net.IPv4(1, 1, 1, 1), RCodeServerFail, 0)
+	defer fail.Close()
+	slow := newTestServer(t, net.IPv4(2, 2, 2, 2), RCodeSuccess, 100*time.Millisecond)
+	defer slow.Close()
+	fast := newTestServer(t, net.IPv4(3, 3, 3, 3), RCodeSuccess, 10*time.Millisecond)
+	defer fast.Close()
+	silent := newTestServer(t, nil, 0, 0)
+	defer silent.Close()
+
+	c := &Client{config: &Config{Timeout: 1}}
+
+	tests := []struct {
+		name    string
+		servers []*testServer
+		want    string
+		rcode   uint16
+	}{
+		{"fastest valid answer", []*testServer{fail, slow, fast, silent}, "3.3.3.3", RCodeSuccess},
+		{"skip servfail", []*testServer{fail, slow}, "2.2.2.2", RCodeSuccess},
+		{"all failed", []*testServer{fail}, "", RCodeServerFail},
+	}
+
+	for _, tt := range tests {
+		var addrs []string
+		for _, s := range tt.servers {
+			addrs = append(addrs, s.Addr())
+		}
+		ups := NewUPStream(addrs, len(addrs))
+
+		server, _, respBytes, err := c.exchangeRace(ups, proxy.Default, "udp", testRequest(t, "www.example.com"))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if ip, rcode := answerIP(t, respBytes); ip != tt.want || rcode != tt.rcode {
+			t.Errorf("%s: answer %q from %s, rcode %d, want %q, rcode %d", tt.name, ip, server, rcode, tt.want, tt.rcode)
+		}
+		if ups.RTT(server) == 0 {
+			t.Errorf("%s: rtt of %s is not recorded", tt.name, server)
+		}
+	}
+
+	// all servers time out
+	ups := NewUPStream([]string{silent.Addr()}, 2)
+	if _, _, _, err := c.exchangeRace(ups, proxy.Default, "udp", testRequest(t, "www.example.com")); err == nil {
+		t.Error("no answer: expected error")
+	}
+	if rtt := ups.RTT(silent.Addr()); rtt < failedRTT {
+		t.Errorf("rtt of timed out server = %s, want at least %s", rtt, failedRTT)
+	}
+}
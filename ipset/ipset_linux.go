@@ -9,8 +9,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"net"
-	"strings"
-	"sync"
 	"sync/atomic"
 	"syscall"
 	"unsafe"
@@ -74,11 +72,11 @@ type Manager struct {
 	fd  int
 	lsa syscall.SockaddrNetlink
 
-	domainSet sync.Map
+	domainSet *rule.DomainMatcher // domain: set name
 }
 
-// NewManager returns a Manager
-func NewManager(rules []*rule.Config) (*Manager, error) {
+// NewManager returns a Manager, geoip is used to add the cidrs of countries in rules, can be nil.
+func NewManager(rules []*rule.Config, geoip *rule.GeoIP) (*Manager, error) {
 	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_NETFILTER)
 	if err != nil {
 		log.F("%s", err)
@@ -96,7 +94,7 @@ func NewManager(rules []*rule.Config) (*Manager, error) {
 		return nil, err
 	}
 
-	m := &Manager{fd: fd, lsa: lsa}
+	m := &Manager{fd: fd, lsa: lsa, domainSet: rule.NewDomainMatcher()}
 
 	// create ipset, avoid redundant.
 	sets := make(map[string]struct{})
@@ -114,7 +112,7 @@ func NewManager(rules []*rule.Config) (*Manager, error) {
 	for _, r := range rules {
 		if r.IPSet != "" {
 			for _, domain := range r.Domain {
-				m.domainSet.Store(domain, r.IPSet)
+				m.domainSet.Add(domain, r.IPSet)
 			}
 			for _, ip := range r.IP {
 				AddToSet(fd, lsa, r.IPSet, ip)
@@ -122,23 +120,28 @@ func NewManager(rules []*rule.Config) (*Manager, error) {
 			for _, cidr := range r.CIDR {
 				AddToSet(fd, lsa, r.IPSet, cidr)
 			}
+			for _, country := range r.GeoIP {
+				if geoip == nil {
+					continue
+				}
+				for _, cidr := range geoip.CIDRs(country) {
+					AddToSet(fd, lsa, r.IPSet, cidr.String())
+				}
+			}
 		}
 	}
 
 	return m, nil
 }
 
-// AddDomainIP implements the DNSAnswerHandler function, used to update ipset according to domainSet rule
-func (m *Manager) AddDomainIP(domain, ip string) error {
+// AddDomainIP implements the DNSAnswerHandler function, used to update ipset according to domainSet rule,
+// the ip will be kept in ipset regardless of ttl.
+func (m *Manager) AddDomainIP(domain, ip string, ttl int) error {
 	if domain == "" || ip == "" {
 		return errors.New("please specify the domain and ip address")
 	}
-	domain = strings.ToLower(domain)
-	for i := len(domain); i != -1; {
-		i = strings.LastIndexByte(domain[:i], '.')
-		if ipset, ok := m.domainSet.Load(domain[i+1:]); ok {
-			AddToSet(m.fd, m.lsa, ipset.(string), ip)
-		}
+	if ipset, _, _ := m.domainSet.Match(domain); ipset != nil {
+		AddToSet(m.fd, m.lsa, ipset.(string), ip)
 	}
 	return nil
 }
@@ -12,11 +12,11 @@ import (
 type Manager struct{}
 
 // NewManager returns a Manager
-func NewManager(rules []*rule.Config) (*Manager, error) {
+func NewManager(rules []*rule.Config, geoip *rule.GeoIP) (*Manager, error) {
 	return nil, errors.New("ipset not supported on this os")
 }
 
 // AddDomainIP implements the DNSAnswerHandler function
-func (m *Manager) AddDomainIP(domain, ip string) error {
+func (m *Manager) AddDomainIP(domain, ip string, ttl int) error {
 	return errors.New("ipset not supported on this os")
 }
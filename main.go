@@ -1,11 +1,18 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	stdlog "log"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/nadoo/glider/common/log"
 	"github.com/nadoo/glider/dns"
@@ -47,24 +54,67 @@ func main() {
 		}
 	}
 
+	// geoip database
+	var geoip *rule.GeoIP
+	if conf.GeoIPFile != "" {
+		var err error
+		if geoip, err = rule.NewGeoIP(conf.GeoIPFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// global forwarders
+	fwdrs := strategy.NewProxy(rule.GroupDefault, conf.Forward, &conf.StrategyConfig)
+	for _, s := range conf.Subscription {
+		if err := fwdrs.Subscribe(s, flag.ConfDir()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// global rule proxy
-	p := rule.NewProxy(conf.rules, strategy.NewProxy("default", conf.Forward, &conf.StrategyConfig))
+	p := rule.NewProxy(conf.rules, fwdrs, geoip)
+	if len(conf.orderedRules) > 0 {
+		if err := p.SetOrderedRules(conf.orderedRules, &conf.StrategyConfig); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// explain mode
+	if conf.Explain != "" {
+		explain(p, conf.Explain)
+		return
+	}
 
 	// ipset manager
-	ipsetM, _ := ipset.NewManager(conf.rules)
+	ipsetM, _ := ipset.NewManager(conf.rules, geoip)
+
+	// the proxy used by local listeners
+	var pxy proxy.Proxy = p
+
+	// dns server
+	var d *dns.Server
+	var err error
 
 	// check and setup dns server
 	if conf.DNS != "" {
-		d, err := dns.NewServer(conf.DNS, p, &conf.DNSConfig)
+		d, err = dns.NewServer(conf.DNS, p, &conf.DNSConfig)
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		// rule
 		for _, r := range conf.rules {
+			if len(r.DNSServers) > 0 {
+				d.SetServers(r.Domain, r.DNSServers, r.DNSRace)
+			}
 			for _, domain := range r.Domain {
-				if len(r.DNSServers) > 0 {
-					d.SetServers(domain, r.DNSServers)
+				if r.DNSIPFamily != "" {
+					d.SetIPFamily(domain, r.DNSIPFamily)
+				}
+				if r.DNSECS != "" {
+					if err := d.SetECS(domain, r.DNSECS); err != nil {
+						log.Fatal(err)
+					}
 				}
 			}
 		}
@@ -75,15 +125,30 @@ func main() {
 			d.AddHandler(ipsetM.AddDomainIP)
 		}
 
+		// fake ip mode, translate fake ips to domains before dialing
+		if f := d.FakeIP(); f != nil {
+			pxy = f.Proxy(p)
+		}
+
 		d.Start()
 	}
 
 	// enable checkers
 	p.Check()
 
+	// update rule providers
+	p.StartProviders()
+
+	// http api
+	if conf.API != "" {
+		if err := serveAPI(conf.API, &api{proxy: p, dns: d}); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Proxy Servers
 	for _, listen := range conf.Listen {
-		local, err := proxy.ServerFromURL(listen, p)
+		local, err := proxy.ServerFromURL(listen, pxy)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -94,4 +159,86 @@ func main() {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	<-sigCh
+
+	if d != nil {
+		if err := d.SaveCache(); err != nil {
+			stdlog.Printf("[dns] failed to save cache: %v", err)
+		}
+	}
+}
+
+// explain prints how the connection to target is routed by rules, it queries the running
+// instance by the api if it's set, so the ips learned from dns answers are also used.
+func explain(p *rule.Proxy, target string) {
+	network, addr := parseTarget(target)
+	sess, err := explainSession(network, conf.ExplainSrc, conf.ExplainInbound)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		os.Exit(-1)
+	}
+
+	e, err := explainByAPI(conf.API, target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s, explain by the config only.\n", err)
+	}
+
+	learned := e != nil
+	if e == nil {
+		e = p.Explain(network, addr, sess)
+	}
+
+	fmt.Printf("destination: %s://%s\n", network, addr)
+	if conf.ExplainSrc != "" {
+		fmt.Printf("source: %s\n", conf.ExplainSrc)
+	}
+	if conf.ExplainInbound != "" {
+		fmt.Printf("inbound: %s\n", conf.ExplainInbound)
+	}
+	if e.Type == rule.MatchDefault {
+		fmt.Printf("rule: no rule matched\n")
+	} else {
+		fmt.Printf("rule: %s\n", e.Rule)
+		if e.Value != "" {
+			fmt.Printf("matcher: %s=%s\n", e.Type, e.Value)
+		} else {
+			fmt.Printf("matcher: %s\n", e.Type)
+		}
+	}
+	// the ips learned from dns answers are only known by the running instance
+	if learned {
+		if e.DomainIP {
+			fmt.Printf("dns learned: yes, the ip is resolved from %s\n", e.Domain)
+		} else {
+			fmt.Printf("dns learned: no\n")
+		}
+	}
+	fmt.Printf("strategy: %s\n", e.Strategy)
+	fmt.Printf("forwarder: %s\n", e.Forwarder)
+}
+
+// explainByAPI queries the explanation from the running instance, nil if the api is not set.
+func explainByAPI(api, target string) (*rule.Explanation, error) {
+	if api == "" {
+		return nil, nil
+	}
+
+	q := url.Values{"target": {target}, "src": {conf.ExplainSrc}, "inbound": {conf.ExplainInbound}}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + api + "/explain?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New("api: " + strings.TrimSpace(string(msg)))
+	}
+
+	e := &rule.Explanation{}
+	if err := json.NewDecoder(resp.Body).Decode(e); err != nil {
+		return nil, err
+	}
+
+	return e, nil
 }
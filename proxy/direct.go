@@ -1,17 +1,40 @@
 package proxy
 
 import (
+	"context"
 	"errors"
 	"net"
+	"sort"
 	"time"
 
 	"github.com/nadoo/glider/common/log"
 )
 
+// IP families of domain targets.
+const (
+	IPv4Only   = "ipv4"
+	IPv6Only   = "ipv6"
+	PreferIPv4 = "preferipv4"
+	PreferIPv6 = "preferipv6"
+)
+
+// fallbackDelay is the time to wait before dialing the ips of the other family in prefer mode.
+const fallbackDelay = 300 * time.Millisecond
+
+// ValidIPFamily reports whether family is a valid ip family, empty means the system default.
+func ValidIPFamily(family string) bool {
+	switch family {
+	case "", IPv4Only, IPv6Only, PreferIPv4, PreferIPv6:
+		return true
+	}
+	return false
+}
+
 // Direct proxy
 type Direct struct {
 	iface        *net.Interface // interface specified by user
 	ip           net.IP
+	family       string // ip family of domain targets
 	dialTimeout  time.Duration
 	relayTimeout time.Duration
 }
@@ -19,9 +42,13 @@ type Direct struct {
 // Default dialer
 var Default = &Direct{dialTimeout: time.Second * 3}
 
-// NewDirect returns a Direct dialer.
-func NewDirect(intface string, dialTimeout, relayTimeout time.Duration) (*Direct, error) {
-	d := &Direct{dialTimeout: dialTimeout, relayTimeout: relayTimeout}
+// NewDirect returns a Direct dialer, family is the ip family used to connect to domain targets.
+func NewDirect(intface, family string, dialTimeout, relayTimeout time.Duration) (*Direct, error) {
+	if !ValidIPFamily(family) {
+		return nil, errors.New("invalid ip family: " + family)
+	}
+
+	d := &Direct{family: family, dialTimeout: dialTimeout, relayTimeout: relayTimeout}
 
 	if intface != "" {
 		if ip := net.ParseIP(intface); ip != nil {
@@ -80,7 +107,7 @@ func (d *Direct) dial(network, addr string, localIP net.IP) (net.Conn, error) {
 	}
 
 	dialer := &net.Dialer{LocalAddr: la, Timeout: d.dialTimeout}
-	c, err := dialer.Dial(network, addr)
+	c, err := d.dialFamily(dialer, network, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -96,6 +123,182 @@ func (d *Direct) dial(network, addr string, localIP net.IP) (net.Conn, error) {
 	return c, err
 }
 
+// dialFamily dials addr according to the ip family when the host of addr is a domain.
+func (d *Direct) dialFamily(dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || d.family == "" || net.ParseIP(host) != nil {
+		return dialer.Dial(network, addr)
+	}
+
+	switch d.family {
+	case IPv4Only:
+		return dialer.Dial(network+"4", addr)
+	case IPv6Only:
+		return dialer.Dial(network+"6", addr)
+	}
+
+	// the lookup and all the dials share one deadline
+	ctx, cancel := d.context()
+	defer cancel()
+
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var primaries, fallbacks []net.IP
+	for _, ip := range ips {
+		if d.preferred(ip) {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+
+	return dialParallel(ctx, dialer, network, port, primaries, fallbacks)
+}
+
+// dialResult is the result of dialing ips of a family.
+type dialResult struct {
+	c   net.Conn
+	err error
+}
+
+// dialParallel dials the primary ips, and races the fallback ips with them if they don't
+// succeed in fallbackDelay, the first established conn is returned.
+// https://tools.ietf.org/html/rfc8305
+func dialParallel(ctx context.Context, dialer *net.Dialer, network, port string, primaries, fallbacks []net.IP) (net.Conn, error) {
+	if len(fallbacks) == 0 {
+		return dialSerial(ctx, dialer, network, port, primaries)
+	}
+	if len(primaries) == 0 {
+		return dialSerial(ctx, dialer, network, port, fallbacks)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, 2)
+	dial := func(ips []net.IP) {
+		c, err := dialSerial(ctx, dialer, network, port, ips)
+		results <- dialResult{c, err}
+	}
+
+	go dial(primaries)
+	pending, fallback := 1, false
+
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if pending > 0 {
+					// the other dial is canceled, close its conn if it's established anyway
+					go func() {
+						if r := <-results; r.c != nil {
+							r.c.Close()
+						}
+					}()
+				}
+				return r.c, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+		}
+
+		if !fallback {
+			fallback = true
+			pending++
+			go dial(fallbacks)
+		}
+
+		if pending == 0 {
+			return nil, firstErr
+		}
+	}
+}
+
+// dialSerial dials ips one by one until one of them succeeds.
+func dialSerial(ctx context.Context, dialer *net.Dialer, network, port string, ips []net.IP) (net.Conn, error) {
+	err := errors.New("no ip address to dial")
+	for _, ip := range ips {
+		var c net.Conn
+		c, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return c, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// context returns a context with the deadline of dial timeout.
+func (d *Direct) context() (context.Context, context.CancelFunc) {
+	if d.dialTimeout > 0 {
+		return context.WithTimeout(context.Background(), d.dialTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// preferred reports whether ip is of the preferred family.
+func (d *Direct) preferred(ip net.IP) bool {
+	return (ip.To4() != nil) == (d.family == PreferIPv4)
+}
+
+// lookup resolves host, the ips of preferred family are placed first.
+func (d *Direct) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+
+	sort.SliceStable(ips, func(i, j int) bool { return d.preferred(ips[i]) && !d.preferred(ips[j]) })
+
+	return ips, nil
+}
+
+// resolveUDPAddr resolves the udp addr according to the ip family.
+func (d *Direct) resolveUDPAddr(addr string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || d.family == "" || net.ParseIP(host) != nil {
+		return net.ResolveUDPAddr("udp", addr)
+	}
+
+	switch d.family {
+	case IPv4Only:
+		return net.ResolveUDPAddr("udp4", addr)
+	case IPv6Only:
+		return net.ResolveUDPAddr("udp6", addr)
+	}
+
+	ctx, cancel := d.context()
+	defer cancel()
+
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ips) == 0 {
+		return nil, errors.New("no ip address found for " + host)
+	}
+
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(ips[0].String(), port))
+}
+
 // DialUDP connects to the given address.
 func (d *Direct) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
 	// TODO: support specifying local interface
@@ -110,7 +313,7 @@ func (d *Direct) DialUDP(network, addr string) (net.PacketConn, net.Addr, error)
 		return nil, nil, err
 	}
 
-	uAddr, err := net.ResolveUDPAddr("udp", addr)
+	uAddr, err := d.resolveUDPAddr(addr)
 	return pc, uAddr, err
 }
 
@@ -90,7 +90,7 @@ func (s *HTTP) servRequest(req *request, c *conn.Conn) {
 }
 
 func (s *HTTP) servHTTPS(r *request, c net.Conn) {
-	rc, dialer, err := s.proxy.Dial("tcp", r.uri)
+	rc, dialer, err := s.proxy.Dial("tcp", r.uri, proxy.NewSession(c.RemoteAddr(), c.LocalAddr()))
 	if err != nil {
 		io.WriteString(c, r.proto+" 502 ERROR\r\n\r\n")
 		log.F("[http] %s <-> %s [c] via %s, error in dial: %v", c.RemoteAddr(), r.uri, dialer.Addr(), err)
@@ -109,7 +109,7 @@ func (s *HTTP) servHTTPS(r *request, c net.Conn) {
 }
 
 func (s *HTTP) servHTTP(req *request, c *conn.Conn) {
-	rc, dialer, err := s.proxy.Dial("tcp", req.target)
+	rc, dialer, err := s.proxy.Dial("tcp", req.target, proxy.NewSession(c.RemoteAddr(), c.LocalAddr()))
 	if err != nil {
 		fmt.Fprintf(c, "%s 502 ERROR\r\n\r\n", req.proto)
 		log.F("[http] %s <-> %s via %s, error in dial: %v", c.RemoteAddr(), req.target, dialer.Addr(), err)
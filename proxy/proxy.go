@@ -4,14 +4,14 @@ import "net"
 
 // Proxy is a dialer manager
 type Proxy interface {
-	// Dial connects to the given address via the proxy.
-	Dial(network, addr string) (c net.Conn, dialer Dialer, err error)
+	// Dial connects to the given address via the proxy, sess can be nil if it's not from a server.
+	Dial(network, addr string, sess *Session) (c net.Conn, dialer Dialer, err error)
 
-	// DialUDP connects to the given address via the proxy.
-	DialUDP(network, addr string) (pc net.PacketConn, writeTo net.Addr, err error)
+	// DialUDP connects to the given address via the proxy, sess can be nil if it's not from a server.
+	DialUDP(network, addr string, sess *Session) (pc net.PacketConn, writeTo net.Addr, err error)
 
-	// Get the dialer by dstAddr.
-	NextDialer(dstAddr string) Dialer
+	// Get the dialer by dstAddr, sess can be nil if it's not from a server.
+	NextDialer(dstAddr string, sess *Session) Dialer
 
 	// Record records result while using the dialer from proxy.
 	Record(dialer Dialer, success bool)
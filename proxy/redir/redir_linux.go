@@ -104,7 +104,7 @@ func (s *RedirProxy) Serve(c net.Conn) {
 		return
 	}
 
-	rc, dialer, err := s.proxy.Dial("tcp", tgt.String())
+	rc, dialer, err := s.proxy.Dial("tcp", tgt.String(), proxy.NewSession(c.RemoteAddr(), c.LocalAddr()))
 	if err != nil {
 		log.F("[redir] %s <-> %s via %s, error in dial: %v", c.RemoteAddr(), tgt, dialer.Addr(), err)
 		return
@@ -31,12 +31,22 @@ func RegisterServer(name string, c ServerCreator) {
 }
 
 // ServerFromURL calls the registered creator to create proxy servers
-// dialer is the default upstream dialer so cannot be nil, we can use Default when calling this function
+// dialer is the default upstream dialer so cannot be nil, we can use Default when calling this function.
+// the listener name used in sessions is the url fragment(SCHEME://ADDR#NAME), or SCHEME://ADDR without
+// userinfo and options if there's no fragment.
 func ServerFromURL(s string, p Proxy) (Server, error) {
 	if p == nil {
 		return nil, errors.New("ServerFromURL: dialer cannot be nil")
 	}
 
+	// servers in transport chains(tls, kcp, unix) share the name of the outer one
+	_, inner := p.(*inboundProxy)
+
+	name := ""
+	if i := strings.LastIndexByte(s, '#'); i != -1 && !inner {
+		name, s = s[i+1:], s[:i]
+	}
+
 	if !strings.Contains(s, "://") {
 		s = "mixed://" + s
 	}
@@ -47,6 +57,13 @@ func ServerFromURL(s string, p Proxy) (Server, error) {
 		return nil, err
 	}
 
+	if !inner {
+		if name == "" {
+			name = listenerName(u)
+		}
+		p = &inboundProxy{Proxy: p, name: name}
+	}
+
 	c, ok := serverMap[strings.ToLower(u.Scheme)]
 	if ok {
 		return c(s, p)
@@ -54,3 +71,15 @@ func ServerFromURL(s string, p Proxy) (Server, error) {
 
 	return nil, errors.New("unknown scheme '" + u.Scheme + "'")
 }
+
+// listenerName returns the default name of listener u: SCHEME://HOST:PORT, or SCHEME://PATH of unix sockets.
+func listenerName(u *url.URL) string {
+	if u.Host == "" {
+		path := u.Path
+		if i := strings.IndexByte(path, ','); i != -1 {
+			path = path[:i] // the rest of transport chain
+		}
+		return u.Scheme + "://" + path
+	}
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import "net"
+
+// Session is the inbound information of a connection.
+type Session struct {
+	Inbound string   // name of the listener, set by the proxy passed to the server
+	Src     net.Addr // client address
+	Local   net.Addr // server address the client connected to, may be unspecified for udp servers
+}
+
+// NewSession returns a new session of client address src and server address local.
+func NewSession(src, local net.Addr) *Session {
+	return &Session{Src: src, Local: local}
+}
+
+// inboundProxy sets the listener name to sessions before calling Proxy.
+type inboundProxy struct {
+	Proxy
+	name string
+}
+
+// Dial connects to the given address via the proxy.
+func (p *inboundProxy) Dial(network, addr string, sess *Session) (net.Conn, Dialer, error) {
+	return p.Proxy.Dial(network, addr, p.session(sess))
+}
+
+// DialUDP connects to the given address via the proxy.
+func (p *inboundProxy) DialUDP(network, addr string, sess *Session) (net.PacketConn, net.Addr, error) {
+	return p.Proxy.DialUDP(network, addr, p.session(sess))
+}
+
+// NextDialer returns the dialer by dstAddr.
+func (p *inboundProxy) NextDialer(dstAddr string, sess *Session) Dialer {
+	return p.Proxy.NextDialer(dstAddr, p.session(sess))
+}
+
+func (p *inboundProxy) session(sess *Session) *Session {
+	if sess == nil {
+		sess = &Session{}
+	}
+	sess.Inbound = p.name
+	return sess
+}
@@ -132,7 +132,7 @@ func (s *Socks5) Serve(c net.Conn) {
 		return
 	}
 
-	rc, dialer, err := s.proxy.Dial("tcp", tgt.String())
+	rc, dialer, err := s.proxy.Dial("tcp", tgt.String(), proxy.NewSession(c.RemoteAddr(), c.LocalAddr()))
 	if err != nil {
 		log.F("[socks5] %s <-> %s via %s, error in dial: %v", c.RemoteAddr(), tgt, dialer.Addr(), err)
 		return
@@ -178,7 +178,7 @@ func (s *Socks5) ListenAndServeUDP() {
 				continue
 			}
 
-			lpc, nextHop, err := s.proxy.DialUDP("udp", c.tgtAddr.String())
+			lpc, nextHop, err := s.proxy.DialUDP("udp", c.tgtAddr.String(), proxy.NewSession(raddr, lc.LocalAddr()))
 			if err != nil {
 				log.F("[socks5-udp] remote dial error: %v", err)
 				continue
@@ -45,7 +45,8 @@ func NewSS(s string, d proxy.Dialer, p proxy.Proxy) (*SS, error) {
 
 	ciph, err := core.PickCipher(method, nil, pass)
 	if err != nil {
-		log.Fatalf("[ss] PickCipher for '%s', error: %s", method, err)
+		log.F("[ss] PickCipher for '%s', error: %s", method, err)
+		return nil, err
 	}
 
 	ss := &SS{
@@ -111,7 +112,7 @@ func (s *SS) Serve(c net.Conn) {
 		return
 	}
 
-	dialer := s.proxy.NextDialer(tgt.String())
+	dialer := s.proxy.NextDialer(tgt.String(), proxy.NewSession(c.RemoteAddr(), c.LocalAddr()))
 
 	// udp over tcp?
 	uot := socks.UoT(tgt[0])
@@ -194,7 +195,7 @@ func (s *SS) ListenAndServeUDP() {
 		var pc *PktConn
 		v, ok := nm.Load(raddr.String())
 		if !ok && v == nil {
-			lpc, nextHop, err := s.proxy.DialUDP("udp", c.tgtAddr.String())
+			lpc, nextHop, err := s.proxy.DialUDP("udp", c.tgtAddr.String(), proxy.NewSession(raddr, lc.LocalAddr()))
 			if err != nil {
 				log.F("[ss-udp] remote dial error: %v", err)
 				continue
@@ -80,7 +80,7 @@ func (s *TCPTun) Serve(c net.Conn) {
 		c.SetKeepAlive(true)
 	}
 
-	rc, dialer, err := s.proxy.Dial("tcp", s.raddr)
+	rc, dialer, err := s.proxy.Dial("tcp", s.raddr, proxy.NewSession(c.RemoteAddr(), c.LocalAddr()))
 	if err != nil {
 		log.F("[tcptun] %s <-> %s via %s, error in dial: %v", c.RemoteAddr(), s.addr, dialer.Addr(), err)
 		s.proxy.Record(dialer, false)
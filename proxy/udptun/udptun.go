@@ -79,7 +79,7 @@ func (s *UDPTun) ListenAndServe() {
 
 		v, ok := nm.Load(raddr.String())
 		if !ok && v == nil {
-			pc, _, err = s.proxy.DialUDP("udp", s.taddr)
+			pc, _, err = s.proxy.DialUDP("udp", s.taddr, proxy.NewSession(raddr, c.LocalAddr()))
 			if err != nil {
 				log.F("[udptun] remote dial error: %v", err)
 				continue
@@ -73,7 +73,7 @@ func (s *UoTTun) ListenAndServe() {
 			continue
 		}
 
-		rc, p, err := s.proxy.Dial("uot", s.raddr)
+		rc, p, err := s.proxy.Dial("uot", s.raddr, proxy.NewSession(clientAddr, c.LocalAddr()))
 		if err != nil {
 			log.F("[uottun] failed to connect to server %v: %v", s.raddr, err)
 			continue
@@ -81,9 +81,9 @@ func (s *UoTTun) ListenAndServe() {
 
 		go func() {
 			// no remote forwarder, just a local udp forwarder
-			if urc, ok := rc.(*net.UDPConn); ok {
+			if urc, ok := unwrap(rc).(*net.UDPConn); ok {
 				conn.RelayUDP(c, clientAddr, urc, 2*time.Minute)
-				urc.Close()
+				rc.Close()
 				return
 			}
 
@@ -113,3 +113,14 @@ func (s *UoTTun) Serve(c net.Conn) {
 	// TODO
 	log.F("[uottun] func Serve: can not be called directly")
 }
+
+// unwrap returns the innermost conn of c, conns dialed by forwarders are wrapped.
+func unwrap(c net.Conn) net.Conn {
+	for {
+		u, ok := c.(interface{ Unwrap() net.Conn })
+		if !ok {
+			return c
+		}
+		c = u.Unwrap()
+	}
+}
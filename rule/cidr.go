@@ -0,0 +1,147 @@
+package rule
+
+import (
+	"math/bits"
+	"net"
+)
+
+// cidrNode is a node of the path compressed binary trie.
+type cidrNode struct {
+	prefix net.IP // masked to plen bits
+	plen   int
+	cidr   *net.IPNet  // nil for branch nodes
+	value  interface{} // nil for branch nodes
+	child  [2]*cidrNode
+}
+
+// cidrTree is a path compressed binary trie (radix tree) of cidrs for longest prefix match,
+// ipv4 and ipv6 cidrs are stored in different tries. It's not safe to insert concurrently,
+// build it before lookups.
+type cidrTree struct {
+	v4, v6 *cidrNode
+	size   int
+}
+
+// Insert inserts cidr with value, the value of a cidr inserted before will be replaced.
+func (t *cidrTree) Insert(cidr *net.IPNet, value interface{}) {
+	ip, root := cidr.IP.To4(), &t.v4
+	if ip == nil {
+		ip, root = cidr.IP.To16(), &t.v6
+	}
+	plen, _ := cidr.Mask.Size()
+	if len(ip) == net.IPv4len && len(cidr.Mask) == net.IPv6len {
+		// ipv4-mapped ipv6 cidr
+		if plen -= 96; plen < 0 {
+			plen = 0
+		}
+	}
+
+	leaf := &cidrNode{prefix: ip.Mask(net.CIDRMask(plen, len(ip)*8)), plen: plen, cidr: cidr, value: value}
+
+	n := root
+	for {
+		cur := *n
+		if cur == nil {
+			*n = leaf
+			t.size++
+			return
+		}
+
+		maxLen := cur.plen
+		if plen < maxLen {
+			maxLen = plen
+		}
+
+		common := commonPrefixLen(cur.prefix, leaf.prefix, maxLen)
+		switch {
+		case common == cur.plen && plen == cur.plen:
+			// same cidr
+			if cur.value == nil {
+				t.size++
+			}
+			cur.cidr, cur.value = cidr, value
+			return
+
+		case common == cur.plen:
+			// cur contains the new cidr, go down
+			n = &cur.child[bit(leaf.prefix, cur.plen)]
+
+		case common == plen:
+			// the new cidr contains cur
+			leaf.child[bit(cur.prefix, plen)] = cur
+			*n = leaf
+			t.size++
+			return
+
+		default:
+			// split at the common prefix
+			b := &cidrNode{prefix: leaf.prefix.Mask(net.CIDRMask(common, len(ip)*8)), plen: common}
+			b.child[bit(cur.prefix, common)] = cur
+			b.child[bit(leaf.prefix, common)] = leaf
+			*n = b
+			t.size++
+			return
+		}
+	}
+}
+
+// Lookup returns the value and the most specific cidr which contains ip, nil if not found.
+func (t *cidrTree) Lookup(ip net.IP) (interface{}, *net.IPNet) {
+	return t.LookupFunc(ip, nil)
+}
+
+// LookupFunc is like Lookup but only returns the cidrs whose value is accepted, accept can be nil.
+func (t *cidrTree) LookupFunc(ip net.IP, accept func(value interface{}) bool) (interface{}, *net.IPNet) {
+	n := t.v4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		n = t.v6
+	}
+
+	var value interface{}
+	var cidr *net.IPNet
+	for n != nil && len(n.prefix) == len(ip) {
+		if commonPrefixLen(n.prefix, ip, n.plen) < n.plen {
+			break
+		}
+
+		if n.value != nil && (accept == nil || accept(n.value)) {
+			value, cidr = n.value, n.cidr
+		}
+
+		if n.plen == len(ip)*8 {
+			break
+		}
+		n = n.child[bit(ip, n.plen)]
+	}
+
+	return value, cidr
+}
+
+// Len returns the number of cidrs in tree.
+func (t *cidrTree) Len() int {
+	return t.size
+}
+
+// bit returns the i-th bit of ip.
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// commonPrefixLen returns the length of common prefix of a and b, at most max bits.
+func commonPrefixLen(a, b net.IP, max int) int {
+	n := 0
+	for i := 0; i < len(a) && n < max; i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			n += bits.LeadingZeros8(x)
+			break
+		}
+		n += 8
+	}
+
+	if n > max {
+		n = max
+	}
+	return n
+}
@@ -0,0 +1,106 @@
+package rule
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCIDRTree(t *testing.T) {
+	var tree cidrTree
+	for _, s := range []string{
+		"0.0.0.0/0",
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+		"10.1.2.0/24",
+		"10.1.2.3/32",
+		"10.128.0.0/9",
+		"192.168.0.0/16",
+		"::ffff:172.16.0.0/108", // ipv4-mapped, the same as 172.16.0.0/12
+		"2001:db8::/32",
+		"2001:db8:1::/48",
+		"2001:db8:1:2::/64",
+		"fc00::/7",
+		"10.1.0.0/16", // duplicated
+	} {
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.Insert(cidr, s)
+	}
+
+	if tree.Len() != 12 {
+		t.Errorf("len = %d, want 12", tree.Len())
+	}
+
+	tests := []struct {
+		ip   string
+		want interface{}
+	}{
+		{"10.1.2.3", "10.1.2.3/32"},
+		{"10.1.2.4", "10.1.2.0/24"},
+		{"10.1.3.1", "10.1.0.0/16"},
+		{"10.2.0.1", "10.0.0.0/8"},
+		{"10.200.0.1", "10.128.0.0/9"},
+		{"192.168.255.255", "192.168.0.0/16"},
+		{"192.169.0.1", "0.0.0.0/0"},
+		{"172.20.1.1", "::ffff:172.16.0.0/108"},
+		{"172.32.0.1", "0.0.0.0/0"},
+		{"::ffff:10.1.2.3", "10.1.2.3/32"}, // ipv4-mapped address matches ipv4 cidrs
+		{"::ffff:172.16.0.1", "::ffff:172.16.0.0/108"},
+		{"2001:db8:1:2::1", "2001:db8:1:2::/64"},
+		{"2001:db8:1:3::1", "2001:db8:1::/48"},
+		{"2001:db8:2::1", "2001:db8::/32"},
+		{"2001:db9::1", nil}, // no ::/0 in ipv6 trie
+		{"fd00::1", "fc00::/7"},
+		{"::1", nil},
+	}
+
+	for _, tt := range tests {
+		value, cidr := tree.Lookup(net.ParseIP(tt.ip))
+		if value != tt.want {
+			t.Errorf("Lookup(%s) = %v, want %v", tt.ip, value, tt.want)
+			continue
+		}
+		if cidr != nil && !cidr.Contains(net.ParseIP(tt.ip)) {
+			t.Errorf("Lookup(%s) returns cidr %s not containing it", tt.ip, cidr)
+		}
+	}
+
+	// the most specific cidr whose value is accepted
+	accept := func(v interface{}) bool { return v != "10.1.2.0/24" && v != "10.1.2.3/32" }
+	if value, _ := tree.LookupFunc(net.ParseIP("10.1.2.3"), accept); value != "10.1.0.0/16" {
+		t.Errorf("LookupFunc(10.1.2.3) = %v, want 10.1.0.0/16", value)
+	}
+}
+
+func TestCIDRTreeOrder(t *testing.T) {
+	// the result does not depend on the insertion order
+	cidrs := []string{"10.0.0.0/8", "10.0.0.0/16", "10.0.128.0/17", "10.0.0.0/24", "10.0.0.128/25", "10.0.1.0/24"}
+	ips := map[string]string{
+		"10.0.0.1":   "10.0.0.0/24",
+		"10.0.0.200": "10.0.0.128/25",
+		"10.0.1.1":   "10.0.1.0/24",
+		"10.0.2.1":   "10.0.0.0/16",
+		"10.0.200.1": "10.0.128.0/17",
+		"10.1.0.1":   "10.0.0.0/8",
+	}
+
+	for i := range cidrs {
+		var tree cidrTree
+		for j := range cidrs {
+			s := cidrs[(i+j)%len(cidrs)]
+			if i%2 == 1 {
+				s = cidrs[(len(cidrs)+i-j)%len(cidrs)]
+			}
+			_, cidr, _ := net.ParseCIDR(s)
+			tree.Insert(cidr, s)
+		}
+
+		for ip, want := range ips {
+			if value, _ := tree.Lookup(net.ParseIP(ip)); value != want {
+				t.Errorf("order %d: Lookup(%s) = %v, want %s", i, ip, value, want)
+			}
+		}
+	}
+}
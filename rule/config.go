@@ -1,6 +1,7 @@
 package rule
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -8,6 +9,7 @@ import (
 
 	"github.com/nadoo/conflag"
 
+	"github.com/nadoo/glider/proxy"
 	"github.com/nadoo/glider/strategy"
 )
 
@@ -16,14 +18,33 @@ type Config struct {
 	Name string
 
 	Forward        []string
+	Subscription   []string
 	StrategyConfig strategy.Config
 
-	DNSServers []string
-	IPSet      string
+	DNSServers  []string
+	DNSRace     int
+	DNSIPFamily string
+	DNSECS      string
+	IPSet       string
 
-	Domain []string
-	IP     []string
-	CIDR   []string
+	Domain  []string
+	IP      []string
+	CIDR    []string
+	GeoIP   []string
+	GeoSite []string
+
+	Port      []string
+	PortRange []string
+	Network   []string
+	SrcIP     []string
+	SrcCIDR   []string
+	Inbound   []string
+	UID       []string
+	Process   []string
+
+	Schedule []string
+
+	Provider []string
 }
 
 // NewConfFromFile returns a new config from file.
@@ -32,6 +53,7 @@ func NewConfFromFile(ruleFile string) (*Config, error) {
 
 	f := conflag.NewFromFile("rule", ruleFile)
 	f.StringSliceUniqVar(&p.Forward, "forward", nil, "forward url, format: SCHEME://[USER|METHOD:PASSWORD@][HOST]:PORT?PARAMS[,SCHEME://[USER|METHOD:PASSWORD@][HOST]:PORT?PARAMS]")
+	f.StringSliceUniqVar(&p.Subscription, "subscription", nil, "forwarder subscription url or file of share links(ss, vmess, trojan), SIP008 json or clash yaml, format: URL|FILE[#interval=DURATION&priority=PRIORITY]")
 	f.StringVar(&p.StrategyConfig.Strategy, "strategy", "rr", "forward strategy, default: rr")
 	f.StringVar(&p.StrategyConfig.CheckWebSite, "checkwebsite", "www.apple.com", "proxy check HTTP(NOT HTTPS) website address, format: HOST[:PORT], default port: 80")
 	f.IntVar(&p.StrategyConfig.CheckInterval, "checkinterval", 30, "proxy check interval(seconds)")
@@ -41,13 +63,32 @@ func NewConfFromFile(ruleFile string) (*Config, error) {
 	f.IntVar(&p.StrategyConfig.DialTimeout, "dialtimeout", 3, "dial timeout(seconds)")
 	f.IntVar(&p.StrategyConfig.RelayTimeout, "relaytimeout", 0, "relay timeout(seconds)")
 	f.StringVar(&p.StrategyConfig.IntFace, "interface", "", "source ip or source interface")
+	f.StringVar(&p.StrategyConfig.IPFamily, "ipfamily", "", "ip family to connect to domain targets directly: ipv4, ipv6, preferipv4, preferipv6")
 
 	f.StringSliceUniqVar(&p.DNSServers, "dnsserver", nil, "remote dns server")
+	f.IntVar(&p.DNSRace, "dnsrace", 0, "query the N fastest dns servers at once and use the first answer, 0: use the global setting")
+	f.StringVar(&p.DNSIPFamily, "dnsipfamily", "", "ip family of A/AAAA answers: ipv4, ipv6, preferipv4, preferipv6")
+	f.StringVar(&p.DNSECS, "dnsecs", "", "edns client subnet of queries to upstream dns servers: CIDR, ip or strip")
 	f.StringVar(&p.IPSet, "ipset", "", "ipset name")
 
 	f.StringSliceUniqVar(&p.Domain, "domain", nil, "domain")
 	f.StringSliceUniqVar(&p.IP, "ip", nil, "ip")
 	f.StringSliceUniqVar(&p.CIDR, "cidr", nil, "cidr")
+	f.StringSliceUniqVar(&p.GeoIP, "geoip", nil, "country iso code of ips in geoip database, e.g. CN")
+	f.StringSliceUniqVar(&p.GeoSite, "geosite", nil, "domain list name in geosite file, format: NAME[@ATTR], e.g. google, geolocation-!cn, google@cn")
+
+	f.StringSliceUniqVar(&p.Port, "port", nil, "destination port")
+	f.StringSliceUniqVar(&p.PortRange, "portrange", nil, "destination port range, format: FROM-TO")
+	f.StringSliceUniqVar(&p.Network, "network", nil, "network: tcp or udp")
+	f.StringSliceUniqVar(&p.SrcIP, "srcip", nil, "client ip")
+	f.StringSliceUniqVar(&p.SrcCIDR, "srccidr", nil, "client cidr")
+	f.StringSliceUniqVar(&p.Inbound, "inbound", nil, "listener name, the fragment of the listen url(SCHEME://ADDR#NAME), or SCHEME://HOST:PORT of it without #NAME")
+	f.StringSliceUniqVar(&p.UID, "uid", nil, "user id or user name of the local process which the connection comes from, linux only")
+	f.StringSliceUniqVar(&p.Process, "process", nil, "name or executable path of the local process which the connection comes from, linux only")
+
+	f.StringSliceUniqVar(&p.Schedule, "schedule", nil, "time window in which the rule is active, format: [DAYS] HH:MM-HH:MM [TIMEZONE], e.g. Mon-Fri 09:00-18:00 Asia/Shanghai")
+
+	f.StringSliceUniqVar(&p.Provider, "provider", nil, "remote rule list, format: URL[#name=NAME&format=domain|ipcidr|classical&interval=24h&via=GROUP&path=FILE]")
 
 	err := f.Parse()
 	if err != nil {
@@ -55,6 +96,22 @@ func NewConfFromFile(ruleFile string) (*Config, error) {
 		return nil, err
 	}
 
+	for _, family := range []string{p.StrategyConfig.IPFamily, p.DNSIPFamily} {
+		if !proxy.ValidIPFamily(family) {
+			err := errors.New("invalid ip family: " + family)
+			fmt.Fprintf(os.Stderr, "ERROR: %s in %s\n", err, ruleFile)
+			return nil, err
+		}
+	}
+
+	var s Schedule
+	for _, schedule := range p.Schedule {
+		if err := s.Add(schedule); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s in %s\n", err, ruleFile)
+			return nil, err
+		}
+	}
+
 	return p, err
 }
 
@@ -0,0 +1,52 @@
+package rule
+
+import (
+	"github.com/nadoo/glider/proxy"
+	"github.com/nadoo/glider/strategy"
+)
+
+// Matcher types of rules besides the domain matcher types.
+const (
+	MatchIP       = "ip"
+	MatchCIDR     = "cidr"
+	MatchGeoIP    = "geoip"
+	MatchPort     = "port"
+	MatchNetwork  = "network"
+	MatchInbound  = "inbound"
+	MatchProcess  = "process"
+	MatchUID      = "uid"
+	MatchSrcIP    = "srcip"
+	MatchSrcCIDR  = "srccidr"
+	MatchProvider = "provider" // value: NAME,PATTERN
+	MatchDefault  = "default"  // no rule matched
+)
+
+// Explanation explains how a connection is routed.
+type Explanation struct {
+	Rule      string `json:"rule"`             // rule file or ordered rule, empty if no rule matched
+	Type      string `json:"type"`             // matcher type
+	Value     string `json:"value,omitempty"`  // matcher value
+	DomainIP  bool   `json:"domainip"`         // matched by an ip learned from dns answers of Domain
+	Domain    string `json:"domain,omitempty"` // the domain which the ip is resolved from
+	Strategy  string `json:"strategy"`         // name of the strategy proxy(forwarder group)
+	Forwarder string `json:"forwarder"`        // the forwarder NextDialer chooses
+}
+
+// set sets the matched proxy and matcher of e, returns proxy. e can be nil.
+func (e *Explanation) set(proxy *strategy.Proxy, typ, value string) *strategy.Proxy {
+	if e != nil {
+		e.Type, e.Value, e.Strategy = typ, value, proxy.Name()
+		if typ != MatchDefault {
+			e.Rule = proxy.Name()
+		}
+	}
+	return proxy
+}
+
+// Explain returns how a connection to dstAddr will be routed, sess can be nil.
+func (p *Proxy) Explain(network, dstAddr string, sess *proxy.Session) *Explanation {
+	e := &Explanation{}
+	sd := p.match(network, dstAddr, sess, e)
+	e.Forwarder = sd.NextDialer(dstAddr, sess).Addr()
+	return e
+}
@@ -0,0 +1,314 @@
+package rule
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+	"sync"
+)
+
+// mmdbMetaStart is the marker before the metadata section of a MaxMind DB file.
+var mmdbMetaStart = []byte("\xAB\xCD\xEFMaxMind.com")
+
+var errMMDBInvalid = errors.New("invalid mmdb data")
+
+// mmdb data types.
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// GeoIP is a reader of MaxMind DB(GeoIP2/GeoLite2 Country or City) files, it looks up
+// the country iso code of ips.
+// https://maxmind.github.io/MaxMind-DB/
+type GeoIP struct {
+	buf        []byte
+	data       []byte // data section
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // node of ::/96 in ipv6 database
+
+	countries sync.Map // data offset: country iso code
+}
+
+// NewGeoIP opens a MaxMind DB file.
+func NewGeoIP(file string) (*GeoIP, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	i := bytes.LastIndex(buf, mmdbMetaStart)
+	if i == -1 {
+		return nil, errors.New("invalid mmdb file: metadata not found")
+	}
+
+	meta, _, err := mmdbDecode(buf[i+len(mmdbMetaStart):], 0)
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid mmdb file: metadata is not a map")
+	}
+
+	g := &GeoIP{buf: buf}
+	for k, p := range map[string]*uint{"node_count": &g.nodeCount, "record_size": &g.recordSize, "ip_version": &g.ipVersion} {
+		v, ok := m[k].(uint64)
+		if !ok {
+			return nil, errors.New("invalid mmdb file: " + k + " not found in metadata")
+		}
+		*p = uint(v)
+	}
+
+	if g.recordSize != 24 && g.recordSize != 28 && g.recordSize != 32 {
+		return nil, errors.New("invalid mmdb file: unsupported record size")
+	}
+
+	treeSize := g.nodeCount * g.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("invalid mmdb file: search tree out of range")
+	}
+	g.data = buf[treeSize+16 : i]
+
+	if g.ipVersion == 6 {
+		for j := 0; j < 96 && g.ipv4Start < g.nodeCount; j++ {
+			g.ipv4Start = g.record(g.ipv4Start, 0)
+		}
+	}
+
+	return g, nil
+}
+
+// record returns the left(bit 0) or right(bit 1) record of node.
+func (g *GeoIP) record(node uint, bit int) uint {
+	b := g.buf[node*g.recordSize/4:]
+	switch g.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// Lookup returns the country iso code(upper case) of ip, empty if not found.
+func (g *GeoIP) Lookup(ip net.IP) string {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, node = ip4, g.ipv4Start
+	} else if g.ipVersion == 4 {
+		return ""
+	}
+
+	for i := 0; i < len(ip)*8 && node < g.nodeCount; i++ {
+		node = g.record(node, int(ip[i/8]>>(7-uint(i%8)))&1)
+	}
+
+	if node <= g.nodeCount {
+		return ""
+	}
+	return g.country(node - g.nodeCount - 16)
+}
+
+// country returns the country iso code of the data record at offset.
+func (g *GeoIP) country(offset uint) string {
+	if v, ok := g.countries.Load(offset); ok {
+		return v.(string)
+	}
+
+	var code string
+	if v, _, err := mmdbDecode(g.data, offset); err == nil {
+		if m, ok := v.(map[string]interface{}); ok {
+			for _, k := range []string{"country", "registered_country"} {
+				if c, ok := m[k].(map[string]interface{}); ok {
+					if s, ok := c["iso_code"].(string); ok {
+						code = strings.ToUpper(s)
+						break
+					}
+				}
+			}
+		}
+	}
+
+	g.countries.Store(offset, code)
+	return code
+}
+
+// CIDRs returns the ipv4 cidrs of country.
+func (g *GeoIP) CIDRs(country string) []*net.IPNet {
+	var cidrs []*net.IPNet
+	g.walk(g.ipv4Start, make(net.IP, net.IPv4len), 0, strings.ToUpper(country), &cidrs)
+	return cidrs
+}
+
+// walk walks the search tree from node with ip prefix of depth bits, and appends cidrs of country.
+func (g *GeoIP) walk(node uint, ip net.IP, depth int, country string, cidrs *[]*net.IPNet) {
+	if node > g.nodeCount {
+		if g.country(node-g.nodeCount-16) == country {
+			*cidrs = append(*cidrs, &net.IPNet{IP: append(net.IP(nil), ip...), Mask: net.CIDRMask(depth, len(ip)*8)})
+		}
+		return
+	}
+
+	if node == g.nodeCount || depth >= len(ip)*8 {
+		return
+	}
+
+	for bit := 0; bit < 2; bit++ {
+		if bit == 1 {
+			ip[depth/8] |= 1 << (7 - uint(depth%8))
+		}
+		g.walk(g.record(node, bit), ip, depth+1, country, cidrs)
+	}
+	ip[depth/8] &^= 1 << (7 - uint(depth%8))
+}
+
+// mmdbDecode decodes the field at offset of data section, returns the value and the offset of the next field.
+// map values are decoded to map[string]interface{}, arrays to []interface{}, unsigned integers to uint64,
+// signed integers to int64, floats to float64 and uint128 to []byte.
+func mmdbDecode(data []byte, offset uint) (interface{}, uint, error) {
+	return mmdbDecodeDepth(data, offset, 0)
+}
+
+func mmdbDecodeDepth(data []byte, offset uint, depth int) (interface{}, uint, error) {
+	if depth > 32 || offset >= uint(len(data)) {
+		return nil, 0, errMMDBInvalid
+	}
+
+	ctrl := data[offset]
+	offset++
+
+	typ := uint(ctrl >> 5)
+	if typ == mmdbPointer {
+		ss, p := uint(ctrl>>3)&3, uint(ctrl&7)
+		if offset+ss+1 > uint(len(data)) {
+			return nil, 0, errMMDBInvalid
+		}
+		switch ss {
+		case 0:
+			p = p<<8 | uint(data[offset])
+		case 1:
+			p = (p<<16 | uint(data[offset])<<8 | uint(data[offset+1])) + 2048
+		case 2:
+			p = (p<<24 | uint(data[offset])<<16 | uint(data[offset+1])<<8 | uint(data[offset+2])) + 526336
+		case 3:
+			p = uint(binary.BigEndian.Uint32(data[offset:]))
+		}
+		v, _, err := mmdbDecodeDepth(data, p, depth+1)
+		return v, offset + ss + 1, err
+	}
+
+	if typ == mmdbExtended {
+		if offset >= uint(len(data)) {
+			return nil, 0, errMMDBInvalid
+		}
+		typ = 7 + uint(data[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(data)) {
+			return nil, 0, errMMDBInvalid
+		}
+		var s uint
+		for i := uint(0); i < n; i++ {
+			s = s<<8 | uint(data[offset+i])
+		}
+		size = []uint{29, 285, 65821}[n-1] + s
+		offset += n
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := mmdbDecodeDepth(data, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBInvalid
+			}
+			v, next, err := mmdbDecodeDepth(data, next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key], offset = v, next
+		}
+		return m, offset, nil
+
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := mmdbDecodeDepth(data, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, offset = append(a, v), next
+		}
+		return a, offset, nil
+
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(data)) {
+		return nil, 0, errMMDBInvalid
+	}
+	b := data[offset : offset+size]
+	offset += size
+
+	switch typ {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes, mmdbUint128:
+		return b, offset, nil
+	case mmdbDouble, mmdbFloat:
+		if typ == mmdbDouble && size == 8 {
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+		} else if typ == mmdbFloat && size == 4 {
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+		}
+		return nil, 0, errMMDBInvalid
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbInt32:
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		if typ == mmdbInt32 {
+			return int64(int32(v)), offset, nil
+		}
+		return v, offset, nil
+	}
+
+	return nil, 0, errMMDBInvalid
+}
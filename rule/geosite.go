@@ -0,0 +1,236 @@
+package rule
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GeoSite is a reader of categorized domain lists, in v2ray geosite.dat(protobuf) format,
+// or a directory of list files in domain-list-community format.
+// NAME@ATTR selects the domains with attribute ATTR in list NAME.
+type GeoSite struct {
+	dir   string
+	lists map[string][]byte // list name: protobuf encoded domains, geosite.dat only
+}
+
+// NewGeoSite opens a geosite.dat file or a directory of list files.
+func NewGeoSite(path string) (*GeoSite, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return &GeoSite{dir: path}, nil
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &GeoSite{lists: make(map[string][]byte)}
+
+	// message GeoSiteList { repeated GeoSite entry = 1; }
+	err = pbRange(buf, func(num int, v uint64, b []byte) error {
+		if num != 1 {
+			return nil
+		}
+		// message GeoSite { string country_code = 1; repeated Domain domain = 2; }
+		return pbRange(b, func(num int, v uint64, data []byte) error {
+			if num == 1 {
+				g.lists[strings.ToLower(string(data))] = b
+			}
+			return nil
+		})
+	})
+
+	return g, err
+}
+
+// Domains returns domain patterns of list name, in the format used by domain rules:
+// "DOMAIN", "full:DOMAIN", "keyword:KEYWORD" or "regexp:REGEXP".
+func (g *GeoSite) Domains(name string) ([]string, error) {
+	name, attr := strings.ToLower(name), ""
+	if i := strings.IndexByte(name, '@'); i != -1 {
+		name, attr = name[:i], name[i+1:]
+	}
+
+	if g.dir != "" {
+		return g.loadList(name, attr, make(map[string]bool))
+	}
+
+	b, ok := g.lists[name]
+	if !ok {
+		return nil, errors.New("geosite list not found: " + name)
+	}
+
+	var domains []string
+	err := pbRange(b, func(num int, v uint64, data []byte) error {
+		if num != 2 {
+			return nil
+		}
+
+		// message Domain { Type type = 1; string value = 2; repeated Attribute attribute = 3; }
+		// enum Type { Plain = 0; Regex = 1; Domain = 2; Full = 3; }
+		// message Attribute { string key = 1; ... }
+		var typ uint64
+		var value string
+		matched := attr == ""
+		err := pbRange(data, func(num int, v uint64, b []byte) error {
+			switch num {
+			case 1:
+				typ = v
+			case 2:
+				value = string(b)
+			case 3:
+				if !matched {
+					return pbRange(b, func(num int, v uint64, key []byte) error {
+						if num == 1 && strings.ToLower(string(key)) == attr {
+							matched = true
+						}
+						return nil
+					})
+				}
+			}
+			return nil
+		})
+		if err != nil || !matched || value == "" {
+			return err
+		}
+
+		switch typ {
+		case 0:
+			domains = append(domains, MatchKeyword+":"+value)
+		case 1:
+			domains = append(domains, MatchRegexp+":"+value)
+		case 2:
+			domains = append(domains, value)
+		case 3:
+			domains = append(domains, MatchFull+":"+value)
+		}
+		return nil
+	})
+
+	return domains, err
+}
+
+// loadList loads the list file name in the directory, and the lists included by it.
+// line format: [TYPE:]VALUE [@ATTR]..., TYPE can be domain, full, keyword, regexp or include.
+func (g *GeoSite) loadList(name, attr string, loaded map[string]bool) ([]string, error) {
+	if loaded[name] {
+		return nil, nil
+	}
+	loaded[name] = true
+
+	f, err := os.Open(filepath.Join(g.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var domains []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		pattern := fields[0]
+		if strings.HasPrefix(pattern, "include:") {
+			sub, err := g.loadList(strings.ToLower(pattern[len("include:"):]), attr, loaded)
+			if err != nil {
+				return nil, err
+			}
+			domains = append(domains, sub...)
+			continue
+		}
+
+		if attr != "" {
+			matched := false
+			for _, a := range fields[1:] {
+				if strings.ToLower(a) == "@"+attr {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+
+		if strings.HasPrefix(pattern, MatchDomain+":") {
+			pattern = pattern[len(MatchDomain)+1:]
+		}
+		domains = append(domains, pattern)
+	}
+
+	return domains, scanner.Err()
+}
+
+var errPBInvalid = errors.New("invalid protobuf data")
+
+// pbRange calls f for each field in protobuf encoded message b, v is the value of varint
+// fields and data is the value of length-delimited fields.
+func pbRange(b []byte, f func(num int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := pbVarint(b)
+		if n == 0 {
+			return errPBInvalid
+		}
+		b = b[n:]
+
+		var v uint64
+		var data []byte
+		switch key & 7 {
+		case 0: // varint
+			if v, n = pbVarint(b); n == 0 {
+				return errPBInvalid
+			}
+		case 1: // 64-bit
+			n = 8
+		case 2: // length-delimited
+			l, m := pbVarint(b)
+			if m == 0 || l > uint64(len(b)-m) {
+				return errPBInvalid
+			}
+			data, n = b[m:m+int(l)], m+int(l)
+		case 5: // 32-bit
+			n = 4
+		default:
+			return errPBInvalid
+		}
+
+		if n > len(b) {
+			return errPBInvalid
+		}
+		b = b[n:]
+
+		if err := f(int(key>>3), v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pbVarint decodes a varint from b, returns the value and the number of bytes read, 0 if failed.
+func pbVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
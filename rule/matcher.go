@@ -0,0 +1,240 @@
+package rule
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Domain matcher types, the pattern format is "TYPE:VALUE", TYPE defaults to domain.
+// When a domain matches patterns of different types, the precedence is:
+// full > domain(the longest one) > keyword(the first added) > regexp(the first added).
+const (
+	MatchFull    = "full"    // exact match
+	MatchDomain  = "domain"  // suffix match, matches the domain and its subdomains
+	MatchKeyword = "keyword" // substring match
+	MatchRegexp  = "regexp"  // regular expression match
+)
+
+// DomainMatcher matches domains against full, domain, keyword and regexp patterns.
+type DomainMatcher struct {
+	mu     sync.RWMutex
+	full   map[string]interface{}
+	domain map[string]interface{}
+
+	keywords []string
+	kwValues []interface{}
+	ac       *acMatcher // built on first match after keywords added
+
+	regexps  []*regexp.Regexp
+	reValues []interface{}
+}
+
+// NewDomainMatcher returns a new domain matcher.
+func NewDomainMatcher() *DomainMatcher {
+	return &DomainMatcher{full: make(map[string]interface{}), domain: make(map[string]interface{})}
+}
+
+// ParsePattern parses the domain pattern and returns its type and value.
+func ParsePattern(pattern string) (typ, value string) {
+	if i := strings.IndexByte(pattern, ':'); i != -1 {
+		switch typ := pattern[:i]; typ {
+		case MatchFull, MatchDomain, MatchKeyword:
+			return typ, strings.ToLower(pattern[i+1:])
+		case MatchRegexp:
+			return typ, pattern[i+1:]
+		}
+	}
+	return MatchDomain, strings.ToLower(pattern)
+}
+
+// Add adds a pattern with value, the value of a full or domain pattern added before will be replaced.
+func (m *DomainMatcher) Add(pattern string, value interface{}) error {
+	typ, v := ParsePattern(pattern)
+	if v == "" {
+		return errors.New("empty domain pattern: " + pattern)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch typ {
+	case MatchFull:
+		m.full[strings.TrimSuffix(v, ".")] = value
+	case MatchDomain:
+		m.domain[strings.TrimSuffix(v, ".")] = value
+	case MatchKeyword:
+		m.keywords = append(m.keywords, v)
+		m.kwValues = append(m.kwValues, value)
+		m.ac = nil
+	case MatchRegexp:
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return err
+		}
+		m.regexps = append(m.regexps, re)
+		m.reValues = append(m.reValues, value)
+	}
+
+	return nil
+}
+
+// Len returns the number of patterns.
+func (m *DomainMatcher) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.full) + len(m.domain) + len(m.keywords) + len(m.regexps)
+}
+
+// Match returns the value, type and value of the matched pattern, value is nil if not matched.
+func (m *DomainMatcher) Match(domain string) (value interface{}, typ, pattern string) {
+	return m.MatchFunc(domain, nil)
+}
+
+// MatchFunc is like Match but only matches the patterns whose value is accepted, accept can be nil.
+func (m *DomainMatcher) MatchFunc(domain string, accept func(value interface{}) bool) (value interface{}, typ, pattern string) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+
+	// keywords may be added before the read lock is held again, check it in a loop
+	m.mu.RLock()
+	for m.ac == nil && len(m.keywords) > 0 {
+		m.mu.RUnlock()
+		m.mu.Lock()
+		if m.ac == nil {
+			m.ac = newACMatcher(m.keywords)
+		}
+		m.mu.Unlock()
+		m.mu.RLock()
+	}
+	defer m.mu.RUnlock()
+
+	ok := func(v interface{}) bool { return accept == nil || accept(v) }
+
+	if v, found := m.full[domain]; found && ok(v) {
+		return v, MatchFull, domain
+	}
+
+	// the longest suffix wins
+	for s := domain; ; {
+		if v, found := m.domain[s]; found && ok(v) {
+			return v, MatchDomain, s
+		}
+		i := strings.IndexByte(s, '.')
+		if i == -1 {
+			break
+		}
+		s = s[i+1:]
+	}
+
+	if m.ac != nil {
+		if i := m.ac.Match(domain); i != -1 {
+			if ok(m.kwValues[i]) {
+				return m.kwValues[i], MatchKeyword, m.keywords[i]
+			}
+			// the first one is not accepted, check the others one by one
+			for j := i + 1; j < len(m.keywords); j++ {
+				if strings.Contains(domain, m.keywords[j]) && ok(m.kwValues[j]) {
+					return m.kwValues[j], MatchKeyword, m.keywords[j]
+				}
+			}
+		}
+	}
+
+	for i, re := range m.regexps {
+		if re.MatchString(domain) && ok(m.reValues[i]) {
+			return m.reValues[i], MatchRegexp, re.String()
+		}
+	}
+
+	return nil, "", ""
+}
+
+// acNode is a state of Aho-Corasick automaton.
+type acNode struct {
+	next map[byte]int32
+	fail int32
+	out  int32 // the min index of patterns which end at this state, -1 if none
+}
+
+// acMatcher is an Aho-Corasick automaton for multiple substring matching.
+type acMatcher struct {
+	nodes []acNode
+}
+
+// newACMatcher returns a new Aho-Corasick automaton of patterns.
+func newACMatcher(patterns []string) *acMatcher {
+	ac := &acMatcher{nodes: []acNode{{next: make(map[byte]int32), out: -1}}}
+
+	for i, p := range patterns {
+		s := int32(0)
+		for j := 0; j < len(p); j++ {
+			n, ok := ac.nodes[s].next[p[j]]
+			if !ok {
+				n = int32(len(ac.nodes))
+				ac.nodes = append(ac.nodes, acNode{next: make(map[byte]int32), out: -1})
+				ac.nodes[s].next[p[j]] = n
+			}
+			s = n
+		}
+		if ac.nodes[s].out == -1 || int32(i) < ac.nodes[s].out {
+			ac.nodes[s].out = int32(i)
+		}
+	}
+
+	// build fail links in bfs order, and merge the outputs of fail states
+	queue := make([]int32, 0, len(ac.nodes))
+	for _, n := range ac.nodes[0].next {
+		queue = append(queue, n)
+	}
+
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+
+		for c, n := range ac.nodes[s].next {
+			f := ac.nodes[s].fail
+			for {
+				if t, ok := ac.nodes[f].next[c]; ok && t != n {
+					ac.nodes[n].fail = t
+					break
+				}
+				if f == 0 {
+					break
+				}
+				f = ac.nodes[f].fail
+			}
+
+			if out := ac.nodes[ac.nodes[n].fail].out; out != -1 &&
+				(ac.nodes[n].out == -1 || out < ac.nodes[n].out) {
+				ac.nodes[n].out = out
+			}
+
+			queue = append(queue, n)
+		}
+	}
+
+	return ac
+}
+
+// Match returns the min index of patterns which are substrings of s, -1 if none.
+func (ac *acMatcher) Match(s string) int {
+	best, state := int32(-1), int32(0)
+	for i := 0; i < len(s); i++ {
+		for {
+			if n, ok := ac.nodes[state].next[s[i]]; ok {
+				state = n
+				break
+			}
+			if state == 0 {
+				break
+			}
+			state = ac.nodes[state].fail
+		}
+
+		if out := ac.nodes[state].out; out != -1 && (best == -1 || out < best) {
+			best = out
+		}
+	}
+	return int(best)
+}
@@ -0,0 +1,145 @@
+package rule
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// firstContained returns the min index of patterns which are substrings of s, -1 if none.
+func firstContained(patterns []string, s string) int {
+	for i, p := range patterns {
+		if strings.Contains(s, p) {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestACMatcher(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		s        string
+		want     int
+	}{
+		{[]string{"he", "she", "his", "hers"}, "ushers", 0},
+		{[]string{"hers", "she", "he"}, "ushers", 0},
+		{[]string{"she", "hers"}, "ushers", 0},
+		{[]string{"hers", "she"}, "usher", 1},
+		{[]string{"abcd", "bc"}, "abce", 1}, // fail from abc to bc
+		{[]string{"bcd", "abce", "cd"}, "abcd", 0},
+		{[]string{"aaa", "aa"}, "aa", 1},
+		{[]string{"aab", "ab"}, "aaab", 0},
+		{[]string{"google", "goo", "oog"}, "www.gooogle.com", 1},
+		{[]string{"ads", "tracker"}, "example.com", -1},
+		{[]string{"x"}, "", -1},
+	}
+
+	for _, tt := range tests {
+		if got := newACMatcher(tt.patterns).Match(tt.s); got != tt.want {
+			t.Errorf("patterns %v: Match(%q) = %d, want %d", tt.patterns, tt.s, got, tt.want)
+		}
+	}
+
+	// compare with brute force on random overlapping patterns
+	r := rand.New(rand.NewSource(1))
+	randStr := func(n int) string {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = "abc."[r.Intn(4)]
+		}
+		return string(b)
+	}
+
+	for i := 0; i < 200; i++ {
+		patterns := make([]string, 1+r.Intn(10))
+		for j := range patterns {
+			patterns[j] = randStr(1 + r.Intn(4))
+		}
+		ac := newACMatcher(patterns)
+		for j := 0; j < 20; j++ {
+			s := randStr(r.Intn(16))
+			if got, want := ac.Match(s), firstContained(patterns, s); got != want {
+				t.Fatalf("patterns %q: Match(%q) = %d, want %d", patterns, s, got, want)
+			}
+		}
+	}
+}
+
+func TestDomainMatcher(t *testing.T) {
+	m := NewDomainMatcher()
+	for _, p := range []string{
+		"full:www.example.com",
+		"example.com",
+		"domain:a.example.com",
+		"keyword:google",
+		"keyword:goo",
+		`regexp:^ad\d+\.`,
+		"keyword:ad",
+	} {
+		if err := m.Add(p, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Add("keyword:", "x"); err == nil {
+		t.Error("empty pattern: expected error")
+	}
+
+	tests := []struct {
+		domain string
+		want   interface{}
+	}{
+		{"www.example.com", "full:www.example.com"},
+		{"WWW.Example.com.", "full:www.example.com"},
+		{"x.www.example.com", "example.com"},
+		{"x.a.example.com", "domain:a.example.com"},
+		{"a.example.com.cn", nil},
+		{"www.google.com", "keyword:google"},
+		{"www.goo.gl", "keyword:goo"},
+		{"ad1.test", "keyword:ad"}, // keyword before regexp
+		{"test.org", nil},
+	}
+
+	for _, tt := range tests {
+		if v, _, _ := m.Match(tt.domain); v != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.domain, v, tt.want)
+		}
+	}
+
+	// the first keyword not accepted
+	accept := func(v interface{}) bool { return v != "keyword:google" }
+	if v, typ, p := m.MatchFunc("www.google.com", accept); v != "keyword:goo" || typ != MatchKeyword || p != "goo" {
+		t.Errorf("MatchFunc = %v, %s, %s, want keyword:goo", v, typ, p)
+	}
+}
+
+func TestDomainMatcherConcurrent(t *testing.T) {
+	m := NewDomainMatcher()
+	m.Add("keyword:k000", 0)
+
+	// the automaton is rebuilt lazily on match while keywords are being added
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if v, _, _ := m.Match("www.k000.com"); v != 0 {
+					t.Errorf("Match = %v, want 0", v)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 1; i < 100; i++ {
+		m.Add(fmt.Sprintf("keyword:k%03d", i), i)
+	}
+	wg.Wait()
+
+	if v, _, _ := m.Match("k099.com"); v != 99 {
+		t.Errorf("Match = %v, want 99", v)
+	}
+}
@@ -0,0 +1,363 @@
+package rule
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nadoo/glider/common/log"
+	"github.com/nadoo/glider/proxy"
+	"github.com/nadoo/glider/strategy"
+)
+
+// Ordered rule types, the rule format is "TYPE,VALUE,GROUP", or "MATCH,GROUP" for the final rule.
+const (
+	RuleDomain        = "DOMAIN"
+	RuleDomainSuffix  = "DOMAIN-SUFFIX"
+	RuleDomainKeyword = "DOMAIN-KEYWORD"
+	RuleDomainRegex   = "DOMAIN-REGEX"
+	RuleGeoSite       = "GEOSITE"
+	RuleIPCIDR        = "IP-CIDR"
+	RuleIPCIDR6       = "IP-CIDR6"
+	RuleGeoIP         = "GEOIP"
+	RuleSrcIPCIDR     = "SRC-IP-CIDR"
+	RuleDstPort       = "DST-PORT"
+	RuleSrcPort       = "SRC-PORT"
+	RuleNetwork       = "NETWORK"
+	RuleInbound       = "INBOUND"
+	RuleProcessName   = "PROCESS-NAME"
+	RuleUID           = "UID"
+	RuleSet           = "RULE-SET" // VALUE is the name of a provider in rule files
+	RuleMatch         = "MATCH"
+	RuleFinal         = "FINAL"
+)
+
+// Built-in groups of ordered rules, the other groups are rule files named without extension.
+const (
+	GroupDirect  = "DIRECT"
+	GroupReject  = "REJECT"
+	GroupDefault = "default" // forwarders in the global config
+)
+
+// OrderedRule is a rule in the ordered rule list.
+type OrderedRule struct {
+	Type    string
+	Value   string
+	Group   string
+	Domains []string // domain patterns of GEOSITE rule, filled by the caller
+
+	proxy *strategy.Proxy
+	match func(m *metadata) bool
+}
+
+// metadata is the information of a connection to match ordered rules.
+type metadata struct {
+	network string
+	domain  string // domain of destination, or the domain which the destination ip is resolved from
+	ip      net.IP // ip of destination
+	port    int    // -1 if unknown
+	srcIP   net.IP
+	srcPort int // -1 if unknown
+	inbound string
+
+	// owner of the source socket if the connection comes from a local process, loaded on demand
+	src         net.Addr
+	uid         int // -1 if unknown
+	inode       uint64
+	process     string
+	processPath string
+	uidLoaded   bool
+	procLoaded  bool
+}
+
+// loadUID loads the uid and socket inode of the local process which the connection comes from.
+func (m *metadata) loadUID() {
+	if m.uidLoaded {
+		return
+	}
+	m.uidLoaded = true
+
+	if m.src != nil {
+		if uid, inode, err := socketOwner(m.network, m.src); err == nil {
+			m.uid, m.inode = uid, inode
+		}
+	}
+}
+
+// loadProcess loads the name and path of the local process which the connection comes from.
+func (m *metadata) loadProcess() {
+	if m.procLoaded {
+		return
+	}
+	m.procLoaded = true
+
+	if m.loadUID(); m.inode != 0 {
+		m.process, m.processPath, _ = socketProcess(m.inode)
+	}
+}
+
+// ParseOrderedRule parses an ordered rule, format: TYPE,VALUE,GROUP[,OPTIONS] or MATCH,GROUP.
+func ParseOrderedRule(s string) (*OrderedRule, error) {
+	fields := strings.Split(s, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+
+	r := &OrderedRule{Type: strings.ToUpper(fields[0])}
+	switch {
+	case r.Type == RuleMatch || r.Type == RuleFinal:
+		if len(fields) < 2 {
+			return nil, errors.New("invalid rule: " + s)
+		}
+		r.Group = fields[1]
+	case len(fields) >= 3:
+		r.Value, r.Group = fields[1], fields[2]
+	default:
+		return nil, errors.New("invalid rule: " + s)
+	}
+
+	if r.Group == "" {
+		return nil, errors.New("invalid rule: " + s)
+	}
+
+	return r, nil
+}
+
+// String returns the rule in "TYPE,VALUE,GROUP" format.
+func (r *OrderedRule) String() string {
+	if r.Type == RuleMatch || r.Type == RuleFinal {
+		return r.Type + "," + r.Group
+	}
+	return r.Type + "," + r.Value + "," + r.Group
+}
+
+// compile sets the match function of rule.
+func (r *OrderedRule) compile(geoip *GeoIP, providers map[string]*provider) error {
+	v := r.Value
+	switch r.Type {
+	case RuleDomain:
+		v = strings.ToLower(v)
+		r.match = func(m *metadata) bool { return m.domain == v }
+
+	case RuleDomainSuffix:
+		v = strings.ToLower(v)
+		r.match = func(m *metadata) bool {
+			return m.domain == v || strings.HasSuffix(m.domain, "."+v)
+		}
+
+	case RuleDomainKeyword:
+		v = strings.ToLower(v)
+		r.match = func(m *metadata) bool { return m.domain != "" && strings.Contains(m.domain, v) }
+
+	case RuleDomainRegex:
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return err
+		}
+		r.match = func(m *metadata) bool { return m.domain != "" && re.MatchString(m.domain) }
+
+	case RuleGeoSite:
+		dm := NewDomainMatcher()
+		for _, d := range r.Domains {
+			dm.Add(d, true)
+		}
+		r.match = func(m *metadata) bool {
+			if m.domain == "" {
+				return false
+			}
+			v, _, _ := dm.Match(m.domain)
+			return v != nil
+		}
+
+	case RuleIPCIDR, RuleIPCIDR6, RuleSrcIPCIDR:
+		_, cidr, err := net.ParseCIDR(v)
+		if err != nil {
+			return err
+		}
+		if r.Type == RuleSrcIPCIDR {
+			r.match = func(m *metadata) bool { return m.srcIP != nil && cidr.Contains(m.srcIP) }
+		} else {
+			r.match = func(m *metadata) bool { return m.ip != nil && cidr.Contains(m.ip) }
+		}
+
+	case RuleGeoIP:
+		if geoip == nil {
+			return errors.New("geoip database not specified")
+		}
+		v = strings.ToUpper(v)
+		r.match = func(m *metadata) bool { return m.ip != nil && geoip.Lookup(m.ip) == v }
+
+	case RuleDstPort, RuleSrcPort:
+		from, to, err := parsePortRange(v)
+		if err != nil {
+			return err
+		}
+		if r.Type == RuleSrcPort {
+			r.match = func(m *metadata) bool { return m.srcPort >= int(from) && m.srcPort <= int(to) }
+		} else {
+			r.match = func(m *metadata) bool { return m.port >= int(from) && m.port <= int(to) }
+		}
+
+	case RuleNetwork:
+		v = strings.ToLower(v)
+		r.match = func(m *metadata) bool { return m.network == v }
+
+	case RuleInbound:
+		r.match = func(m *metadata) bool { return m.inbound == v }
+
+	case RuleProcessName:
+		r.match = func(m *metadata) bool {
+			m.loadProcess()
+			return m.process != "" && (m.process == v || m.processPath == v)
+		}
+
+	case RuleUID:
+		uid, err := lookupUID(v)
+		if err != nil {
+			return err
+		}
+		n, _ := strconv.Atoi(uid)
+		r.match = func(m *metadata) bool {
+			m.loadUID()
+			return m.uid == n
+		}
+
+	case RuleSet:
+		pv, ok := providers[v]
+		if !ok {
+			return errors.New("provider not found: " + v)
+		}
+		r.match = func(m *metadata) bool {
+			if m.ip != nil {
+				if proxy, _ := pv.matchIP(m.ip, nil); proxy != nil {
+					return true
+				}
+			}
+			if m.domain != "" {
+				if proxy, _ := pv.matchDomain(m.domain, nil); proxy != nil {
+					return true
+				}
+			}
+			return false
+		}
+
+	case RuleMatch, RuleFinal:
+		r.match = func(m *metadata) bool { return true }
+
+	default:
+		return errors.New("unknown rule type: " + r.Type)
+	}
+
+	return nil
+}
+
+// isDomainRule returns true if the rule matches domains, RULE-SET rules may also match ips.
+func (r *OrderedRule) isDomainRule() bool {
+	switch r.Type {
+	case RuleDomain, RuleDomainSuffix, RuleDomainKeyword, RuleDomainRegex, RuleGeoSite, RuleSet:
+		return true
+	}
+	return false
+}
+
+// groupName returns the group name of rule file, the file name without extension.
+func groupName(ruleFile string) string {
+	name := filepath.Base(ruleFile)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// SetOrderedRules enables the ordered rule mode: rules are evaluated top-down and the first matched
+// one is used, the destinations in rule files are ignored. c is the config of the built-in groups.
+// It should be called before serving.
+func (p *Proxy) SetOrderedRules(rules []*OrderedRule, c *strategy.Config) error {
+	for _, r := range rules {
+		sd, ok := p.groups[r.Group]
+		if !ok {
+			switch r.Group {
+			case GroupDirect:
+				cfg := *c
+				sd = strategy.NewProxy(GroupDirect, nil, &cfg)
+			case GroupReject:
+				cfg := *c
+				sd = strategy.NewProxy(GroupReject, []string{"reject://"}, &cfg)
+			default:
+				return errors.New("unknown group in rule: " + r.String())
+			}
+			p.groups[r.Group] = sd
+		}
+		r.proxy = sd
+
+		if err := r.compile(p.geoip, p.providerMap); err != nil {
+			return errors.New(err.Error() + ", rule: " + r.String())
+		}
+	}
+
+	for i, r := range rules {
+		if (r.Type == RuleMatch || r.Type == RuleFinal) && i < len(rules)-1 {
+			log.F("[rule] WARNING: %d rules after %s are never matched, the first one: %s",
+				len(rules)-1-i, r, rules[i+1])
+			break
+		}
+	}
+
+	p.ordered = rules
+
+	return nil
+}
+
+// orderedProxy returns the proxy and the rule of the first matched ordered rule, nil if not found.
+func (p *Proxy) orderedProxy(network, host, port string, sess *proxy.Session) (*strategy.Proxy, *OrderedRule) {
+	m := &metadata{port: -1, srcPort: -1, uid: -1}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		m.network = "tcp"
+	case "udp", "udp4", "udp6", "uot":
+		m.network = "udp"
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		m.ip = ip
+		m.domain = p.resolvedDomain(ip)
+	} else {
+		m.domain = strings.TrimSuffix(strings.ToLower(host), ".")
+	}
+
+	if n, err := strconv.Atoi(port); err == nil {
+		m.port = n
+	}
+
+	if sess != nil {
+		m.inbound, m.src = sess.Inbound, sess.Src
+		if sess.Src != nil {
+			if h, sp, err := net.SplitHostPort(sess.Src.String()); err == nil {
+				m.srcIP = net.ParseIP(h)
+				if n, err := strconv.Atoi(sp); err == nil {
+					m.srcPort = n
+				}
+			}
+		}
+	}
+
+	for _, r := range p.ordered {
+		if r.match(m) && p.active(r.proxy) {
+			return r.proxy, r
+		}
+	}
+
+	return nil, nil
+}
+
+// orderedDomainRule returns the first matched domain rule of domain in ordered rules, nil if not found.
+func (p *Proxy) orderedDomainRule(domain string) *OrderedRule {
+	m := &metadata{domain: strings.TrimSuffix(strings.ToLower(domain), "."), port: -1, srcPort: -1}
+	for _, r := range p.ordered {
+		if r.isDomainRule() && r.match(m) {
+			return r
+		}
+	}
+	return nil
+}
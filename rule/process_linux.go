@@ -0,0 +1,358 @@
+package rule
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// processCacheTTL is how long a process which owns sockets is cached.
+const processCacheTTL = 30 * time.Second
+
+// processCacheSize is the max number of cached processes.
+const processCacheSize = 64
+
+// localAddrsTTL is how long the ip addresses of local interfaces are cached.
+const localAddrsTTL = 30 * time.Second
+
+// processScanTimeout bounds the time of scanning all the processes for a socket in the dial path.
+const processScanTimeout = 100 * time.Millisecond
+
+var nativeEndian binary.ByteOrder = binary.BigEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		nativeEndian = binary.LittleEndian
+	}
+}
+
+type procEntry struct {
+	name, path string
+	expire     time.Time
+}
+
+// procCache caches the processes found recently, a process usually makes many connections,
+// so their fds are checked before scanning all processes. the sockets found are cached too,
+// as a udp socket is looked up for each session.
+var procCache = struct {
+	sync.Mutex
+	m       map[string]*procEntry // pid: process
+	sockets map[uint64]*procEntry // inode: process
+}{m: make(map[string]*procEntry), sockets: make(map[uint64]*procEntry)}
+
+var localAddrs = struct {
+	sync.Mutex
+	ips    map[string]bool
+	expire time.Time
+}{}
+
+var errNotLocal = errors.New("not a local address")
+
+// endpoint is an ip address and port in /proc/net files.
+type endpoint struct {
+	ip   net.IP
+	port uint16
+}
+
+// parseEndpoint parses the address "ip:port".
+func parseEndpoint(addr string) (endpoint, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return endpoint{}, false
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return endpoint{}, false
+	}
+	return endpoint{ip, uint16(p)}, true
+}
+
+// socketOwner returns the uid and inode of the local socket whose local address is src and remote
+// address is one of remotes, it's found in /proc/net/{tcp,tcp6} or /proc/net/{udp,udp6}.
+// the remote address of a client socket is the server address, or the original destination of
+// redirected connections. remotes with unspecified ip match any ip, and all remotes match if empty.
+func socketOwner(network string, src net.Addr, remotes ...string) (uid int, inode uint64, err error) {
+	local, ok := parseEndpoint(src.String())
+	if !ok {
+		return 0, 0, errors.New("invalid source address: " + src.String())
+	}
+
+	// connections from other hosts can not be owned by local processes
+	if !isLocalIP(local.ip) {
+		return 0, 0, errNotLocal
+	}
+
+	var rs []endpoint
+	for _, r := range remotes {
+		if e, ok := parseEndpoint(r); ok {
+			rs = append(rs, e)
+		}
+	}
+
+	proto := "tcp"
+	if strings.HasPrefix(network, "udp") || network == "uot" {
+		proto = "udp"
+	}
+
+	files := []string{proto + "6"}
+	if local.ip.To4() != nil {
+		// ipv4 connections of dual stack sockets are listed in the ipv6 file
+		files = []string{proto, proto + "6"}
+	}
+
+	for _, file := range files {
+		uid, inode, err = findSocket("/proc/net/"+file, local, rs, proto == "udp")
+		if err == nil {
+			return
+		}
+	}
+
+	return 0, 0, errors.New("socket not found: " + proto + "://" + src.String())
+}
+
+// isLocalIP reports whether ip is a loopback address or an address of local interfaces.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+
+	localAddrs.Lock()
+	defer localAddrs.Unlock()
+
+	if now := time.Now(); now.After(localAddrs.expire) {
+		localAddrs.ips = make(map[string]bool)
+		if addrs, err := net.InterfaceAddrs(); err == nil {
+			for _, addr := range addrs {
+				if ipnet, ok := addr.(*net.IPNet); ok {
+					localAddrs.ips[ipnet.IP.String()] = true
+				}
+			}
+		}
+		localAddrs.expire = now.Add(localAddrsTTL)
+	}
+
+	return localAddrs.ips[ip.String()]
+}
+
+// findSocket finds the socket with local address local and remote address in remotes in file.
+// for udp, unspecified local address matches any ip, and unconnected sockets match any remote.
+func findSocket(file string, local endpoint, remotes []endpoint, udp bool) (uid int, inode uint64, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	size, unspec := net.IPv4len, net.IPv4zero
+	if strings.HasSuffix(file, "6") {
+		size, unspec = net.IPv6len, net.IPv6unspecified
+	}
+
+	zero := procHexIP(unspec, size)
+	want := procHexIP(local.ip, size) + ":" + procHexPort(local.port)
+	anyIP := zero + ":" + procHexPort(local.port)
+	unconnected := zero + ":0000"
+
+	var rs []string // remote addresses, only port for unspecified ips
+	for _, r := range remotes {
+		if r.ip.IsUnspecified() {
+			rs = append(rs, ":"+procHexPort(r.port))
+		} else if ip := procHexIP(r.ip, size); ip != "" {
+			rs = append(rs, ip+":"+procHexPort(r.port))
+		}
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		if fields[1] != want && !(udp && fields[1] == anyIP) {
+			continue
+		}
+
+		if len(remotes) > 0 && !(udp && fields[2] == unconnected) {
+			matched := false
+			for _, r := range rs {
+				if fields[2] == r || r[0] == ':' && strings.HasSuffix(fields[2], r) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+
+		if uid, err = strconv.Atoi(fields[7]); err != nil {
+			return 0, 0, err
+		}
+		if inode, err = strconv.ParseUint(fields[9], 10, 64); err != nil {
+			return 0, 0, err
+		}
+		return uid, inode, nil
+	}
+
+	if err = scanner.Err(); err == nil {
+		err = errors.New("socket not found")
+	}
+	return 0, 0, err
+}
+
+// procHexPort formats port like the kernel does in /proc/net files.
+func procHexPort(port uint16) string {
+	return strings.ToUpper(strconv.FormatUint(uint64(port)|0x10000, 16)[1:])
+}
+
+// procHexIP formats ip like the kernel does in /proc/net files: 32-bit words in native byte order.
+// size is net.IPv4len or net.IPv6len, "" is returned if ip can not be presented in size.
+func procHexIP(ip net.IP, size int) string {
+	if size == net.IPv4len {
+		ip = ip.To4()
+	} else {
+		ip = ip.To16()
+	}
+	if ip == nil {
+		return ""
+	}
+
+	b := make([]byte, len(ip))
+	for i := 0; i < len(ip); i += 4 {
+		binary.BigEndian.PutUint32(b[i:], nativeEndian.Uint32(ip[i:]))
+	}
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+// socketProcess returns the name and executable path of the process which owns the socket inode.
+func socketProcess(inode uint64) (name, path string, err error) {
+	link := "socket:[" + strconv.FormatUint(inode, 10) + "]"
+
+	now := time.Now()
+	var pids []string
+	procCache.Lock()
+	if e, ok := procCache.sockets[inode]; ok && now.Before(e.expire) {
+		procCache.Unlock()
+		return e.name, e.path, nil
+	}
+	for pid, e := range procCache.m {
+		if now.Before(e.expire) {
+			pids = append(pids, pid)
+		}
+	}
+	procCache.Unlock()
+
+	// check the cached processes first
+	for _, pid := range pids {
+		if hasSocket(pid, link) {
+			procCache.Lock()
+			e, ok := procCache.m[pid]
+			if ok {
+				cacheSocket(inode, e)
+			}
+			procCache.Unlock()
+			if ok {
+				return e.name, e.path, nil
+			}
+		}
+	}
+
+	pid, err := findProcess(link, now.Add(processScanTimeout))
+	if err != nil {
+		return "", "", err
+	}
+
+	if path, err = os.Readlink("/proc/" + pid + "/exe"); err == nil {
+		name = filepath.Base(path)
+	} else {
+		// the exe link of processes of other users can not be read without privilege
+		comm, err := ioutil.ReadFile("/proc/" + pid + "/comm")
+		if err != nil {
+			return "", "", err
+		}
+		name = strings.TrimSpace(string(comm))
+	}
+
+	procCache.Lock()
+	for k, e := range procCache.m {
+		if now.After(e.expire) || len(procCache.m) >= processCacheSize {
+			delete(procCache.m, k)
+		}
+	}
+	e := &procEntry{name: name, path: path, expire: now.Add(processCacheTTL)}
+	procCache.m[pid] = e
+	cacheSocket(inode, e)
+	procCache.Unlock()
+
+	return name, path, nil
+}
+
+// cacheSocket caches the process of socket inode, the caller must hold the lock of procCache.
+func cacheSocket(inode uint64, e *procEntry) {
+	now := time.Now()
+	for k, c := range procCache.sockets {
+		if now.After(c.expire) || len(procCache.sockets) >= processCacheSize*16 {
+			delete(procCache.sockets, k)
+		}
+	}
+	procCache.sockets[inode] = e
+}
+
+// findProcess returns the pid of the process which has a fd of the socket link, e.g. socket:[1234].
+// the scan stops at deadline, as it's in the dial path and the fds of all processes are checked.
+func findProcess(link string, deadline time.Time) (string, error) {
+	pids, err := readDirNames("/proc")
+	if err != nil {
+		return "", err
+	}
+
+	for _, pid := range pids {
+		if pid[0] >= '0' && pid[0] <= '9' && hasSocket(pid, link) {
+			return pid, nil
+		}
+		if time.Now().After(deadline) {
+			return "", errors.New("process lookup timed out of " + link)
+		}
+	}
+
+	return "", errors.New("process not found of " + link)
+}
+
+// hasSocket reports whether the process pid has a fd of the socket link.
+func hasSocket(pid, link string) bool {
+	fds, err := readDirNames("/proc/" + pid + "/fd")
+	if err != nil {
+		return false
+	}
+
+	for _, fd := range fds {
+		if l, err := os.Readlink("/proc/" + pid + "/fd/" + fd); err == nil && l == link {
+			return true
+		}
+	}
+	return false
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
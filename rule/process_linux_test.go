@@ -0,0 +1,102 @@
+package rule
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := func(ip string, port uint16) string {
+		return procHexIP(net.ParseIP(ip), net.IPv4len) + ":" + procHexPort(port)
+	}
+	line := func(sl int, local, remote string, uid, inode int) string {
+		return fmt.Sprintf("%4d: %s %s 01 00000000:00000000 00:00000000 00000000 %5d        0 %d 1 0000000000000000 20 4 30 10 -1\n",
+			sl, local, remote, uid, inode)
+	}
+
+	// the same local address connects to different remotes
+	file := filepath.Join(dir, "tcp")
+	ioutil.WriteFile(file, []byte("  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"+
+		line(0, addr("127.0.0.1", 5000), addr("10.0.0.1", 443), 1000, 101)+
+		line(1, addr("127.0.0.1", 5000), addr("127.0.0.1", 1080), 1001, 102)+
+		line(2, addr("0.0.0.0", 6000), addr("0.0.0.0", 0), 1002, 103)), 0644)
+
+	local := endpoint{net.ParseIP("127.0.0.1"), 5000}
+	tests := []struct {
+		local   endpoint
+		remotes []endpoint
+		udp     bool
+		inode   uint64
+	}{
+		{local, nil, false, 101},
+		{local, []endpoint{{net.ParseIP("127.0.0.1"), 1080}}, false, 102},
+		{local, []endpoint{{net.ParseIP("0.0.0.0"), 1080}}, false, 102}, // server listens on all addresses
+		{local, []endpoint{{net.ParseIP("10.0.0.2"), 443}, {net.ParseIP("10.0.0.1"), 443}}, false, 101},
+		{local, []endpoint{{net.ParseIP("10.0.0.1"), 80}}, false, 0},
+		{endpoint{net.ParseIP("127.0.0.1"), 6000}, []endpoint{{net.ParseIP("127.0.0.1"), 53}}, true, 103}, // unconnected udp
+		{endpoint{net.ParseIP("127.0.0.1"), 6000}, nil, false, 0},
+	}
+
+	for _, tt := range tests {
+		_, inode, err := findSocket(file, tt.local, tt.remotes, tt.udp)
+		if inode != tt.inode || (err == nil) != (tt.inode != 0) {
+			t.Errorf("findSocket(%v, %v, udp %v) = %d, %v, want %d", tt.local, tt.remotes, tt.udp, inode, err, tt.inode)
+		}
+	}
+}
+
+func TestSocketOwner(t *testing.T) {
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		t.Skip("no /proc/net/tcp")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	uid, inode, err := socketOwner("tcp", c.LocalAddr(), l.Addr().String(), "1.2.3.4:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid != os.Getuid() {
+		t.Errorf("uid = %d, want %d", uid, os.Getuid())
+	}
+
+	exe, _ := os.Executable()
+	for i := 0; i < 2; i++ { // the second lookup is cached
+		name, path, err := socketProcess(inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != filepath.Base(exe) || path != exe {
+			t.Errorf("process = %s, %s, want %s", name, path, exe)
+		}
+	}
+
+	// the socket of the server side has a different remote address
+	if _, _, err := socketOwner("tcp", c.LocalAddr(), "1.2.3.4:443"); err == nil {
+		t.Error("socket with other remote address: expected error")
+	}
+
+	if _, _, err := socketOwner("tcp", &net.TCPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 1234}); err != errNotLocal {
+		t.Errorf("remote client: err = %v, want %v", err, errNotLocal)
+	}
+}
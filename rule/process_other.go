@@ -0,0 +1,18 @@
+// +build !linux
+
+package rule
+
+import (
+	"errors"
+	"net"
+)
+
+var errProcessUnsupported = errors.New("process lookup is only supported on linux")
+
+func socketOwner(network string, src net.Addr, remotes ...string) (uid int, inode uint64, err error) {
+	return 0, 0, errProcessUnsupported
+}
+
+func socketProcess(inode uint64) (name, path string, err error) {
+	return "", "", errProcessUnsupported
+}
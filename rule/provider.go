@@ -0,0 +1,355 @@
+package rule
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nadoo/glider/common/fileutil"
+	"github.com/nadoo/glider/common/log"
+	"github.com/nadoo/glider/strategy"
+)
+
+// Formats of rule providers.
+const (
+	FormatDomain    = "domain"    // a domain pattern per line
+	FormatIPCIDR    = "ipcidr"    // an ip or cidr per line
+	FormatClassical = "classical" // TYPE,VALUE per line, e.g. DOMAIN-SUFFIX,example.com
+)
+
+const (
+	providerInterval = 24 * time.Hour
+	providerRetry    = 5 * time.Minute
+	providerTimeout  = 30 * time.Second
+	providerMaxSize  = 32 << 20
+)
+
+// provider is a rule list loaded from a remote url, cached on disk and updated periodically.
+type provider struct {
+	name     string
+	url      string
+	format   string // empty: detect the format of each line
+	interval time.Duration
+	path     string // cache file
+	via      string // group to fetch the list through, empty: the owner group
+
+	proxy   *strategy.Proxy // owner group, the proxy of matched connections
+	config  *strategy.Config
+	dialer  *strategy.Proxy
+	rules   atomic.Value // *providerRules
+	updated time.Time    // time of the cached rules
+}
+
+// providerRules is the rules loaded from a provider.
+type providerRules struct {
+	domains *DomainMatcher
+	cidrs   cidrTree
+}
+
+// newProvider parses a provider of rule file ruleFile,
+// format: URL[#name=NAME&format=FORMAT&interval=DURATION&via=GROUP&path=FILE].
+func newProvider(s, ruleFile string, sd *strategy.Proxy) (*provider, error) {
+	pv := &provider{url: s, interval: providerInterval, proxy: sd}
+	if i := strings.IndexByte(s, '#'); i != -1 {
+		pv.url = s[:i]
+
+		query, err := url.ParseQuery(s[i+1:])
+		if err != nil {
+			return nil, err
+		}
+
+		pv.name = query.Get("name")
+		pv.format = strings.ToLower(query.Get("format"))
+		pv.via = query.Get("via")
+		pv.path = query.Get("path")
+
+		if v := query.Get("interval"); v != "" {
+			if pv.interval, err = time.ParseDuration(v); err != nil {
+				return nil, err
+			}
+			if pv.interval < time.Minute {
+				pv.interval = time.Minute
+			}
+		}
+	}
+
+	u, err := url.Parse(pv.url)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("unsupported provider url: " + pv.url)
+	}
+
+	switch pv.format {
+	case "", FormatDomain, FormatIPCIDR, FormatClassical:
+	default:
+		return nil, errors.New("unknown provider format: " + pv.format)
+	}
+
+	if pv.name == "" {
+		base := path.Base(u.Path)
+		pv.name = strings.TrimSuffix(base, path.Ext(base))
+		if pv.name == "" || pv.name == "." || pv.name == "/" {
+			pv.name = u.Hostname()
+		}
+	}
+
+	if pv.path == "" {
+		pv.path = filepath.Join("providers", pv.name+".list")
+	}
+	if !filepath.IsAbs(pv.path) {
+		pv.path = filepath.Join(filepath.Dir(ruleFile), pv.path)
+	}
+
+	pv.rules.Store(&providerRules{domains: NewDomainMatcher()})
+
+	return pv, nil
+}
+
+// matchDomain returns the proxy and the pattern matched by domain, nil if not found.
+func (pv *provider) matchDomain(domain string, accept func(value interface{}) bool) (*strategy.Proxy, string) {
+	rules := pv.rules.Load().(*providerRules)
+	if proxy, typ, pattern := rules.domains.MatchFunc(domain, accept); proxy != nil {
+		if typ != MatchDomain {
+			pattern = typ + ":" + pattern
+		}
+		return proxy.(*strategy.Proxy), pattern
+	}
+	return nil, ""
+}
+
+// matchIP returns the proxy and the cidr matched by ip, nil if not found.
+func (pv *provider) matchIP(ip net.IP, accept func(value interface{}) bool) (*strategy.Proxy, string) {
+	rules := pv.rules.Load().(*providerRules)
+	if proxy, cidr := rules.cidrs.LookupFunc(ip, accept); proxy != nil {
+		return proxy.(*strategy.Proxy), cidr.String()
+	}
+	return nil, ""
+}
+
+// loadCache loads the rules from the cache file.
+func (pv *provider) loadCache() error {
+	fi, err := os.Stat(pv.path)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(pv.path)
+	if err != nil {
+		return err
+	}
+
+	rules, err := pv.parse(data)
+	if err != nil {
+		return err
+	}
+	pv.rules.Store(rules)
+	pv.updated = fi.ModTime()
+
+	log.F("[rule] provider %s: loaded %d domains and %d cidrs from %s",
+		pv.name, rules.domains.Len(), rules.cidrs.Len(), pv.path)
+
+	return nil
+}
+
+// run updates the rules periodically, the first update is after the cached rules expired.
+func (pv *provider) run() {
+	next := pv.updated.Add(pv.interval)
+	for {
+		time.Sleep(time.Until(next))
+
+		if err := pv.update(); err != nil {
+			retry := providerRetry
+			if retry > pv.interval {
+				retry = pv.interval
+			}
+			log.F("[rule] provider %s: update error: %v, use the cached rules and retry in %s", pv.name, err, retry)
+			next = time.Now().Add(retry)
+			continue
+		}
+
+		next = time.Now().Add(pv.interval)
+	}
+}
+
+// update fetches the rules, replaces the current rules and the cache file with them if they're valid.
+func (pv *provider) update() error {
+	data, err := pv.fetch()
+	if err != nil {
+		return err
+	}
+
+	rules, err := pv.parse(data)
+	if err != nil {
+		return err
+	}
+	pv.rules.Store(rules)
+
+	log.F("[rule] provider %s: updated %d domains and %d cidrs from %s",
+		pv.name, rules.domains.Len(), rules.cidrs.Len(), pv.url)
+
+	if err := fileutil.WriteFileAtomic(pv.path, data, 0644); err != nil {
+		log.F("[rule] provider %s: save cache error: %v", pv.name, err)
+	}
+
+	return nil
+}
+
+// fetch downloads the list through the forwarders of the dialer group.
+func (pv *provider) fetch() ([]byte, error) {
+	client := &http.Client{
+		Timeout: providerTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				c, _, err := pv.dialer.Dial(network, addr, nil)
+				return c, err
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	resp, err := client.Get(pv.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected http status: " + resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, providerMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > providerMaxSize {
+		return nil, errors.New("rule list too large")
+	}
+
+	return data, nil
+}
+
+// parse parses the rule list, it fails if there's no valid rule or most of the lines are invalid.
+// the yaml "payload:" list of clash rule providers is also supported.
+func (pv *provider) parse(data []byte) (*providerRules, error) {
+	rules := &providerRules{domains: NewDomainMatcher()}
+
+	var valid, invalid int
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || strings.HasPrefix(line, "//") || line == "payload:" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "- ") {
+			line = strings.Trim(strings.TrimSpace(line[2:]), `'"`)
+		}
+
+		if err := pv.addRule(rules, line); err != nil {
+			if err != errUnsupportedRule {
+				invalid++
+			}
+			continue
+		}
+		valid++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if valid == 0 || invalid > valid {
+		return nil, fmt.Errorf("invalid rule list: %d valid and %d invalid lines", valid, invalid)
+	}
+
+	return rules, nil
+}
+
+var errUnsupportedRule = errors.New("unsupported rule")
+
+// addRule adds a rule line to rules.
+func (pv *provider) addRule(rules *providerRules, line string) error {
+	format := pv.format
+	if format == "" {
+		switch {
+		case strings.IndexByte(line, ',') != -1:
+			format = FormatClassical
+		case parseCIDR(line) != nil:
+			format = FormatIPCIDR
+		default:
+			format = FormatDomain
+		}
+	}
+
+	switch format {
+	case FormatIPCIDR:
+		cidr := parseCIDR(line)
+		if cidr == nil {
+			return errors.New("invalid cidr: " + line)
+		}
+		rules.cidrs.Insert(cidr, pv.proxy)
+		return nil
+
+	case FormatClassical:
+		fields := strings.Split(line, ",")
+		if len(fields) < 2 {
+			return errors.New("invalid rule: " + line)
+		}
+
+		v := strings.TrimSpace(fields[1])
+		switch strings.ToUpper(strings.TrimSpace(fields[0])) {
+		case RuleDomain:
+			return rules.domains.Add(MatchFull+":"+v, pv.proxy)
+		case RuleDomainSuffix:
+			return rules.domains.Add(v, pv.proxy)
+		case RuleDomainKeyword:
+			return rules.domains.Add(MatchKeyword+":"+v, pv.proxy)
+		case RuleDomainRegex:
+			return rules.domains.Add(MatchRegexp+":"+v, pv.proxy)
+		case RuleIPCIDR, RuleIPCIDR6:
+			if cidr := parseCIDR(v); cidr != nil {
+				rules.cidrs.Insert(cidr, pv.proxy)
+				return nil
+			}
+			return errors.New("invalid cidr: " + line)
+		}
+		return errUnsupportedRule
+
+	default:
+		// "+.example.com" and ".example.com" in clash lists are matched as domain suffixes
+		line = strings.TrimPrefix(strings.TrimPrefix(line, "+"), ".")
+		if typ, v := ParsePattern(line); typ != MatchRegexp && strings.ContainsAny(v, " \t*/<>'\"=;") {
+			return errors.New("invalid domain: " + line)
+		}
+		return rules.domains.Add(line, pv.proxy)
+	}
+}
+
+// parseCIDR parses a cidr or an ip, nil if it's invalid.
+func parseCIDR(s string) *net.IPNet {
+	if _, cidr, err := net.ParseCIDR(s); err == nil {
+		return cidr
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+	}
+	return nil
+}
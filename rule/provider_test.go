@@ -0,0 +1,156 @@
+package rule
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nadoo/glider/strategy"
+)
+
+// listServer serves the body of the current list, 500 if it's empty.
+type listServer struct {
+	body string
+}
+
+func (s *listServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.body == "" {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(s.body))
+}
+
+func newTestProvider(t *testing.T, url, dir string) (*provider, *strategy.Proxy) {
+	t.Helper()
+
+	cfg := &strategy.Config{Strategy: "rr", CheckWebSite: "www.example.com"}
+	owner := strategy.NewProxy("owner", nil, cfg)
+
+	pv, err := newProvider(url+"#name=test", filepath.Join(dir, "test.rule"), owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pv.config = cfg
+	pv.dialer = strategy.NewProxy(GroupDirect, nil, cfg)
+
+	return pv, owner
+}
+
+func checkDomain(t *testing.T, pv *provider, domain string, want *strategy.Proxy) {
+	t.Helper()
+	if got, _ := pv.matchDomain(domain, nil); got != want {
+		t.Errorf("matchDomain(%q) = %v, want %v", domain, got, want)
+	}
+}
+
+func TestProviderUpdate(t *testing.T) {
+	ls := &listServer{body: "example.com\n# comment\nfull:www.example.org\n"}
+	ts := httptest.NewServer(ls)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "provider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pv, owner := newTestProvider(t, ts.URL+"/list.txt", dir)
+	checkDomain(t, pv, "www.example.com", nil)
+
+	if err := pv.update(); err != nil {
+		t.Fatal(err)
+	}
+	checkDomain(t, pv, "www.example.com", owner)
+	checkDomain(t, pv, "www.example.org", owner)
+	checkDomain(t, pv, "example.org", nil)
+
+	// the cache file is written and no temporary file is left
+	files, err := ioutil.ReadDir(filepath.Join(dir, "providers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "test.list" {
+		t.Errorf("%d files in cache dir, want test.list only", len(files))
+	}
+
+	// a new valid list replaces the old one
+	ls.body = "IP-CIDR,10.0.0.0/8\nDOMAIN-SUFFIX,example.net\n"
+	if err := pv.update(); err != nil {
+		t.Fatal(err)
+	}
+	checkDomain(t, pv, "www.example.com", nil)
+	checkDomain(t, pv, "www.example.net", owner)
+	if got, _ := pv.matchIP(net.ParseIP("10.1.2.3"), nil); got != owner {
+		t.Errorf("matchIP(10.1.2.3) = %v, want %v", got, owner)
+	}
+}
+
+func TestProviderInvalidList(t *testing.T) {
+	ls := &listServer{body: "example.com\n"}
+	ts := httptest.NewServer(ls)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "provider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pv, owner := newTestProvider(t, ts.URL+"/list.txt", dir)
+	if err := pv.update(); err != nil {
+		t.Fatal(err)
+	}
+
+	// most of the lines are invalid, e.g. an html error page
+	ls.body = "<html>\n<body>not found</body>\n</html>\nexample.org\n"
+	if err := pv.update(); err == nil {
+		t.Fatal("update with an invalid list should fail")
+	}
+	checkDomain(t, pv, "www.example.com", owner)
+	checkDomain(t, pv, "www.example.org", nil)
+
+	// the cache file is not replaced
+	data, err := ioutil.ReadFile(pv.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "example.com\n" {
+		t.Errorf("cache file is replaced by an invalid list: %q", data)
+	}
+}
+
+func TestProviderFetchFailure(t *testing.T) {
+	ls := &listServer{body: "example.com\n"}
+	ts := httptest.NewServer(ls)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "provider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pv, _ := newTestProvider(t, ts.URL+"/list.txt", dir)
+	if err := pv.update(); err != nil {
+		t.Fatal(err)
+	}
+
+	// restart with the list server down, the cached list is used
+	ls.body = ""
+	pv, owner := newTestProvider(t, ts.URL+"/list.txt", dir)
+	if err := pv.loadCache(); err != nil {
+		t.Fatal(err)
+	}
+	if pv.updated.IsZero() {
+		t.Error("updated time of the cached list is not set")
+	}
+	if err := pv.update(); err == nil {
+		t.Fatal("update should fail when the server is down")
+	}
+	checkDomain(t, pv, "www.example.com", owner)
+}
@@ -1,109 +1,577 @@
 package rule
 
 import (
+	"errors"
 	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/nadoo/glider/common/log"
 	"github.com/nadoo/glider/proxy"
 	"github.com/nadoo/glider/strategy"
 )
 
+// domainIPGrace is the extra time to keep a domain ip after its dns ttl expired,
+// as clients may still connect to it for a while.
+const domainIPGrace = 5 * time.Minute
+
+// domainIPSweepInterval is the interval to remove expired domain ips.
+const domainIPSweepInterval = time.Minute
+
+// domainIP is an ip learned from the dns answer of a domain in rules.
+type domainIP struct {
+	proxy  *strategy.Proxy
+	domain string // the domain resolved
+	typ    string // matcher type of the matched rule
+	value  string // matcher value of the matched rule
+	rule   string // the matched ordered rule, empty in the default mode
+	expire int64  // unix nano, protected by domainIPMu of proxy
+}
+
+// portRange is a range of destination ports in rules.
+type portRange struct {
+	from, to uint16
+	proxy    *strategy.Proxy
+}
+
+// Stats is the statistics of rules.
+type Stats struct {
+	Domains   int `json:"domains"`   // domains in rules
+	IPs       int `json:"ips"`       // ips in rules
+	CIDRs     int `json:"cidrs"`     // cidrs in rules
+	GeoIPs    int `json:"geoips"`    // countries in rules
+	DomainIPs int `json:"domainips"` // ips learned from dns answers of domains in rules
+}
+
 // Proxy struct.
 type Proxy struct {
 	proxy   *strategy.Proxy
 	proxies []*strategy.Proxy
 
-	domainMap sync.Map
-	ipMap     sync.Map
-	cidrMap   sync.Map
+	domains  *DomainMatcher
+	ipMap    sync.Map
+	cidrTree cidrTree
+	geoip    *GeoIP
+	geoipMap map[string]*strategy.Proxy // country: proxy
+
+	ports      []portRange
+	networkMap map[string]*strategy.Proxy
+	inboundMap map[string]*strategy.Proxy
+	processMap map[string]*strategy.Proxy // process name or path: proxy
+	uidMap     map[string]*strategy.Proxy
+	srcIPMap   map[string]*strategy.Proxy
+	srcCIDRs   cidrTree
+
+	groups  map[string]*strategy.Proxy // group name: proxy
+	ordered []*OrderedRule
+
+	providers   []*provider
+	providerMap map[string]*provider // provider name: provider
+
+	schedules map[*strategy.Proxy]Schedule
+	accept    func(v interface{}) bool // nil if there's no schedule
+
+	domainIPMu  sync.RWMutex
+	domainIPMap map[string]*domainIP // ip: *domainIP
+	stats       Stats
 }
 
-// NewProxy returns a new rule proxy.
-func NewProxy(rules []*Config, proxy *strategy.Proxy) *Proxy {
-	rd := &Proxy{proxy: proxy}
+// NewProxy returns a new rule proxy, geoip can be nil if there's no geoip database.
+func NewProxy(rules []*Config, proxy *strategy.Proxy, geoip *GeoIP) *Proxy {
+	rd := &Proxy{
+		proxy:      proxy,
+		domains:    NewDomainMatcher(),
+		geoip:      geoip,
+		geoipMap:   make(map[string]*strategy.Proxy),
+		networkMap: make(map[string]*strategy.Proxy),
+		inboundMap: make(map[string]*strategy.Proxy),
+		processMap: make(map[string]*strategy.Proxy),
+		uidMap:     make(map[string]*strategy.Proxy),
+		srcIPMap:   make(map[string]*strategy.Proxy),
+		groups:     map[string]*strategy.Proxy{GroupDefault: proxy},
+		schedules:  make(map[*strategy.Proxy]Schedule),
+
+		domainIPMap: make(map[string]*domainIP),
+
+		providerMap: make(map[string]*provider),
+	}
+
+	// the rule file of each rule, to warn about the same rule in different rule files
+	owners := make(map[string]string)
+	claim := func(rule, file string, lastWins bool) {
+		if old, ok := owners[rule]; ok && old != file {
+			used := old
+			if lastWins {
+				used = file
+			}
+			log.F("[rule] WARNING: %s is in both %s and %s, %s is used", rule, old, file, used)
+		}
+		if _, ok := owners[rule]; !ok || lastWins {
+			owners[rule] = file
+		}
+	}
 
 	for _, r := range rules {
 		sd := strategy.NewProxy(r.Name, r.Forward, &r.StrategyConfig)
 		rd.proxies = append(rd.proxies, sd)
 
+		for _, s := range r.Subscription {
+			if !strings.Contains(s, "://") && !filepath.IsAbs(s) {
+				s = filepath.Join(filepath.Dir(r.Name), s)
+			}
+			if err := sd.Subscribe(s, filepath.Dir(r.Name)); err != nil {
+				log.F("[rule] invalid subscription %s in %s: %v", s, r.Name, err)
+			}
+		}
+
+		if len(r.Schedule) > 0 {
+			var schedule Schedule
+			for _, w := range r.Schedule {
+				if err := schedule.Add(w); err != nil {
+					log.F("[rule] %v in %s", err, r.Name)
+				}
+			}
+			rd.schedules[sd] = schedule
+			rd.accept = rd.active
+		}
+
+		name := groupName(r.Name)
+		if _, ok := rd.groups[name]; ok {
+			log.F("[rule] WARNING: group %s of %s already exists, ignored in ordered rules", name, r.Name)
+		} else {
+			rd.groups[name] = sd
+		}
+
 		for _, domain := range r.Domain {
-			rd.domainMap.Store(strings.ToLower(domain), sd)
+			if err := rd.domains.Add(domain, sd); err != nil {
+				log.F("[rule] invalid domain rule %s: %v", domain, err)
+				continue
+			}
+			if typ, v := ParsePattern(domain); typ == MatchDomain {
+				claim("domain="+v, r.Name, true)
+			} else {
+				claim("domain="+typ+":"+v, r.Name, typ == MatchFull)
+			}
 		}
 
 		for _, ip := range r.IP {
 			rd.ipMap.Store(ip, sd)
+			claim("ip="+ip, r.Name, true)
 		}
+		rd.stats.IPs += len(r.IP)
 
 		for _, s := range r.CIDR {
 			if _, cidr, err := net.ParseCIDR(s); err == nil {
-				rd.cidrMap.Store(cidr, sd)
+				rd.cidrTree.Insert(cidr, sd)
+				claim("cidr="+cidr.String(), r.Name, true)
+			}
+		}
+
+		for _, country := range r.GeoIP {
+			if geoip == nil {
+				log.F("[rule] geoip database not specified, ignore rule: geoip=%s", country)
+				continue
+			}
+			rd.geoipMap[strings.ToUpper(country)] = sd
+			claim("geoip="+strings.ToUpper(country), r.Name, true)
+		}
+
+		for _, port := range append(r.Port, r.PortRange...) {
+			from, to, err := parsePortRange(port)
+			if err != nil {
+				log.F("[rule] invalid port rule %s: %v", port, err)
+				continue
+			}
+			rd.ports = append(rd.ports, portRange{from: from, to: to, proxy: sd})
+			claim("port="+port, r.Name, false)
+		}
+
+		for _, network := range r.Network {
+			rd.networkMap[strings.ToLower(network)] = sd
+			claim("network="+strings.ToLower(network), r.Name, true)
+		}
+
+		for _, inbound := range r.Inbound {
+			rd.inboundMap[inbound] = sd
+			claim("inbound="+inbound, r.Name, true)
+		}
+
+		for _, process := range r.Process {
+			rd.processMap[process] = sd
+			claim("process="+process, r.Name, true)
+		}
+
+		for _, s := range r.UID {
+			uid, err := lookupUID(s)
+			if err != nil {
+				log.F("[rule] invalid uid %s in %s: %v", s, r.Name, err)
+				continue
 			}
+			rd.uidMap[uid] = sd
+			claim("uid="+uid, r.Name, true)
+		}
+
+		for _, s := range r.SrcIP {
+			if ip := net.ParseIP(s); ip != nil {
+				rd.srcIPMap[ip.String()] = sd
+				claim("srcip="+ip.String(), r.Name, true)
+			}
+		}
+
+		for _, s := range r.SrcCIDR {
+			if _, cidr, err := net.ParseCIDR(s); err == nil {
+				rd.srcCIDRs.Insert(cidr, sd)
+				claim("srccidr="+cidr.String(), r.Name, true)
+			}
+		}
+
+		for _, s := range r.Provider {
+			pv, err := newProvider(s, r.Name, sd)
+			if err != nil {
+				log.F("[rule] invalid provider %s in %s: %v", s, r.Name, err)
+				continue
+			}
+			if _, ok := rd.providerMap[pv.name]; ok {
+				log.F("[rule] WARNING: provider %s in %s already exists, ignored", pv.name, r.Name)
+				continue
+			}
+			pv.config = &r.StrategyConfig
+			rd.providers = append(rd.providers, pv)
+			rd.providerMap[pv.name] = pv
+		}
+	}
+
+	for _, pv := range rd.providers {
+		switch pv.via {
+		case "":
+			pv.dialer = pv.proxy
+		case GroupDirect:
+			cfg := *pv.config
+			pv.dialer = strategy.NewProxy(GroupDirect, nil, &cfg)
+		default:
+			if pv.dialer = rd.groups[pv.via]; pv.dialer == nil {
+				log.F("[rule] WARNING: unknown group %s of provider %s, use %s instead", pv.via, pv.name, pv.proxy.Name())
+				pv.dialer = pv.proxy
+			}
+		}
+
+		if err := pv.loadCache(); err != nil && !os.IsNotExist(err) {
+			log.F("[rule] provider %s: load cache error: %v", pv.name, err)
 		}
 	}
 
+	rd.stats.Domains = rd.domains.Len()
+	rd.stats.CIDRs = rd.cidrTree.Len()
+	rd.stats.GeoIPs = len(rd.geoipMap)
+	rd.sweep()
+
+	log.F("[rule] loaded %d domains, %d ips, %d cidrs and %d geoips", rd.stats.Domains, rd.stats.IPs, rd.stats.CIDRs, rd.stats.GeoIPs)
+
 	return rd
 }
 
 // Dial dials to targer addr and return a conn.
-func (p *Proxy) Dial(network, addr string) (net.Conn, proxy.Dialer, error) {
-	return p.nextProxy(addr).Dial(network, addr)
+func (p *Proxy) Dial(network, addr string, sess *proxy.Session) (net.Conn, proxy.Dialer, error) {
+	return p.nextProxy(network, addr, sess).Dial(network, addr, sess)
 }
 
 // DialUDP connects to the given address via the proxy.
-func (p *Proxy) DialUDP(network, addr string) (pc net.PacketConn, writeTo net.Addr, err error) {
-	return p.nextProxy(addr).DialUDP(network, addr)
+func (p *Proxy) DialUDP(network, addr string, sess *proxy.Session) (pc net.PacketConn, writeTo net.Addr, err error) {
+	return p.nextProxy(network, addr, sess).DialUDP(network, addr, sess)
 }
 
 // nextProxy return next proxy according to rule.
-func (p *Proxy) nextProxy(dstAddr string) *strategy.Proxy {
-	host, _, err := net.SplitHostPort(dstAddr)
+func (p *Proxy) nextProxy(network, dstAddr string, sess *proxy.Session) *strategy.Proxy {
+	return p.match(network, dstAddr, sess, nil)
+}
+
+// match returns the proxy according to rule and fills e if it's not nil, the most specific rule wins:
+// destination rules(ip > cidr > provider cidr > geoip > domain > provider domain) first, then
+// connection rules(process > uid > srcip > srccidr > inbound > port > network).
+func (p *Proxy) match(network, dstAddr string, sess *proxy.Session, e *Explanation) *strategy.Proxy {
+	host, port, err := net.SplitHostPort(dstAddr)
 	if err != nil {
 		// TODO: check here
 		// logf("[rule] SplitHostPort ERROR: %s", err)
-		return p.proxy
+		return e.set(p.proxy, MatchDefault, "")
+	}
+
+	if len(p.ordered) > 0 {
+		if proxy, r := p.orderedProxy(network, host, port, sess); proxy != nil {
+			if e != nil {
+				e.set(proxy, r.Type, r.Value)
+				e.Rule = r.String()
+				if ip := net.ParseIP(host); ip != nil && r.isDomainRule() {
+					// RULE-SET rules may match the ip itself
+					matchedIP := false
+					if r.Type == RuleSet {
+						sd, _ := p.providerMap[r.Value].matchIP(ip, nil)
+						matchedIP = sd != nil
+					}
+					if !matchedIP {
+						e.Domain, e.DomainIP = p.resolvedDomain(ip), true
+					}
+				}
+			}
+			return proxy
+		}
+		return e.set(p.proxy, MatchDefault, "")
+	}
+
+	if proxy := p.dstProxy(host, e); proxy != nil {
+		return proxy
+	}
+
+	if proxy := p.connProxy(network, host, port, sess, e); proxy != nil {
+		return proxy
 	}
 
-	// find ip
+	return e.set(p.proxy, MatchDefault, "")
+}
+
+// dstProxy returns the proxy matched by the destination host, nil if not found.
+func (p *Proxy) dstProxy(host string, e *Explanation) *strategy.Proxy {
 	if ip := net.ParseIP(host); ip != nil {
 		// check ip
-		if proxy, ok := p.ipMap.Load(ip.String()); ok {
+		key := ip.String()
+		if proxy, ok := p.ipMap.Load(key); ok && p.active(proxy) {
+			return e.set(proxy.(*strategy.Proxy), MatchIP, key)
+		}
+
+		// check ips learned from dns answers
+		if dip := p.domainIP(key); dip != nil {
+			if p.active(dip.proxy) {
+				if e != nil {
+					e.set(dip.proxy, dip.typ, dip.value)
+					e.Domain, e.DomainIP = dip.domain, true
+				}
+				return dip.proxy
+			}
+
+			// the rule is not active now, check the other domain rules
+			if proxy, typ, pattern := p.matchDomain(dip.domain, p.accept); proxy != nil {
+				if e != nil {
+					e.set(proxy, typ, pattern)
+					e.Domain, e.DomainIP = dip.domain, true
+				}
+				return proxy
+			}
+		}
+
+		// check cidr, the most specific one wins
+		if proxy, cidr := p.cidrTree.LookupFunc(ip, p.accept); proxy != nil {
+			if e != nil {
+				e.set(proxy.(*strategy.Proxy), MatchCIDR, cidr.String())
+			}
 			return proxy.(*strategy.Proxy)
 		}
 
-		var ret *strategy.Proxy
-		// check cidr
-		p.cidrMap.Range(func(key, value interface{}) bool {
-			cidr := key.(*net.IPNet)
-			if cidr.Contains(ip) {
-				ret = value.(*strategy.Proxy)
-				return false
+		// check cidrs of providers
+		for _, pv := range p.providers {
+			if proxy, cidr := pv.matchIP(ip, p.accept); proxy != nil {
+				return e.set(proxy, MatchProvider, pv.name+","+cidr)
+			}
+		}
+
+		// check country in geoip database
+		if len(p.geoipMap) > 0 {
+			country := p.geoip.Lookup(ip)
+			if proxy, ok := p.geoipMap[country]; ok && p.active(proxy) {
+				return e.set(proxy, MatchGeoIP, country)
 			}
+		}
+	}
 
-			return true
-		})
+	if proxy, typ, pattern := p.matchDomain(host, p.accept); proxy != nil {
+		return e.set(proxy, typ, pattern)
+	}
+
+	return nil
+}
+
+// matchDomain returns the proxy, matcher type and value of the domain rules or providers matched by
+// domain, nil if not found.
+func (p *Proxy) matchDomain(domain string, accept func(v interface{}) bool) (*strategy.Proxy, string, string) {
+	if proxy, typ, pattern := p.domains.MatchFunc(domain, accept); proxy != nil {
+		return proxy.(*strategy.Proxy), typ, pattern
+	}
 
-		if ret != nil {
-			return ret
+	for _, pv := range p.providers {
+		if proxy, pattern := pv.matchDomain(domain, accept); proxy != nil {
+			return proxy, MatchProvider, pv.name + "," + pattern
 		}
+	}
+
+	return nil, "", ""
+}
+
+// connProxy returns the proxy matched by the source, inbound, port and network of session, nil if not found.
+// these rules only apply to connections from servers, not the queries of dns server.
+func (p *Proxy) connProxy(network, host, port string, sess *proxy.Session, e *Explanation) *strategy.Proxy {
+	if sess == nil {
+		return nil
+	}
+
+	if sess.Src != nil && (len(p.processMap) > 0 || len(p.uidMap) > 0) {
+		if proxy := p.ownerProxy(network, net.JoinHostPort(host, port), sess, e); proxy != nil {
+			return proxy
+		}
+	}
+
+	if sess.Src != nil && (len(p.srcIPMap) > 0 || p.srcCIDRs.Len() > 0) {
+		if proxy := p.srcProxy(sess.Src, e); proxy != nil {
+			return proxy
+		}
+	}
+
+	if proxy, ok := p.inboundMap[sess.Inbound]; ok && p.active(proxy) {
+		return e.set(proxy, MatchInbound, sess.Inbound)
+	}
+
+	if len(p.ports) > 0 {
+		if n, err := strconv.ParseUint(port, 10, 16); err == nil {
+			for _, r := range p.ports {
+				if uint16(n) >= r.from && uint16(n) <= r.to && p.active(r.proxy) {
+					if e != nil {
+						v := strconv.Itoa(int(r.from))
+						if r.to != r.from {
+							v += "-" + strconv.Itoa(int(r.to))
+						}
+						e.set(r.proxy, MatchPort, v)
+					}
+					return r.proxy
+				}
+			}
+		}
+	}
+
+	if len(p.networkMap) > 0 {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			network = "tcp"
+		case "udp", "udp4", "udp6", "uot":
+			network = "udp"
+		}
+		if proxy, ok := p.networkMap[network]; ok && p.active(proxy) {
+			return e.set(proxy, MatchNetwork, network)
+		}
+	}
+
+	return nil
+}
 
+// srcProxy returns the proxy matched by the source ip, nil if not found.
+func (p *Proxy) srcProxy(src net.Addr, e *Explanation) *strategy.Proxy {
+	host, _, err := net.SplitHostPort(src.String())
+	if err != nil {
+		return nil
 	}
 
-	host = strings.ToLower(host)
-	for i := len(host); i != -1; {
-		i = strings.LastIndexByte(host[:i], '.')
-		if proxy, ok := p.domainMap.Load(host[i+1:]); ok {
+	if ip := net.ParseIP(host); ip != nil {
+		if proxy, ok := p.srcIPMap[ip.String()]; ok && p.active(proxy) {
+			return e.set(proxy, MatchSrcIP, ip.String())
+		}
+		if proxy, cidr := p.srcCIDRs.LookupFunc(ip, p.accept); proxy != nil {
+			if e != nil {
+				e.set(proxy.(*strategy.Proxy), MatchSrcCIDR, cidr.String())
+			}
 			return proxy.(*strategy.Proxy)
 		}
 	}
 
-	return p.proxy
+	return nil
+}
+
+// ownerProxy returns the proxy matched by the local process which owns the source socket, nil if not found.
+// the remote address of the socket is the server address or dstAddr if it's redirected, any remote
+// address is matched if the server address is unknown, e.g. sessions to explain.
+func (p *Proxy) ownerProxy(network, dstAddr string, sess *proxy.Session, e *Explanation) *strategy.Proxy {
+	var remotes []string
+	if sess.Local != nil {
+		remotes = []string{sess.Local.String(), dstAddr}
+	}
+
+	uid, inode, err := socketOwner(network, sess.Src, remotes...)
+	if err != nil {
+		return nil
+	}
+
+	if len(p.processMap) > 0 {
+		if name, path, err := socketProcess(inode); err == nil {
+			if proxy, ok := p.processMap[path]; ok && path != "" && p.active(proxy) {
+				return e.set(proxy, MatchProcess, path)
+			}
+			if proxy, ok := p.processMap[name]; ok && p.active(proxy) {
+				return e.set(proxy, MatchProcess, name)
+			}
+		}
+	}
+
+	if proxy, ok := p.uidMap[strconv.Itoa(uid)]; ok && p.active(proxy) {
+		return e.set(proxy, MatchUID, strconv.Itoa(uid))
+	}
+
+	return nil
+}
+
+// lookupUID returns the user id of a user id or user name.
+func lookupUID(s string) (string, error) {
+	if _, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return s, nil
+	}
+	u, err := user.Lookup(s)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+// parsePortRange parses "PORT" or "FROM-TO".
+func parsePortRange(s string) (from, to uint16, err error) {
+	f, t := s, s
+	if i := strings.IndexByte(s, '-'); i != -1 {
+		f, t = s[:i], s[i+1:]
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(f), 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	m, err := strconv.ParseUint(strings.TrimSpace(t), 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if n > m {
+		return 0, 0, errors.New("invalid port range")
+	}
+
+	return uint16(n), uint16(m), nil
+}
+
+// NextDialer return next dialer according to rule, network is assumed to be tcp.
+func (p *Proxy) NextDialer(dstAddr string, sess *proxy.Session) proxy.Dialer {
+	return p.nextProxy("tcp", dstAddr, sess).NextDialer(dstAddr, sess)
+}
+
+// Route is the group of forwarders which a destination is routed to.
+type Route struct {
+	Group  string // name of the group
+	Direct bool   // the group connects directly
+	Reject bool   // the group rejects connections
+	Server bool   // the destination host is a forwarder server of the group
 }
 
-// NextDialer return next dialer according to rule.
-func (p *Proxy) NextDialer(dstAddr string) proxy.Dialer {
-	return p.nextProxy(dstAddr).NextDialer(dstAddr)
+// Route returns the route of dstAddr, network is assumed to be tcp. unlike NextDialer,
+// it doesn't schedule a forwarder, so it can be used to classify destinations.
+func (p *Proxy) Route(dstAddr string) Route {
+	sd := p.match("tcp", dstAddr, nil, nil)
+	host, _, _ := net.SplitHostPort(dstAddr)
+	return Route{Group: sd.Name(), Direct: sd.Direct(), Reject: sd.Reject(), Server: sd.HasServer(host)}
 }
 
 // Record records result while using the dialer from proxy.
@@ -111,21 +579,107 @@ func (p *Proxy) Record(dialer proxy.Dialer, success bool) {
 	strategy.OnRecord(dialer, success)
 }
 
-// AddDomainIP used to update ipMap rules according to domainMap rule.
-func (p *Proxy) AddDomainIP(domain, ip string) error {
-	if ip != "" {
-		domain = strings.ToLower(domain)
-		for i := len(domain); i != -1; {
-			i = strings.LastIndexByte(domain[:i], '.')
-			if dialer, ok := p.domainMap.Load(domain[i+1:]); ok {
-				p.ipMap.Store(ip, dialer)
-				log.F("[rule] add ip=%s, based on rule: domain=%s & domain/ip: %s/%s\n", ip, domain[i+1:], domain, ip)
-			}
+// AddDomainIP used to update ip rules according to domainMap rule, the ip rule
+// expires after ttl seconds plus a grace period.
+func (p *Proxy) AddDomainIP(domain, ip string, ttl int) error {
+	if ip == "" {
+		return nil
+	}
+
+	dip := &domainIP{domain: domain}
+	if len(p.ordered) > 0 {
+		if r := p.orderedDomainRule(domain); r != nil {
+			dip.proxy, dip.typ, dip.value, dip.rule = r.proxy, r.Type, r.Value, r.String()
+		}
+	} else if proxy, typ, pattern := p.matchDomain(domain, nil); proxy != nil {
+		dip.proxy, dip.typ, dip.value = proxy, typ, pattern
+	}
+
+	proxy := dip.proxy
+	if proxy == nil {
+		return nil
+	}
+
+	expire := time.Now().Add(time.Duration(ttl)*time.Second + domainIPGrace).UnixNano()
+	dip.expire = expire
+
+	p.domainIPMu.Lock()
+	if old, ok := p.domainIPMap[ip]; ok && old.proxy == proxy {
+		// extend the expire time only
+		if old.expire < expire {
+			old.expire = expire
 		}
+		p.domainIPMu.Unlock()
+		return nil
+	}
+	// a new ip, or the ip is reassigned to a domain of another rule
+	p.domainIPMap[ip] = dip
+	p.domainIPMu.Unlock()
+
+	log.F("[rule] add ip=%s, based on rule: %s=%s & domain/ip: %s/%s, ttl: %ds\n", ip, dip.typ, dip.value, domain, ip, ttl)
+	return nil
+}
+
+// active returns true if the rule of proxy is active now according to its schedule.
+func (p *Proxy) active(proxy interface{}) bool {
+	if p.accept == nil {
+		return true
+	}
+
+	schedule, ok := p.schedules[proxy.(*strategy.Proxy)]
+	return !ok || schedule.Active(time.Now())
+}
+
+// resolvedDomain returns the domain which ip is resolved from, empty if not found.
+func (p *Proxy) resolvedDomain(ip net.IP) string {
+	if dip := p.domainIP(ip.String()); dip != nil {
+		return strings.TrimSuffix(strings.ToLower(dip.domain), ".")
+	}
+	return ""
+}
+
+// domainIP returns the ip learned from dns answers if it's not expired, nil if not found.
+func (p *Proxy) domainIP(ip string) *domainIP {
+	p.domainIPMu.RLock()
+	defer p.domainIPMu.RUnlock()
+
+	if dip, ok := p.domainIPMap[ip]; ok && dip.expire > time.Now().UnixNano() {
+		return dip
 	}
 	return nil
 }
 
+// sweep removes the expired domain ips periodically.
+func (p *Proxy) sweep() {
+	go func() {
+		for now := range time.Tick(domainIPSweepInterval) {
+			removed := 0
+			p.domainIPMu.Lock()
+			for ip, dip := range p.domainIPMap {
+				if dip.expire <= now.UnixNano() {
+					delete(p.domainIPMap, ip)
+					removed++
+				}
+			}
+			left := len(p.domainIPMap)
+			p.domainIPMu.Unlock()
+
+			if removed > 0 {
+				log.F("[rule] removed %d expired domain ips, %d left", removed, left)
+			}
+		}
+	}()
+}
+
+// Stats returns the statistics of rules.
+func (p *Proxy) Stats() Stats {
+	s := p.stats
+	p.domainIPMu.RLock()
+	s.DomainIPs = len(p.domainIPMap)
+	p.domainIPMu.RUnlock()
+	return s
+}
+
 // Check .
 func (p *Proxy) Check() {
 	p.proxy.Check()
@@ -134,3 +688,10 @@ func (p *Proxy) Check() {
 		d.Check()
 	}
 }
+
+// StartProviders starts updating the rule providers periodically.
+func (p *Proxy) StartProviders() {
+	for _, pv := range p.providers {
+		go pv.run()
+	}
+}
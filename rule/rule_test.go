@@ -0,0 +1,98 @@
+package rule
+
+import (
+	"net"
+	"testing"
+
+	"github.com/nadoo/glider/proxy"
+	_ "github.com/nadoo/glider/proxy/reject"
+	"github.com/nadoo/glider/strategy"
+)
+
+func TestMatchPrecedence(t *testing.T) {
+	cfg := strategy.Config{Strategy: "rr"}
+	rules := []*Config{
+		{Name: "dst.rule", StrategyConfig: cfg, Domain: []string{"example.com"}, IP: []string{"1.1.1.1"}, CIDR: []string{"10.0.0.0/8"}},
+		{Name: "src.rule", StrategyConfig: cfg, SrcIP: []string{"192.168.50.10"}, SrcCIDR: []string{"192.168.50.0/24"}},
+		{Name: "inbound.rule", StrategyConfig: cfg, Inbound: []string{"guest"}},
+		{Name: "port.rule", StrategyConfig: cfg, Port: []string{"25"}},
+		{Name: "network.rule", StrategyConfig: cfg, Network: []string{"udp"}},
+	}
+	p := NewProxy(rules, strategy.NewProxy("default", nil, &cfg), nil)
+
+	guest := &proxy.Session{Inbound: "guest", Src: &net.TCPAddr{IP: net.IPv4(192, 168, 50, 10), Port: 1234}}
+	lan := &proxy.Session{Inbound: "guest", Src: &net.TCPAddr{IP: net.IPv4(192, 168, 50, 20), Port: 1234}}
+	other := &proxy.Session{Inbound: "guest", Src: &net.TCPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 1234}}
+	anon := &proxy.Session{Src: &net.TCPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 1234}}
+
+	tests := []struct {
+		network, addr string
+		sess          *proxy.Session
+		rule, typ     string
+	}{
+		// destination rules are more specific than connection rules
+		{"tcp", "www.example.com:25", guest, "dst.rule", MatchDomain},
+		{"udp", "1.1.1.1:25", guest, "dst.rule", MatchIP},
+		{"tcp", "10.1.1.1:25", guest, "dst.rule", MatchCIDR},
+
+		// connection rules: srcip > srccidr > inbound > port > network
+		{"udp", "www.example.org:25", guest, "src.rule", MatchSrcIP},
+		{"udp", "www.example.org:25", lan, "src.rule", MatchSrcCIDR},
+		{"udp", "www.example.org:25", other, "inbound.rule", MatchInbound},
+		{"udp", "www.example.org:25", anon, "port.rule", MatchPort},
+		{"udp", "www.example.org:53", anon, "network.rule", MatchNetwork},
+		{"tcp", "www.example.org:443", anon, "", MatchDefault},
+
+		// connection rules don't apply without session
+		{"udp", "www.example.org:25", nil, "", MatchDefault},
+	}
+
+	for _, tt := range tests {
+		e := p.Explain(tt.network, tt.addr, tt.sess)
+		if e.Rule != tt.rule || e.Type != tt.typ {
+			t.Errorf("%s://%s from %v: matched %s by %s, want %s by %s", tt.network, tt.addr, tt.sess, e.Rule, e.Type, tt.rule, tt.typ)
+		}
+	}
+}
+
+func TestOrderedRules(t *testing.T) {
+	cfg := strategy.Config{Strategy: "rr"}
+	rules := []*Config{{Name: "office.rule", StrategyConfig: cfg, Domain: []string{"example.com"}}}
+	p := NewProxy(rules, strategy.NewProxy("default", nil, &cfg), nil)
+
+	var ordered []*OrderedRule
+	for _, s := range []string{
+		"DST-PORT,25,REJECT",
+		"DOMAIN-SUFFIX,example.com,office",
+		"SRC-IP-CIDR,192.168.50.0/24,DIRECT",
+		"MATCH,default",
+		"NETWORK,udp,DIRECT", // never matched
+	} {
+		r, err := ParseOrderedRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ordered = append(ordered, r)
+	}
+	if err := p.SetOrderedRules(ordered, &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	lan := &proxy.Session{Src: &net.TCPAddr{IP: net.IPv4(192, 168, 50, 10), Port: 1234}}
+	tests := []struct {
+		network, addr string
+		sess          *proxy.Session
+		rule          string
+	}{
+		{"tcp", "www.example.com:25", lan, "DST-PORT,25,REJECT"},
+		{"tcp", "www.example.com:443", lan, "DOMAIN-SUFFIX,example.com,office"},
+		{"tcp", "www.example.org:443", lan, "SRC-IP-CIDR,192.168.50.0/24,DIRECT"},
+		{"udp", "www.example.org:443", nil, "MATCH,default"},
+	}
+
+	for _, tt := range tests {
+		if e := p.Explain(tt.network, tt.addr, tt.sess); e.Rule != tt.rule {
+			t.Errorf("%s://%s: matched %s, want %s", tt.network, tt.addr, e.Rule, tt.rule)
+		}
+	}
+}
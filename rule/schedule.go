@@ -0,0 +1,155 @@
+package rule
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdays = [7]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// window is a daily time window on some days of week in a time zone.
+type window struct {
+	days       [7]bool // indexed by time.Weekday
+	start, end int     // minutes of day, end can be less than start for overnight windows
+	loc        *time.Location
+}
+
+// Schedule is a set of time windows, the rule is active only in them.
+type Schedule []window
+
+// Add parses a time window and adds it to the schedule,
+// format: [DAYS] HH:MM-HH:MM [TIMEZONE], e.g. "Mon-Fri 09:00-18:00 Asia/Shanghai".
+// DAYS is a comma separated list of days or day ranges, default: every day.
+// TIMEZONE is an IANA time zone name, default: the local time zone.
+func (s *Schedule) Add(schedule string) error {
+	fields := strings.Fields(schedule)
+
+	// index of the time range
+	i := -1
+	for j, f := range fields {
+		if strings.Contains(f, ":") {
+			i = j
+			break
+		}
+	}
+	if i == -1 || i > 1 || len(fields) > i+2 {
+		return errors.New("invalid schedule: " + schedule)
+	}
+
+	w := window{loc: time.Local}
+	if i == 0 {
+		for d := range w.days {
+			w.days[d] = true
+		}
+	} else if err := parseDays(fields[0], &w.days); err != nil {
+		return err
+	}
+
+	var err error
+	ts := strings.Split(fields[i], "-")
+	if len(ts) != 2 {
+		return errors.New("invalid time range: " + fields[i])
+	}
+	if w.start, err = parseClock(ts[0]); err != nil {
+		return err
+	}
+	if w.end, err = parseClock(ts[1]); err != nil {
+		return err
+	}
+
+	if len(fields) > i+1 {
+		if w.loc, err = time.LoadLocation(fields[i+1]); err != nil {
+			return err
+		}
+	}
+
+	*s = append(*s, w)
+	return nil
+}
+
+// Active returns true if t is in any window of the schedule.
+func (s Schedule) Active(t time.Time) bool {
+	for _, w := range s {
+		if w.active(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *window) active(t time.Time) bool {
+	t = t.In(w.loc)
+	day, min := t.Weekday(), t.Hour()*60+t.Minute()
+
+	switch {
+	case w.start == w.end: // all day
+		return w.days[day]
+	case w.start < w.end:
+		return w.days[day] && min >= w.start && min < w.end
+	default: // overnight, the days are the days it starts
+		return (w.days[day] && min >= w.start) || (w.days[(day+6)%7] && min < w.end)
+	}
+}
+
+// parseDays parses days like "Mon-Fri", "Sat,Sun" or "Fri-Mon".
+func parseDays(s string, days *[7]bool) error {
+	for _, r := range strings.Split(s, ",") {
+		ds := strings.Split(r, "-")
+		if len(ds) > 2 {
+			return errors.New("invalid days: " + s)
+		}
+
+		from, err := parseWeekday(ds[0])
+		if err != nil {
+			return err
+		}
+
+		to := from
+		if len(ds) == 2 {
+			if to, err = parseWeekday(ds[1]); err != nil {
+				return err
+			}
+		}
+
+		for d := from; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseWeekday parses day names like "Mon" or "Monday".
+func parseWeekday(s string) (int, error) {
+	if len(s) >= 3 {
+		for i, d := range weekdays {
+			if strings.EqualFold(s[:3], d) {
+				return i, nil
+			}
+		}
+	}
+	return 0, errors.New("invalid day: " + s)
+}
+
+// parseClock parses "HH:MM" and returns minutes of day, "24:00" is allowed.
+func parseClock(s string) (int, error) {
+	hm := strings.Split(s, ":")
+	if len(hm) != 2 {
+		return 0, errors.New("invalid time: " + s)
+	}
+
+	h, err := strconv.Atoi(hm[0])
+	if err != nil {
+		return 0, errors.New("invalid time: " + s)
+	}
+	m, err := strconv.Atoi(hm[1])
+	if err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, errors.New("invalid time: " + s)
+	}
+
+	return h*60 + m, nil
+}
@@ -0,0 +1,93 @@
+package rule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	// 2024-01-01 is Monday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2024, 1, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		schedule string
+		t        time.Time
+		want     bool
+	}{
+		{"09:00-18:00 UTC", at(1, 9, 0), true},
+		{"09:00-18:00 UTC", at(1, 17, 59), true},
+		{"09:00-18:00 UTC", at(1, 18, 0), false},
+		{"09:00-18:00 UTC", at(1, 8, 59), false},
+		{"Mon-Fri 09:00-18:00 UTC", at(6, 10, 0), false}, // Saturday
+		{"Sat,Sun 09:00-18:00 UTC", at(7, 10, 0), true},
+		{"Fri-Mon 09:00-18:00 UTC", at(7, 10, 0), true}, // day range across the week
+		{"Fri-Mon 09:00-18:00 UTC", at(2, 10, 0), false},
+		{"Monday 00:00-24:00 UTC", at(1, 23, 59), true},
+		{"Mon 00:00-00:00 UTC", at(1, 0, 0), true}, // all day
+		{"Mon 00:00-00:00 UTC", at(2, 0, 0), false},
+
+		// windows cross midnight, the days are the days they start
+		{"22:00-06:00 UTC", at(1, 23, 0), true},
+		{"22:00-06:00 UTC", at(2, 5, 59), true},
+		{"22:00-06:00 UTC", at(2, 6, 0), false},
+		{"22:00-06:00 UTC", at(2, 21, 59), false},
+		{"Fri 22:00-02:00 UTC", at(5, 22, 0), true},
+		{"Fri 22:00-02:00 UTC", at(6, 1, 30), true}, // Saturday morning
+		{"Fri 22:00-02:00 UTC", at(6, 22, 30), false},
+		{"Fri 22:00-02:00 UTC", at(5, 1, 30), false}, // Friday morning belongs to Thursday
+		{"Sat 23:00-01:00 UTC", at(7, 0, 30), true},  // Sunday, the week wraps
+		{"Sun 23:00-01:00 UTC", at(1, 0, 30), true},  // Monday after Sunday
+		{"Sun 23:00-01:00 UTC", at(7, 0, 30), false},
+
+		// time zone, 09:00 in Shanghai is 01:00 UTC
+		{"Mon 09:00-10:00 Asia/Shanghai", at(1, 1, 30), true},
+		{"Mon 09:00-10:00 Asia/Shanghai", at(1, 9, 30), false},
+		{"Tue 07:00-09:00 Asia/Shanghai", at(1, 23, 30), true}, // Monday in UTC
+	}
+
+	for _, tt := range tests {
+		var s Schedule
+		if err := s.Add(tt.schedule); err != nil {
+			t.Errorf("Add(%q): %v", tt.schedule, err)
+			continue
+		}
+		if got := s.Active(tt.t); got != tt.want {
+			t.Errorf("%q: Active(%s) = %v, want %v", tt.schedule, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+
+	// any window active
+	var s Schedule
+	s.Add("Mon-Fri 09:00-12:00 UTC")
+	s.Add("Mon-Fri 13:00-18:00 UTC")
+	if !s.Active(at(1, 14, 0)) || s.Active(at(1, 12, 30)) {
+		t.Error("schedule of two windows")
+	}
+	if (Schedule{}).Active(at(1, 12, 0)) {
+		t.Error("empty schedule is active")
+	}
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	for _, schedule := range []string{
+		"",
+		"Mon-Fri",
+		"09:00",
+		"09:00-25:00",
+		"24:01-02:00",
+		"09:60-10:00",
+		"9-10:00",
+		"Mo 09:00-10:00",
+		"Mon-Tue-Wed 09:00-10:00",
+		"Mon 09:00-10:00 Nowhere/City",
+		"Mon 09:00-10:00 UTC extra",
+		"Mon Tue 09:00-10:00",
+	} {
+		var s Schedule
+		if err := s.Add(schedule); err == nil {
+			t.Errorf("Add(%q): expected error", schedule)
+		}
+	}
+}
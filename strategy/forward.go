@@ -1,6 +1,8 @@
 package strategy
 
 import (
+	"errors"
+	"io"
 	"net"
 	"net/url"
 	"strconv"
@@ -8,6 +10,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/nadoo/glider/common/conn"
 	"github.com/nadoo/glider/common/log"
 	"github.com/nadoo/glider/proxy"
 )
@@ -24,17 +27,29 @@ type Forwarder struct {
 	disabled    uint32
 	failures    uint32
 	latency     int64
-	intface     string // local interface or ip address
+	conns       int64    // active connections
+	weight      uint32   // weight in weighted round robin mode
+	current     int64    // current weight in weighted round robin mode, protected by wrrMu of proxy
+	hash        uint64   // hash of the forward chain in consistent hashing mode
+	hosts       []string // server hosts of the forward chain
+	intface     string   // local interface or ip address
 	handlers    []StatusHandler
+
+	url     string // forward url, empty for the direct forwarder
+	source  string // subscription which the forwarder comes from, empty for forward urls in config
+	removed uint32 // removed from the proxy by subscription updates
+	checked bool   // checker started, protected by the mutex of proxy
 }
 
 // ForwarderFromURL parses `forward=` command value and returns a new forwarder.
-func ForwarderFromURL(s, intface string, dialTimeout, relayTimeout time.Duration) (f *Forwarder, err error) {
-	f = &Forwarder{}
+func ForwarderFromURL(s, intface, family string, dialTimeout, relayTimeout time.Duration) (f *Forwarder, err error) {
+	f = &Forwarder{url: s, weight: 1}
 
 	ss := strings.Split(s, "#")
 	if len(ss) > 1 {
-		err = f.parseOption(ss[1])
+		if err = f.parseOption(ss[1]); err != nil {
+			return nil, err
+		}
 	}
 
 	iface := intface
@@ -43,20 +58,24 @@ func ForwarderFromURL(s, intface string, dialTimeout, relayTimeout time.Duration
 	}
 
 	var d proxy.Dialer
-	d, err = proxy.NewDirect(iface, dialTimeout, relayTimeout)
+	d, err = proxy.NewDirect(iface, family, dialTimeout, relayTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, url := range strings.Split(ss[0], ",") {
-		d, err = proxy.DialerFromURL(url, d)
+	for _, s := range strings.Split(ss[0], ",") {
+		d, err = proxy.DialerFromURL(s, d)
 		if err != nil {
 			return nil, err
 		}
+		if u, err := url.Parse(s); err == nil && u.Hostname() != "" {
+			f.hosts = append(f.hosts, strings.ToLower(u.Hostname()))
+		}
 	}
 
 	f.Dialer = d
 	f.addr = d.Addr()
+	f.hash = hashString(ss[0])
 
 	// set forwarder to disabled by default
 	f.Disable()
@@ -65,13 +84,13 @@ func ForwarderFromURL(s, intface string, dialTimeout, relayTimeout time.Duration
 }
 
 // DirectForwarder returns a direct forwarder.
-func DirectForwarder(intface string, dialTimeout, relayTimeout time.Duration) *Forwarder {
-	d, err := proxy.NewDirect(intface, dialTimeout, relayTimeout)
+func DirectForwarder(intface, family string, dialTimeout, relayTimeout time.Duration) *Forwarder {
+	d, err := proxy.NewDirect(intface, family, dialTimeout, relayTimeout)
 	if err != nil {
 		return nil
 	}
 
-	return &Forwarder{Dialer: d, addr: d.Addr()}
+	return &Forwarder{Dialer: d, addr: d.Addr(), weight: 1, hash: hashString(d.Addr())}
 }
 
 func (f *Forwarder) parseOption(option string) error {
@@ -89,6 +108,14 @@ func (f *Forwarder) parseOption(option string) error {
 
 	f.intface = query.Get("interface")
 
+	if w := query.Get("weight"); w != "" {
+		weight, err := strconv.ParseUint(w, 10, 32)
+		if err != nil || weight == 0 {
+			return errors.New("invalid weight: " + w)
+		}
+		f.weight = uint32(weight)
+	}
+
 	return err
 }
 
@@ -102,9 +129,32 @@ func (f *Forwarder) Dial(network, addr string) (c net.Conn, err error) {
 	c, err = f.Dialer.Dial(network, addr)
 	if err != nil {
 		f.IncFailures()
+		return c, err
 	}
 
-	return c, err
+	atomic.AddInt64(&f.conns, 1)
+	return &countConn{Conn: c, fwdr: f}, err
+}
+
+// DialUDP connects to the given address.
+func (f *Forwarder) DialUDP(network, addr string) (pc net.PacketConn, writeTo net.Addr, err error) {
+	pc, writeTo, err = f.Dialer.DialUDP(network, addr)
+	if err != nil {
+		return pc, writeTo, err
+	}
+
+	atomic.AddInt64(&f.conns, 1)
+	return &countPacketConn{PacketConn: pc, fwdr: f}, writeTo, err
+}
+
+// Conns returns the active connections of forwarder.
+func (f *Forwarder) Conns() int64 {
+	return atomic.LoadInt64(&f.conns)
+}
+
+// Weight returns the weight of forwarder.
+func (f *Forwarder) Weight() uint32 {
+	return f.weight
 }
 
 // Failures returns the failuer count of forwarder.
@@ -147,6 +197,16 @@ func (f *Forwarder) Disable() {
 	}
 }
 
+// remove marks the forwarder as removed, its checker will stop.
+func (f *Forwarder) remove() {
+	atomic.StoreUint32(&f.removed, 1)
+}
+
+// isRemoved returns true if the forwarder is removed from its proxy.
+func (f *Forwarder) isRemoved() bool {
+	return isTrue(atomic.LoadUint32(&f.removed))
+}
+
 // Enabled returns the status of forwarder.
 func (f *Forwarder) Enabled() bool {
 	return !isTrue(atomic.LoadUint32(&f.disabled))
@@ -185,3 +245,60 @@ func (f *Forwarder) Latency() int64 {
 func (f *Forwarder) SetLatency(l int64) {
 	atomic.StoreInt64(&f.latency, l)
 }
+
+// countConn is a conn dialed by forwarder, it decreases the active connections of forwarder on close.
+type countConn struct {
+	net.Conn
+	fwdr   *Forwarder
+	closed uint32
+}
+
+func (c *countConn) Close() error {
+	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.fwdr.conns, -1)
+	}
+	return c.Conn.Close()
+}
+
+// Unwrap returns the underlying conn.
+func (c *countConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// ReadFrom implements io.ReaderFrom, so relays keep the splice path of the underlying tcp conn.
+func (c *countConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return conn.Copy(c.Conn, r)
+}
+
+// WriteTo implements io.WriterTo.
+func (c *countConn) WriteTo(w io.Writer) (int64, error) {
+	if wt, ok := c.Conn.(io.WriterTo); ok {
+		return wt.WriteTo(w)
+	}
+	return conn.Copy(w, c.Conn)
+}
+
+// CloseWrite shuts down the writing side of the underlying conn.
+func (c *countConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("close write not supported by " + c.fwdr.addr)
+}
+
+// countPacketConn is a packet conn dialed by forwarder, it decreases the active connections of forwarder on close.
+type countPacketConn struct {
+	net.PacketConn
+	fwdr   *Forwarder
+	closed uint32
+}
+
+func (c *countPacketConn) Close() error {
+	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.fwdr.conns, -1)
+	}
+	return c.PacketConn.Close()
+}
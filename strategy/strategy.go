@@ -2,8 +2,10 @@ package strategy
 
 import (
 	"bytes"
+	"errors"
 	"hash/fnv"
 	"io"
+	"math"
 	"net"
 	"sort"
 	"strings"
@@ -26,6 +28,7 @@ type Config struct {
 	DialTimeout       int
 	RelayTimeout      int
 	IntFace           string
+	IPFamily          string
 }
 
 // forwarder slice orderd by priority
@@ -37,20 +40,24 @@ func (p priSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
 // Proxy is base proxy struct.
 type Proxy struct {
+	name     string
 	config   *Config
 	fwdrs    priSlice
 	avail    []*Forwarder // available forwarders
 	mu       sync.RWMutex
+	wrrMu    sync.Mutex // protects the current weights of forwarders
 	index    uint32
 	priority uint32
-	next     func(addr string) *Forwarder
+	next     func(dstAddr string, sess *proxy.Session) *Forwarder
+	checking bool // checkers started
+	subs     []*subscription
 }
 
 // NewProxy returns a new strategy proxy.
 func NewProxy(name string, s []string, c *Config) *Proxy {
 	var fwdrs []*Forwarder
 	for _, chain := range s {
-		fwdr, err := ForwarderFromURL(chain, c.IntFace,
+		fwdr, err := ForwarderFromURL(chain, c.IntFace, c.IPFamily,
 			time.Duration(c.DialTimeout)*time.Second, time.Duration(c.RelayTimeout)*time.Second)
 		if err != nil {
 			log.Fatal(err)
@@ -60,10 +67,9 @@ func NewProxy(name string, s []string, c *Config) *Proxy {
 	}
 
 	if len(fwdrs) == 0 {
-		// direct forwarder
-		fwdrs = append(fwdrs, DirectForwarder(c.IntFace,
+		// direct forwarder, it will be replaced by the forwarders of subscriptions if there're some
+		fwdrs = append(fwdrs, DirectForwarder(c.IntFace, c.IPFamily,
 			time.Duration(c.DialTimeout)*time.Second, time.Duration(c.RelayTimeout)*time.Second))
-		c.Strategy = "rr"
 	}
 
 	return newProxy(name, fwdrs, c)
@@ -71,7 +77,7 @@ func NewProxy(name string, s []string, c *Config) *Proxy {
 
 // newProxy returns a new Proxy.
 func newProxy(name string, fwdrs []*Forwarder, c *Config) *Proxy {
-	p := &Proxy{fwdrs: fwdrs, config: c}
+	p := &Proxy{name: name, fwdrs: fwdrs, config: c}
 	sort.Sort(p.fwdrs)
 
 	p.init()
@@ -93,6 +99,18 @@ func newProxy(name string, fwdrs []*Forwarder, c *Config) *Proxy {
 	case "dh":
 		p.next = p.scheduleDH
 		log.F("[strategy] %s: forward in destination hashing mode.", name)
+	case "lc":
+		p.next = p.scheduleLC
+		log.F("[strategy] %s: forward in least connections mode.", name)
+	case "wrr":
+		p.next = p.scheduleWRR
+		log.F("[strategy] %s: forward in weighted round robin mode.", name)
+	case "ch":
+		p.next = p.scheduleCH
+		log.F("[strategy] %s: forward in consistent destination hashing mode.", name)
+	case "sh":
+		p.next = p.scheduleSH
+		log.F("[strategy] %s: forward in consistent source hashing mode.", name)
 	default:
 		p.next = p.scheduleRR
 		log.F("[strategy] %s: not supported forward mode '%s', use round robin mode.", name, c.Strategy)
@@ -105,20 +123,25 @@ func newProxy(name string, fwdrs []*Forwarder, c *Config) *Proxy {
 	return p
 }
 
-// Dial connects to the address addr on the network net.
-func (p *Proxy) Dial(network, addr string) (net.Conn, proxy.Dialer, error) {
-	nd := p.NextDialer(addr)
+// Name returns the name of proxy.
+func (p *Proxy) Name() string {
+	return p.name
+}
+
+// Dial connects to the address addr on the network net, sess can be nil if it's not from a server.
+func (p *Proxy) Dial(network, addr string, sess *proxy.Session) (net.Conn, proxy.Dialer, error) {
+	nd := p.NextDialer(addr, sess)
 	c, err := nd.Dial(network, addr)
 	return c, nd, err
 }
 
-// DialUDP connects to the given address.
-func (p *Proxy) DialUDP(network, addr string) (pc net.PacketConn, writeTo net.Addr, err error) {
-	return p.NextDialer(addr).DialUDP(network, addr)
+// DialUDP connects to the given address, sess can be nil if it's not from a server.
+func (p *Proxy) DialUDP(network, addr string, sess *proxy.Session) (pc net.PacketConn, writeTo net.Addr, err error) {
+	return p.NextDialer(addr, sess).DialUDP(network, addr)
 }
 
-// NextDialer returns the next dialer.
-func (p *Proxy) NextDialer(dstAddr string) proxy.Dialer {
+// NextDialer returns the next dialer, sess can be nil if it's not from a server.
+func (p *Proxy) NextDialer(dstAddr string, sess *proxy.Session) proxy.Dialer {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
@@ -126,7 +149,7 @@ func (p *Proxy) NextDialer(dstAddr string) proxy.Dialer {
 		return p.fwdrs[atomic.AddUint32(&p.index, 1)%uint32(len(p.fwdrs))]
 	}
 
-	return p.next(dstAddr)
+	return p.next(dstAddr, sess)
 }
 
 // Record records result while using the dialer from proxy.
@@ -145,6 +168,41 @@ func OnRecord(dialer proxy.Dialer, success bool) {
 	}
 }
 
+// Direct returns true if all the forwarders of proxy connect to destinations directly.
+func (p *Proxy) Direct() bool { return p.allAddr("DIRECT") }
+
+// Reject returns true if all the forwarders of proxy reject connections.
+func (p *Proxy) Reject() bool { return p.allAddr("REJECT") }
+
+func (p *Proxy) allAddr(addr string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, f := range p.fwdrs {
+		if f.Addr() != addr {
+			return false
+		}
+	}
+	return true
+}
+
+// HasServer returns true if host is the server of a forwarder of proxy.
+func (p *Proxy) HasServer(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, f := range p.fwdrs {
+		for _, h := range f.hosts {
+			if h == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Priority returns the active priority of dialer.
 func (p *Proxy) Priority() uint32 { return atomic.LoadUint32(&p.priority) }
 
@@ -179,6 +237,10 @@ func (p *Proxy) onStatusChanged(fwdr *Forwarder) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	if fwdr.isRemoved() {
+		return
+	}
+
 	if fwdr.Enabled() {
 		log.F("[strategy] %s changed status from Disabled to Enabled ", fwdr.Addr())
 		if fwdr.Priority() == p.Priority() {
@@ -201,12 +263,27 @@ func (p *Proxy) onStatusChanged(fwdr *Forwarder) {
 	}
 }
 
-// Check implements the Checker interface.
+// Check implements the Checker interface, it also starts updating the subscriptions.
 func (p *Proxy) Check() {
+	p.mu.Lock()
+	p.checking = true
+	p.startCheckers()
+	p.mu.Unlock()
+
+	for _, sub := range p.subs {
+		go sub.run()
+	}
+}
+
+// startCheckers starts the checkers of forwarders which are not checked, p.mu must be held.
+func (p *Proxy) startCheckers() {
 	// no need to check when there's only 1 forwarder
 	if len(p.fwdrs) > 1 {
-		for i := 0; i < len(p.fwdrs); i++ {
-			go p.check(p.fwdrs[i])
+		for _, f := range p.fwdrs {
+			if !f.checked {
+				f.checked = true
+				go p.check(f)
+			}
 		}
 	}
 }
@@ -219,6 +296,10 @@ func (p *Proxy) check(f *Forwarder) {
 	for {
 		time.Sleep(intval * time.Duration(wait))
 
+		if f.isRemoved() {
+			return
+		}
+
 		// check all forwarders at least one time
 		if wait > 0 && (f.Priority() < p.Priority()) {
 			continue
@@ -300,18 +381,103 @@ func checkWebSite(fwdr *Forwarder, website string, timeout time.Duration, buf []
 	return true
 }
 
+// setForwarders replaces the forwarders from source with the forwarders of urls, the unchanged ones
+// are kept with their status. the direct forwarder used when there's no forwarder is also removed.
+func (p *Proxy) setForwarders(source string, urls []string) (added, removed int, err error) {
+	c := p.config
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var fwdrs priSlice
+	old := make(map[string]*Forwarder)
+	for _, f := range p.fwdrs {
+		switch {
+		case f.source == source:
+			old[f.url] = f
+		case f.url != "":
+			fwdrs = append(fwdrs, f)
+		}
+	}
+
+	var fresh []*Forwarder
+	for _, u := range urls {
+		if f, ok := old[u]; ok {
+			fwdrs = append(fwdrs, f)
+			delete(old, u)
+			continue
+		}
+
+		f, err := ForwarderFromURL(u, c.IntFace, c.IPFamily,
+			time.Duration(c.DialTimeout)*time.Second, time.Duration(c.RelayTimeout)*time.Second)
+		if err != nil {
+			log.F("[strategy] %s: invalid forwarder from %s: %s", p.name, source, err)
+			continue
+		}
+		f.source = source
+		f.SetMaxFailures(uint32(c.MaxFailures))
+		fwdrs = append(fwdrs, f)
+		fresh = append(fresh, f)
+	}
+
+	if len(fwdrs) == 0 {
+		return 0, 0, errors.New("no valid forwarder")
+	}
+
+	for _, f := range fresh {
+		f.AddHandler(p.onStatusChanged)
+	}
+
+	for _, f := range old {
+		f.remove()
+	}
+
+	sort.Sort(fwdrs)
+	p.fwdrs = fwdrs
+	p.init()
+
+	if p.checking {
+		p.startCheckers()
+	}
+
+	return len(fresh), len(old), nil
+}
+
+// rejectPlaceholder replaces the direct forwarder used when there's no forwarder with a reject one,
+// so connections are not sent directly before the forwarders of subscriptions are loaded.
+// it reports whether the proxy has no forwarders but the placeholder.
+func (p *Proxy) rejectPlaceholder() (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.fwdrs) != 1 || p.fwdrs[0].url != "" {
+		return false, nil
+	}
+
+	if p.fwdrs[0].Addr() != "REJECT" {
+		d, err := proxy.DialerFromURL("reject://", proxy.Default)
+		if err != nil {
+			return true, err
+		}
+		p.fwdrs[0] = &Forwarder{Dialer: d, addr: d.Addr(), weight: 1, hash: hashString(d.Addr())}
+		p.init()
+	}
+
+	return true, nil
+}
+
 // Round Robin
-func (p *Proxy) scheduleRR(dstAddr string) *Forwarder {
+func (p *Proxy) scheduleRR(dstAddr string, sess *proxy.Session) *Forwarder {
 	return p.avail[atomic.AddUint32(&p.index, 1)%uint32(len(p.avail))]
 }
 
 // High Availability
-func (p *Proxy) scheduleHA(dstAddr string) *Forwarder {
+func (p *Proxy) scheduleHA(dstAddr string, sess *proxy.Session) *Forwarder {
 	return p.avail[0]
 }
 
 // Latency based High Availability
-func (p *Proxy) scheduleLHA(dstAddr string) *Forwarder {
+func (p *Proxy) scheduleLHA(dstAddr string, sess *proxy.Session) *Forwarder {
 	fwdr := p.avail[0]
 	lowest := fwdr.Latency()
 	for _, f := range p.avail {
@@ -324,8 +490,98 @@ func (p *Proxy) scheduleLHA(dstAddr string) *Forwarder {
 }
 
 // Destination Hashing
-func (p *Proxy) scheduleDH(dstAddr string) *Forwarder {
+func (p *Proxy) scheduleDH(dstAddr string, sess *proxy.Session) *Forwarder {
 	fnv1a := fnv.New32a()
 	fnv1a.Write([]byte(dstAddr))
 	return p.avail[fnv1a.Sum32()%uint32(len(p.avail))]
 }
+
+// Least Connections
+func (p *Proxy) scheduleLC(dstAddr string, sess *proxy.Session) *Forwarder {
+	// start from the next one of round robin, so idle forwarders are used in turn
+	start := atomic.AddUint32(&p.index, 1) % uint32(len(p.avail))
+	fwdr := p.avail[start]
+	least := fwdr.Conns()
+	for i := 1; i < len(p.avail) && least > 0; i++ {
+		f := p.avail[(start+uint32(i))%uint32(len(p.avail))]
+		if f.Conns() < least {
+			least = f.Conns()
+			fwdr = f
+		}
+	}
+	return fwdr
+}
+
+// Smooth Weighted Round Robin
+func (p *Proxy) scheduleWRR(dstAddr string, sess *proxy.Session) *Forwarder {
+	p.wrrMu.Lock()
+	defer p.wrrMu.Unlock()
+
+	var fwdr *Forwarder
+	var total int64
+	for _, f := range p.avail {
+		f.current += int64(f.Weight())
+		total += int64(f.Weight())
+		if fwdr == nil || f.current > fwdr.current {
+			fwdr = f
+		}
+	}
+	fwdr.current -= total
+	return fwdr
+}
+
+// Consistent Destination Hashing
+func (p *Proxy) scheduleCH(dstAddr string, sess *proxy.Session) *Forwarder {
+	return p.rendezvous(hostOf(dstAddr))
+}
+
+// Consistent Source Hashing, it falls back to destination hashing when the source is unknown
+func (p *Proxy) scheduleSH(dstAddr string, sess *proxy.Session) *Forwarder {
+	if sess != nil && sess.Src != nil {
+		return p.rendezvous(hostOf(sess.Src.String()))
+	}
+	return p.scheduleCH(dstAddr, sess)
+}
+
+// rendezvous returns the available forwarder with the highest weighted score for key, so when a
+// forwarder changes status only the keys of it are moved, the others keep their forwarders.
+func (p *Proxy) rendezvous(key string) *Forwarder {
+	h := hashString(key)
+
+	var fwdr *Forwarder
+	var highest float64
+	for _, f := range p.avail {
+		// a uniform number in (0, 1) from the hash of key and forwarder
+		u := (float64(mix64(h^f.hash)>>11) + 0.5) / (1 << 53)
+		score := -float64(f.Weight()) / math.Log(u)
+		if fwdr == nil || score > highest {
+			fwdr, highest = f, score
+		}
+	}
+	return fwdr
+}
+
+// hostOf returns the host of addr, or addr itself if it has no port.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// hashString returns the fnv-1a hash of s.
+func hashString(s string) uint64 {
+	fnv1a := fnv.New64a()
+	fnv1a.Write([]byte(s))
+	return fnv1a.Sum64()
+}
+
+// mix64 is the finalizer of splitmix64, it spreads the bits of fnv hashes.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,240 @@
+package strategy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/nadoo/glider/proxy"
+)
+
+// newTestProxy returns a proxy of strategy with forwarders named a, b, c... of weights.
+func newTestProxy(strategy string, weights ...uint32) *Proxy {
+	var fwdrs []*Forwarder
+	for i, w := range weights {
+		addr := string(rune('a' + i))
+		fwdrs = append(fwdrs, &Forwarder{addr: addr, weight: w, hash: hashString(addr)})
+	}
+	return newProxy(strategy, fwdrs, &Config{Strategy: strategy, CheckWebSite: "www.example.com"})
+}
+
+func (p *Proxy) fwdr(addr string) *Forwarder {
+	for _, f := range p.fwdrs {
+		if f.addr == addr {
+			return f
+		}
+	}
+	return nil
+}
+
+func (p *Proxy) nextAddr(dstAddr string, sess *proxy.Session) string {
+	return p.NextDialer(dstAddr, sess).Addr()
+}
+
+func TestScheduleWRR(t *testing.T) {
+	tests := []struct {
+		weights []uint32
+		seq     string // picks of one round
+	}{
+		{[]uint32{1, 1, 1}, "abc"},
+		{[]uint32{5, 1, 1}, "aabacaa"},
+		{[]uint32{3, 2}, "ababa"},
+		{[]uint32{1, 4}, "bbabb"},
+	}
+
+	for _, tt := range tests {
+		p := newTestProxy("wrr", tt.weights...)
+		for round := 0; round < 3; round++ {
+			var seq strings.Builder
+			for range tt.seq {
+				seq.WriteString(p.nextAddr("example.com:443", nil))
+			}
+			if seq.String() != tt.seq {
+				t.Errorf("weights %v round %d: picks %s, want %s", tt.weights, round, seq.String(), tt.seq)
+			}
+		}
+	}
+}
+
+func TestScheduleWRRDisabled(t *testing.T) {
+	p := newTestProxy("wrr", 5, 1, 1)
+	p.fwdr("a").Disable()
+
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		counts[p.nextAddr("example.com:443", nil)]++
+	}
+	if counts["a"] != 0 || counts["b"] != 5 || counts["c"] != 5 {
+		t.Errorf("picks %v, want b and c 5 times each", counts)
+	}
+}
+
+func TestScheduleLC(t *testing.T) {
+	tests := []struct {
+		conns    []int64
+		disabled string // addrs of disabled forwarders
+		want     string // addrs may be picked, all of them are picked in turn
+	}{
+		{[]int64{3, 1, 2}, "", "b"},
+		{[]int64{0, 0, 0}, "", "abc"},
+		{[]int64{2, 0, 0}, "", "bc"},
+		{[]int64{0, 3, 1}, "a", "c"},
+		{[]int64{0, 1, 1}, "a", "bc"},
+		{[]int64{5, 5, 5}, "bc", "a"},
+	}
+
+	for _, tt := range tests {
+		p := newTestProxy("lc", 1, 1, 1)
+		for i, f := range p.fwdrs {
+			f.conns = tt.conns[i]
+		}
+		for _, addr := range tt.disabled {
+			p.fwdr(string(addr)).Disable()
+		}
+
+		picked := make(map[string]bool)
+		for i := 0; i < 3*len(tt.want); i++ {
+			addr := p.nextAddr("example.com:443", nil)
+			if !strings.Contains(tt.want, addr) {
+				t.Errorf("conns %v disabled %q: picked %s, want one of %s", tt.conns, tt.disabled, addr, tt.want)
+			}
+			picked[addr] = true
+		}
+		if len(picked) != len(tt.want) {
+			t.Errorf("conns %v disabled %q: picked %v, want all of %s", tt.conns, tt.disabled, picked, tt.want)
+		}
+	}
+}
+
+func TestForwarderConns(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	p := NewProxy("lc", nil, &Config{Strategy: "lc", CheckWebSite: "www.example.com", DialTimeout: 3})
+	f := p.fwdrs[0]
+
+	c1, _, err := p.Dial("tcp", l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, _, err := p.Dial("tcp", l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Conns() != 2 {
+		t.Errorf("conns = %d, want 2", f.Conns())
+	}
+
+	c1.Close()
+	c1.Close()
+	if f.Conns() != 1 {
+		t.Errorf("conns after closing twice = %d, want 1", f.Conns())
+	}
+
+	if _, ok := c2.(interface{ Unwrap() net.Conn }).Unwrap().(*net.TCPConn); !ok {
+		t.Errorf("unwrapped conn is %T, want *net.TCPConn", c2)
+	}
+	c2.Close()
+	if f.Conns() != 0 {
+		t.Errorf("conns = %d, want 0", f.Conns())
+	}
+}
+
+func TestRendezvous(t *testing.T) {
+	tests := []struct {
+		weights  []uint32
+		disabled string
+	}{
+		{[]uint32{1, 1, 1, 1, 1}, "c"},
+		{[]uint32{1, 2, 3, 4, 5}, "e"},
+		{[]uint32{1, 1, 1, 1, 1}, "a"},
+	}
+
+	for _, tt := range tests {
+		p := newTestProxy("ch", tt.weights...)
+
+		const keys = 10000
+		before := make([]string, keys)
+		for i := range before {
+			before[i] = p.nextAddr(fmt.Sprintf("host%d.example.com:443", i), nil)
+		}
+
+		p.fwdr(tt.disabled).Disable()
+		moved := 0
+		for i := range before {
+			addr := p.nextAddr(fmt.Sprintf("host%d.example.com:443", i), nil)
+			switch {
+			case addr == tt.disabled:
+				t.Fatalf("weights %v: picked disabled forwarder %s", tt.weights, addr)
+			case before[i] == tt.disabled:
+				moved++
+			case addr != before[i]:
+				t.Errorf("weights %v: key %d moved from %s to %s, but %s is disabled", tt.weights, i, before[i], addr, tt.disabled)
+			}
+		}
+		if moved == 0 {
+			t.Errorf("weights %v: no keys of %s moved", tt.weights, tt.disabled)
+		}
+
+		// the keys come back when the forwarder is enabled again
+		p.fwdr(tt.disabled).Enable()
+		for i := range before {
+			if addr := p.nextAddr(fmt.Sprintf("host%d.example.com:443", i), nil); addr != before[i] {
+				t.Fatalf("weights %v: key %d picked %s after enabled, want %s", tt.weights, i, addr, before[i])
+			}
+		}
+	}
+}
+
+func TestRendezvousWeights(t *testing.T) {
+	weights := []uint32{1, 2, 3, 4}
+	p := newTestProxy("ch", weights...)
+
+	const keys = 100000
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		counts[p.nextAddr(fmt.Sprintf("host%d.example.com:443", i), nil)]++
+	}
+
+	for i, w := range weights {
+		addr := string(rune('a' + i))
+		want := keys * int(w) / 10
+		if d := counts[addr] - want; d > want/20 || d < -want/20 {
+			t.Errorf("forwarder %s of weight %d got %d keys, want about %d", addr, w, counts[addr], want)
+		}
+	}
+}
+
+func TestScheduleSH(t *testing.T) {
+	p := newTestProxy("sh", 1, 1, 1, 1)
+
+	for i := 0; i < 100; i++ {
+		ip := net.IPv4(10, 0, byte(i), 1)
+		src := &net.TCPAddr{IP: ip, Port: 10000}
+		want := p.nextAddr("example.com:443", proxy.NewSession(src, nil))
+		for port := 10001; port < 10010; port++ {
+			src := &net.TCPAddr{IP: ip, Port: port}
+			if got := p.nextAddr(fmt.Sprintf("host%d.example.com:443", port), proxy.NewSession(src, nil)); got != want {
+				t.Fatalf("source %s picked %s, want %s", src, got, want)
+			}
+		}
+	}
+
+	// destination hashing without source
+	if got, want := p.nextAddr("example.com:443", nil), p.nextAddr("example.com:80", nil); got != want {
+		t.Errorf("no source: example.com:443 picked %s, example.com:80 picked %s", got, want)
+	}
+}
@@ -0,0 +1,505 @@
+package strategy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/nadoo/glider/common/log"
+)
+
+// node is a server in subscriptions.
+type node struct {
+	typ      string // ss, vmess or trojan
+	server   string
+	port     string
+	method   string // cipher of ss, security of vmess
+	password string // password of ss and trojan, uuid of vmess
+	alterID  string
+	obfs     string // simple-obfs type of ss
+	obfsHost string
+	tls      bool
+	sni      string
+	insecure bool
+	network  string // transport of vmess and trojan: tcp or ws
+	path     string // ws path
+	host     string // ws host
+}
+
+// parseSubscription parses the subscription and returns the forward urls of servers in it, skipped is
+// the number of servers not supported. supported formats:
+// base64 encoded or plain share links: ss://(SIP002), vmess://(base64 json), trojan://;
+// SIP008 json; "proxies:" section of clash yaml.
+func parseSubscription(data []byte) (urls []string, skipped int, err error) {
+	data = bytes.TrimSpace(data)
+
+	var nodes []*node
+	switch {
+	case bytes.HasPrefix(data, []byte("{")):
+		if nodes, err = parseSIP008(data); err != nil {
+			return nil, 0, err
+		}
+	case bytes.HasPrefix(data, []byte("proxies:")) || bytes.Contains(data, []byte("\nproxies:")):
+		if nodes, skipped, err = parseClash(data); err != nil {
+			return nil, 0, err
+		}
+	default:
+		if !bytes.Contains(data, []byte("://")) {
+			if b, err := decodeBase64(string(data)); err == nil {
+				data = b
+			}
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 64<<10), subscriptionMaxSize)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+
+			n, err := parseLink(line)
+			if err != nil {
+				log.F("[subscription] skip %s: %s", schemeOf(line), err)
+				skipped++
+				continue
+			}
+			nodes = append(nodes, n)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, n := range nodes {
+		u, err := n.forwardURL()
+		if err != nil {
+			log.F("[subscription] skip %s server %s: %s", n.typ, n.server, err)
+			skipped++
+			continue
+		}
+		if !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
+
+	if len(urls) == 0 {
+		return nil, skipped, errors.New("no supported server in subscription")
+	}
+
+	return urls, skipped, nil
+}
+
+// forwardURL returns the forward url of node.
+func (n *node) forwardURL() (string, error) {
+	if n.server == "" || n.port == "" {
+		return "", errors.New("no server address")
+	}
+	if _, err := strconv.ParseUint(n.port, 10, 16); err != nil {
+		return "", errors.New("invalid port: " + n.port)
+	}
+	addr := net.JoinHostPort(n.server, n.port)
+
+	switch n.typ {
+	case "ss":
+		ss := "ss://" + userinfo(url.UserPassword(n.method, n.password)) + "@"
+		if n.obfs == "" {
+			return ss + addr, nil
+		}
+
+		obfs := "simple-obfs://" + addr + "?type=" + url.QueryEscape(n.obfs)
+		if n.obfsHost != "" {
+			obfs += "&host=" + url.QueryEscape(n.obfsHost)
+		}
+		return obfs + "," + ss, nil
+
+	case "trojan":
+		if n.network != "" && n.network != "tcp" {
+			return "", errors.New("unsupported transport: " + n.network)
+		}
+		if n.sni != "" && n.sni != n.server {
+			return "", errors.New("unsupported sni: " + n.sni)
+		}
+
+		trojan := "trojan://" + userinfo(url.User(n.password)) + "@" + addr
+		if n.insecure {
+			trojan += "?skipVerify=true"
+		}
+		return trojan, nil
+
+	case "vmess":
+		security := strings.ToLower(n.method)
+		switch security {
+		case "", "auto":
+			security = "aes-128-gcm"
+		case "aes-128-gcm", "chacha20-poly1305", "none":
+		default:
+			return "", errors.New("unsupported security: " + n.method)
+		}
+
+		query := ""
+		if n.alterID != "" && n.alterID != "0" {
+			if _, err := strconv.ParseUint(n.alterID, 10, 32); err != nil {
+				return "", errors.New("invalid alterId: " + n.alterID)
+			}
+			query = "?alterID=" + n.alterID
+		}
+
+		var chain []string
+		if n.tls {
+			tls, q := "tls://"+addr, url.Values{}
+			if n.sni != "" {
+				q.Set("serverName", n.sni)
+			}
+			if n.insecure {
+				q.Set("skipVerify", "true")
+			}
+			if len(q) > 0 {
+				tls += "?" + q.Encode()
+			}
+			chain, addr = append(chain, tls), ""
+		}
+
+		switch n.network {
+		case "", "tcp":
+		case "ws":
+			ws := "ws://" + addr
+			if addr == "" {
+				ws += "@"
+			}
+			if n.path != "" && n.path != "/" {
+				if !strings.HasPrefix(n.path, "/") {
+					ws += "/"
+				}
+				ws += n.path
+			}
+			if n.host != "" {
+				ws += "?host=" + url.QueryEscape(n.host)
+			}
+			chain, addr = append(chain, ws), ""
+		default:
+			return "", errors.New("unsupported transport: " + n.network)
+		}
+
+		vmess := "vmess://" + security + ":" + url.PathEscape(n.password) + "@" + addr + query
+		return strings.Join(append(chain, vmess), ","), nil
+	}
+
+	return "", errors.New("unsupported type: " + n.typ)
+}
+
+// userinfo returns the escaped user info, "," is also escaped as it separates the urls in forward chains.
+func userinfo(u *url.Userinfo) string {
+	return strings.ReplaceAll(u.String(), ",", "%2C")
+}
+
+// parseLink parses a share link.
+func parseLink(s string) (*node, error) {
+	switch schemeOf(s) {
+	case "ss":
+		return parseSSLink(s)
+	case "vmess":
+		return parseVMessLink(s)
+	case "trojan":
+		return parseTrojanLink(s)
+	}
+	return nil, errors.New("unsupported link")
+}
+
+func schemeOf(link string) string {
+	if i := strings.Index(link, "://"); i != -1 {
+		return strings.ToLower(link[:i])
+	}
+	return ""
+}
+
+// parseSSLink parses ss links in SIP002 format: ss://BASE64URL(METHOD:PASSWORD)@HOST:PORT[/][?plugin=PLUGIN][#TAG],
+// or the legacy format: ss://BASE64(METHOD:PASSWORD@HOST:PORT)[#TAG].
+func parseSSLink(s string) (*node, error) {
+	s = s[len("ss://"):]
+	if i := strings.IndexByte(s, '#'); i != -1 {
+		s = s[:i]
+	}
+
+	if !strings.Contains(s, "@") {
+		b, err := decodeBase64(s)
+		if err != nil {
+			return nil, err
+		}
+		s = string(b)
+
+		i := strings.LastIndexByte(s, '@')
+		if i == -1 {
+			return nil, errors.New("invalid ss link")
+		}
+
+		method, pass, ok := cut(s[:i], ":")
+		host, port, err := net.SplitHostPort(s[i+1:])
+		if !ok || err != nil {
+			return nil, errors.New("invalid ss link")
+		}
+		return &node{typ: "ss", server: host, port: port, method: method, password: pass}, nil
+	}
+
+	u, err := url.Parse("ss://" + s)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &node{typ: "ss", server: u.Hostname(), port: u.Port()}
+	if pass, ok := u.User.Password(); ok {
+		n.method, n.password = u.User.Username(), pass
+	} else {
+		b, err := decodeBase64(u.User.Username())
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if n.method, n.password, ok = cut(string(b), ":"); !ok {
+			return nil, errors.New("invalid ss user info")
+		}
+	}
+
+	if plugin := u.Query().Get("plugin"); plugin != "" {
+		if err := n.setPlugin(plugin); err != nil {
+			return nil, err
+		}
+	}
+
+	return n, nil
+}
+
+// setPlugin sets the plugin of ss node, only simple-obfs is supported,
+// format: obfs-local;obfs=http;obfs-host=HOST.
+func (n *node) setPlugin(plugin string) error {
+	opts := strings.Split(plugin, ";")
+	if opts[0] != "obfs-local" && opts[0] != "simple-obfs" {
+		return errors.New("unsupported plugin: " + opts[0])
+	}
+
+	for _, opt := range opts[1:] {
+		k, v, _ := cut(opt, "=")
+		switch k {
+		case "obfs":
+			n.obfs = v
+		case "obfs-host":
+			n.obfsHost = v
+		}
+	}
+
+	if n.obfs == "" {
+		n.obfs = "http"
+	}
+	return nil
+}
+
+// parseVMessLink parses vmess links: vmess://BASE64(JSON), the json format of v2rayN.
+func parseVMessLink(s string) (*node, error) {
+	b, err := decodeBase64(s[len("vmess://"):])
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	str := func(k string) string {
+		switch v := m[k].(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		return ""
+	}
+
+	n := &node{
+		typ:      "vmess",
+		server:   str("add"),
+		port:     str("port"),
+		password: str("id"),
+		alterID:  str("aid"),
+		method:   str("scy"),
+		network:  str("net"),
+		tls:      str("tls") == "tls",
+		sni:      str("sni"),
+		path:     str("path"),
+		host:     str("host"),
+	}
+
+	if n.network == "tcp" && str("type") != "" && str("type") != "none" {
+		return nil, errors.New("unsupported header type: " + str("type"))
+	}
+
+	return n, nil
+}
+
+// parseTrojanLink parses trojan links: trojan://PASSWORD@HOST:PORT[?sni=SNI&allowInsecure=1&type=TYPE][#TAG].
+func parseTrojanLink(s string) (*node, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	n := &node{
+		typ:      "trojan",
+		server:   u.Hostname(),
+		port:     u.Port(),
+		password: u.User.Username(),
+		network:  q.Get("type"),
+		sni:      q.Get("sni"),
+		insecure: q.Get("allowInsecure") == "1" || q.Get("allowInsecure") == "true",
+	}
+	if n.sni == "" {
+		n.sni = q.Get("peer")
+	}
+
+	return n, nil
+}
+
+// parseSIP008 parses the SIP008 json format of ss servers.
+func parseSIP008(data []byte) ([]*node, error) {
+	var c struct {
+		Servers []struct {
+			Server     string `json:"server"`
+			ServerPort int    `json:"server_port"`
+			Password   string `json:"password"`
+			Method     string `json:"method"`
+			Plugin     string `json:"plugin"`
+			PluginOpts string `json:"plugin_opts"`
+		} `json:"servers"`
+	}
+
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+
+	var nodes []*node
+	for _, s := range c.Servers {
+		n := &node{typ: "ss", server: s.Server, port: strconv.Itoa(s.ServerPort), method: s.Method, password: s.Password}
+		if s.Plugin != "" {
+			if err := n.setPlugin(s.Plugin + ";" + s.PluginOpts); err != nil {
+				log.F("[subscription] skip ss server %s: %s", s.Server, err)
+				continue
+			}
+		}
+		nodes = append(nodes, n)
+	}
+
+	return nodes, nil
+}
+
+// clashProxy is a proxy in the "proxies" list of clash config.
+type clashProxy struct {
+	Type           string `yaml:"type"`
+	Server         string `yaml:"server"`
+	Port           string `yaml:"port"`
+	Cipher         string `yaml:"cipher"`
+	Password       string `yaml:"password"`
+	UUID           string `yaml:"uuid"`
+	AlterID        string `yaml:"alterId"`
+	TLS            bool   `yaml:"tls"`
+	SkipCertVerify bool   `yaml:"skip-cert-verify"`
+	ServerName     string `yaml:"servername"`
+	SNI            string `yaml:"sni"`
+	Network        string `yaml:"network"`
+	Plugin         string `yaml:"plugin"`
+	PluginOpts     struct {
+		Mode string `yaml:"mode"`
+		Host string `yaml:"host"`
+	} `yaml:"plugin-opts"`
+	WSOpts struct {
+		Path    string            `yaml:"path"`
+		Headers map[string]string `yaml:"headers"`
+	} `yaml:"ws-opts"`
+	WSPath    string            `yaml:"ws-path"`
+	WSHeaders map[string]string `yaml:"ws-headers"`
+}
+
+// parseClash parses the "proxies" section of clash yaml config.
+func parseClash(data []byte) (nodes []*node, skipped int, err error) {
+	var c struct {
+		Proxies []*clashProxy `yaml:"proxies"`
+	}
+
+	// fields of wrong types are left empty, the servers are checked below
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		if _, ok := err.(*yaml.TypeError); !ok {
+			return nil, 0, err
+		}
+		log.F("[subscription] clash config: %s", err)
+	}
+
+	for _, p := range c.Proxies {
+		if p == nil {
+			continue
+		}
+
+		n := &node{
+			typ:      p.Type,
+			server:   p.Server,
+			port:     p.Port,
+			tls:      p.TLS,
+			insecure: p.SkipCertVerify,
+			network:  p.Network,
+		}
+
+		switch n.typ {
+		case "ss":
+			n.method, n.password = p.Cipher, p.Password
+			switch p.Plugin {
+			case "":
+			case "obfs":
+				n.obfs, n.obfsHost = p.PluginOpts.Mode, p.PluginOpts.Host
+			default:
+				log.F("[subscription] skip ss server %s: unsupported plugin: %s", n.server, p.Plugin)
+				skipped++
+				continue
+			}
+		case "vmess":
+			n.password, n.alterID, n.method, n.sni = p.UUID, p.AlterID, p.Cipher, p.ServerName
+			n.path, n.host = p.WSOpts.Path, p.WSOpts.Headers["Host"]
+			if n.path == "" {
+				n.path, n.host = p.WSPath, p.WSHeaders["Host"]
+			}
+		case "trojan":
+			n.password, n.sni = p.Password, p.SNI
+		default:
+			log.F("[subscription] skip %s server %s: unsupported type", n.typ, n.server)
+			skipped++
+			continue
+		}
+
+		nodes = append(nodes, n)
+	}
+
+	return nodes, skipped, nil
+}
+
+// decodeBase64 decodes base64 data in standard or url encoding, with or without padding.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.Join(strings.Fields(s), "")
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// cut slices s around the first sep.
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
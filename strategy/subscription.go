@@ -0,0 +1,247 @@
+package strategy
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nadoo/glider/common/fileutil"
+	"github.com/nadoo/glider/common/log"
+	"github.com/nadoo/glider/proxy"
+)
+
+const (
+	subscriptionInterval = time.Hour
+	subscriptionRetry    = 5 * time.Minute
+	subscriptionTimeout  = 30 * time.Second
+	subscriptionMaxSize  = 8 << 20
+)
+
+// subscription is a forwarder provider, it loads forwarders from a subscription url or file.
+type subscription struct {
+	url      string // http(s) url or file path
+	interval time.Duration
+	priority string // priority of the forwarders
+	path     string // cache file of http(s) subscriptions
+	updated  time.Time
+	proxy    *Proxy
+}
+
+// Subscribe loads forwarders from a subscription and updates them periodically after Check is called,
+// format: URL|FILE[#interval=DURATION&priority=PRIORITY&path=FILE]. the forwarders of the subscription
+// are added to the forward urls in config, they're updated in place: the unchanged forwarders keep their
+// status. http(s) subscriptions are cached in path, default: subscriptions/HASH.txt in dir, the cache is
+// used when the subscription fails to load. the proxy rejects connections if it has no forwarders.
+func (p *Proxy) Subscribe(s, dir string) error {
+	sub := &subscription{url: s, interval: subscriptionInterval, proxy: p}
+	if i := strings.IndexByte(s, '#'); i != -1 {
+		sub.url = s[:i]
+
+		query, err := url.ParseQuery(s[i+1:])
+		if err != nil {
+			return err
+		}
+
+		if v := query.Get("interval"); v != "" {
+			if sub.interval, err = time.ParseDuration(v); err != nil {
+				return err
+			}
+			if sub.interval < time.Minute {
+				sub.interval = time.Minute
+			}
+		}
+
+		if v := query.Get("priority"); v != "" {
+			if _, err := strconv.ParseUint(v, 10, 32); err != nil {
+				return err
+			}
+			sub.priority = v
+		}
+
+		sub.path = query.Get("path")
+	}
+
+	if sub.url == "" {
+		return errors.New("empty subscription")
+	}
+
+	if sub.remote() {
+		if sub.path == "" {
+			h := fnv.New64a()
+			h.Write([]byte(sub.url))
+			sub.path = filepath.Join("subscriptions", strconv.FormatUint(h.Sum64(), 16)+".txt")
+		}
+		if !filepath.IsAbs(sub.path) {
+			sub.path = filepath.Join(dir, sub.path)
+		}
+
+		if err := sub.loadCache(); err != nil && !os.IsNotExist(err) {
+			log.F("[strategy] %s: load subscription cache %s error: %s", p.name, sub.path, err)
+		}
+	}
+
+	// update now if there's no valid cache
+	if time.Since(sub.updated) >= sub.interval {
+		if err := sub.update(); err != nil {
+			log.F("[strategy] %s: load subscription %s error: %s", p.name, sub.url, err)
+		}
+	}
+
+	if ok, err := p.rejectPlaceholder(); err != nil {
+		return err
+	} else if ok {
+		log.F("[strategy] %s: WARNING: no forwarders loaded from subscriptions, reject connections until they're loaded", p.name)
+	}
+
+	p.subs = append(p.subs, sub)
+	return nil
+}
+
+// remote reports whether the subscription is downloaded from a http(s) url.
+func (sub *subscription) remote() bool {
+	return strings.HasPrefix(sub.url, "http://") || strings.HasPrefix(sub.url, "https://")
+}
+
+// run updates the subscription periodically, the first update is after the loaded forwarders expired.
+func (sub *subscription) run() {
+	next := sub.updated.Add(sub.interval)
+	if sub.updated.IsZero() {
+		next = time.Now().Add(subscriptionRetry)
+	}
+	for {
+		time.Sleep(time.Until(next))
+
+		if err := sub.update(); err != nil {
+			retry := subscriptionRetry
+			if retry > sub.interval {
+				retry = sub.interval
+			}
+			log.F("[strategy] %s: update subscription %s error: %s, retry in %s", sub.proxy.name, sub.url, err, retry)
+			next = time.Now().Add(retry)
+			continue
+		}
+
+		next = time.Now().Add(sub.interval)
+	}
+}
+
+// update loads the subscription, replaces the forwarders of it and saves it to the cache file.
+func (sub *subscription) update() error {
+	data, err := sub.load()
+	if err != nil {
+		return err
+	}
+
+	if err := sub.apply(data); err != nil {
+		return err
+	}
+
+	// the cache is readable by the owner only as it contains the passwords of servers
+	if sub.path != "" {
+		if err := fileutil.WriteFileAtomic(sub.path, data, 0600); err != nil {
+			log.F("[strategy] %s: save subscription cache %s error: %s", sub.proxy.name, sub.path, err)
+		}
+	}
+
+	return nil
+}
+
+// loadCache loads the forwarders from the cache file.
+func (sub *subscription) loadCache() error {
+	fi, err := os.Stat(sub.path)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(sub.path)
+	if err != nil {
+		return err
+	}
+
+	if err := sub.apply(data); err != nil {
+		return err
+	}
+	sub.updated = fi.ModTime()
+
+	log.F("[strategy] %s: subscription %s loaded from cache %s", sub.proxy.name, sub.url, sub.path)
+	return nil
+}
+
+// apply parses the subscription data and replaces the forwarders of the subscription.
+func (sub *subscription) apply(data []byte) error {
+	urls, skipped, err := parseSubscription(data)
+	if err != nil {
+		return err
+	}
+
+	if sub.priority != "" {
+		for i := range urls {
+			urls[i] += "#priority=" + sub.priority
+		}
+	}
+
+	added, removed, err := sub.proxy.setForwarders(sub.url, urls)
+	if err != nil {
+		return err
+	}
+
+	sub.updated = time.Now()
+	log.F("[strategy] %s: subscription %s updated, %d forwarders, %d added, %d removed, %d unsupported skipped",
+		sub.proxy.name, sub.url, len(urls), added, removed, skipped)
+
+	return nil
+}
+
+// load reads the subscription from file or downloads it directly.
+func (sub *subscription) load() ([]byte, error) {
+	if !sub.remote() {
+		return ioutil.ReadFile(sub.url)
+	}
+
+	c := sub.proxy.config
+	d, err := proxy.NewDirect(c.IntFace, c.IPFamily,
+		time.Duration(c.DialTimeout)*time.Second, time.Duration(c.RelayTimeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Timeout: subscriptionTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return d.Dial(network, addr)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	resp, err := client.Get(sub.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected http status: " + resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, subscriptionMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > subscriptionMaxSize {
+		return nil, errors.New("subscription too large")
+	}
+
+	return data, nil
+}
@@ -0,0 +1,201 @@
+package strategy
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func b64(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+func b64url(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+func TestParseSubscription(t *testing.T) {
+	vmess := `{"v":"2","ps":"tag","add":"v.example.com","port":443,"id":"b831381d-6324-4d53-ad4f-8cda48b30811",` +
+		`"aid":"0","net":"ws","type":"none","host":"cdn.example.com","path":"/ws","tls":"tls","sni":"v.example.com"}`
+
+	tests := []struct {
+		name    string
+		data    string
+		urls    []string
+		skipped int
+	}{
+		{
+			name: "ss sip002",
+			data: "ss://" + b64url("aes-256-gcm:pass") + "@1.2.3.4:8388#tag\n" +
+				"ss://" + b64url("aes-128-gcm:pass") + "@s.example.com:443/?plugin=obfs-local%3Bobfs%3Dtls%3Bobfs-host%3Dh.example.com#obfs\n",
+			urls: []string{
+				"ss://aes-256-gcm:pass@1.2.3.4:8388",
+				"simple-obfs://s.example.com:443?type=tls&host=h.example.com,ss://aes-128-gcm:pass@",
+			},
+		},
+		{
+			name: "ss legacy",
+			data: "ss://" + b64("chacha20-ietf-poly1305:p@ss@5.6.7.8:443") + "#tag",
+			urls: []string{"ss://chacha20-ietf-poly1305:p%40ss@5.6.7.8:443"},
+		},
+		{
+			name: "vmess",
+			data: "vmess://" + b64(vmess),
+			urls: []string{"tls://v.example.com:443?serverName=v.example.com,ws://@/ws?host=cdn.example.com," +
+				"vmess://aes-128-gcm:b831381d-6324-4d53-ad4f-8cda48b30811@"},
+		},
+		{
+			name:    "trojan",
+			data:    "trojan://pass@t.example.com:443?allowInsecure=1#tag\ntrojan://pass@t.example.com:443?type=grpc",
+			urls:    []string{"trojan://pass@t.example.com:443?skipVerify=true"},
+			skipped: 1,
+		},
+		{
+			name:    "base64 links",
+			data:    b64("ss://" + b64url("aes-256-gcm:pass") + "@1.2.3.4:8388\nhttp://unsupported\n"),
+			urls:    []string{"ss://aes-256-gcm:pass@1.2.3.4:8388"},
+			skipped: 1,
+		},
+		{
+			name: "sip008",
+			data: `{"version":1,"servers":[` +
+				`{"server":"1.2.3.4","server_port":8388,"password":"pass","method":"aes-256-gcm"},` +
+				`{"server":"5.6.7.8","server_port":443,"password":"pass","method":"aes-128-gcm","plugin":"obfs-local","plugin_opts":"obfs=http"}]}`,
+			urls: []string{
+				"ss://aes-256-gcm:pass@1.2.3.4:8388",
+				"simple-obfs://5.6.7.8:443?type=http,ss://aes-128-gcm:pass@",
+			},
+		},
+		{
+			name: "clash block",
+			data: `port: 7890
+proxies:
+  - name: "ss"
+    type: ss
+    server: 1.2.3.4
+    port: 8388
+    cipher: aes-256-gcm
+    password: "pass" # comment
+    plugin: obfs
+    plugin-opts:
+      mode: http
+      host: h.example.com
+  - name: vmess
+    type: vmess
+    server: v.example.com
+    port: 443
+    uuid: b831381d-6324-4d53-ad4f-8cda48b30811
+    alterId: 0
+    cipher: auto
+    tls: true
+    network: ws
+    ws-opts:
+      path: /ws
+      headers:
+        Host: cdn.example.com
+  - name: snell
+    type: snell
+    server: 5.6.7.8
+    port: 443
+proxy-groups:
+  - name: auto
+    type: url-test
+`,
+			urls: []string{
+				"simple-obfs://1.2.3.4:8388?type=http&host=h.example.com,ss://aes-256-gcm:pass@",
+				"tls://v.example.com:443,ws://@/ws?host=cdn.example.com,vmess://aes-128-gcm:b831381d-6324-4d53-ad4f-8cda48b30811@",
+			},
+			skipped: 1,
+		},
+		{
+			name: "clash flow",
+			data: `proxies:
+  - {name: ss, type: ss, server: 1.2.3.4, port: 8388, cipher: aes-256-gcm, password: "p,ss"}
+  - {name: "trojan", type: trojan, server: t.example.com, port: 443, password: pass, skip-cert-verify: true, alpn: [h2]}
+`,
+			urls: []string{
+				"ss://aes-256-gcm:p%2Css@1.2.3.4:8388",
+				"trojan://pass@t.example.com:443?skipVerify=true",
+			},
+		},
+		{
+			name: "clash config",
+			data: `# profile from a subscription service
+mixed-port: 7890
+allow-lan: false
+mode: rule
+log-level: info
+dns:
+  enable: true
+  nameserver:
+    - 223.5.5.5
+    - https://dns.example.com/dns-query
+x-ss: &ss
+  type: ss
+  cipher: chacha20-ietf-poly1305
+  udp: true
+proxies:
+- <<: *ss
+  name: "\U0001F1ED\U0001F1F0 HK 01"
+  server: hk.example.com
+  port: 20001
+  password: 'it''s secret'
+- <<: *ss
+  name: JP 01 # anchors merged
+  "server": jp.example.com
+  port: "20002"
+  password: "p#ss"
+- {
+    name: US 01, type: vmess, server: us.example.com, port: 443,
+    uuid: b831381d-6324-4d53-ad4f-8cda48b30811, alterId: 64, cipher: auto,
+    tls: true, servername: sni.example.com, network: ws,
+    ws-path: /path, ws-headers: {Host: cdn.example.com}
+  }
+- name: SG 01
+  type: trojan
+  server: sg.example.com
+  port: 443
+  password: >-
+    folded
+  sni: sg.example.com
+  udp: true
+- {name: KR 01, type: ss, server: kr.example.com, port: 8388, cipher: aes-128-gcm, password: pass, plugin: v2ray-plugin}
+proxy-groups:
+- name: Proxy
+  type: select
+  proxies:
+  - HK 01
+  - JP 01
+rules:
+- DOMAIN-SUFFIX,example.com,Proxy
+- MATCH,DIRECT
+`,
+			urls: []string{
+				"ss://chacha20-ietf-poly1305:it%27s%20secret@hk.example.com:20001",
+				"ss://chacha20-ietf-poly1305:p%23ss@jp.example.com:20002",
+				"tls://us.example.com:443?serverName=sni.example.com,ws://@/path?host=cdn.example.com," +
+					"vmess://aes-128-gcm:b831381d-6324-4d53-ad4f-8cda48b30811@?alterID=64",
+				"trojan://folded@sg.example.com:443",
+			},
+			skipped: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		urls, skipped, err := parseSubscription([]byte(tt.data))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(urls, tt.urls) {
+			t.Errorf("%s: urls = %q, want %q", tt.name, urls, tt.urls)
+		}
+		if skipped != tt.skipped {
+			t.Errorf("%s: skipped = %d, want %d", tt.name, skipped, tt.skipped)
+		}
+	}
+}
+
+func TestParseSubscriptionEmpty(t *testing.T) {
+	for _, data := range []string{"", "proxies:\n", `{"servers":[]}`, "http://unsupported", "proxies:\n  - {name: a\n"} {
+		if _, _, err := parseSubscription([]byte(data)); err == nil {
+			t.Errorf("parseSubscription(%q): expected error", data)
+		}
+	}
+}